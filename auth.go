@@ -0,0 +1,179 @@
+package feedbot
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FeedAuth contains the credentials and extra request parameters needed to fetch a feed
+type FeedAuth struct {
+	Username string            `json:"username,omitempty"`
+	Password string            `json:"password,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Query    map[string]string `json:"query,omitempty"`
+}
+
+// Empty returns true if the FeedAuth would not change a request
+func (a *FeedAuth) Empty() bool {
+	return a.Username == "" && a.Password == "" && len(a.Headers) == 0 && len(a.Query) == 0
+}
+
+// Describe lists what the FeedAuth contains without revealing any secret values
+func (a *FeedAuth) Describe() string {
+	var parts []string
+	if a.Username != "" || a.Password != "" {
+		parts = append(parts, "basic auth as `"+a.Username+"`")
+	}
+	for _, k := range sortedKeys(a.Headers) {
+		parts = append(parts, "header `"+k+"`")
+	}
+	for _, k := range sortedKeys(a.Query) {
+		parts = append(parts, "query `"+k+"`")
+	}
+	if len(parts) == 0 {
+		return "no credentials"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// apply adds the FeedAuth's credentials to an outgoing request
+func (a *FeedAuth) apply(req *http.Request) {
+	if a.Username != "" || a.Password != "" {
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+	for k, v := range a.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(a.Query) > 0 {
+		q := req.URL.Query()
+		for k, v := range a.Query {
+			q.Set(k, v)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+}
+
+// strip removes the FeedAuth's credentials from a request, such as a redirect to another
+// host, which mustn't be handed them
+func (a *FeedAuth) strip(req *http.Request) {
+	req.Header.Del("Authorization")
+	for k := range a.Headers {
+		req.Header.Del(k)
+	}
+	if len(a.Query) > 0 {
+		q := req.URL.Query()
+		for k := range a.Query {
+			q.Del(k)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+}
+
+// reservedHeaders may not be overridden by a FeedAuth
+var reservedHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+}
+
+// ValidHeader checks that a header may be set on a FeedAuth
+func ValidHeader(name string) bool {
+	if name == "" || strings.ContainsAny(name, " :\r\n") {
+		return false
+	}
+	return !reservedHeaders[http.CanonicalHeaderKey(name)]
+}
+
+// Vault encrypts feed credentials before they are written to the database
+type Vault struct {
+	aead cipher.AEAD
+}
+
+// NewVault creates a Vault from a 32 byte key
+func NewVault(key []byte) (*Vault, error) {
+	if len(key) != 32 {
+		return nil, errors.New("secret key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Vault{aead: aead}, nil
+}
+
+// ParseSecretKey decodes a base64 encoded secret key
+func ParseSecretKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "secret key must be base64 encoded")
+	}
+	if len(key) != 32 {
+		return nil, errors.New("secret key must decode to 32 bytes")
+	}
+	return key, nil
+}
+
+// Seal encrypts a FeedAuth, prefixing the result with its nonce
+func (v *Vault) Seal(a *FeedAuth) ([]byte, error) {
+	plain, err := json.Marshal(a)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return v.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Open decrypts a FeedAuth produced by Seal
+func (v *Vault) Open(sealed []byte) (*FeedAuth, error) {
+	n := v.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("sealed credentials are too short")
+	}
+	plain, err := v.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't decrypt credentials; was the secret key changed?")
+	}
+	var a FeedAuth
+	if err = json.Unmarshal(plain, &a); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &a, nil
+}
+
+// redactURI strips any query string from a URI, in case it contains a key
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
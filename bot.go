@@ -1,80 +1,501 @@
-package feedbot
-
-import (
-	"fmt"
-	"log"
-	"os"
-	"os/signal"
-
-	"github.com/bwmarrin/discordgo"
-)
-
-var l = log.New(os.Stdout, "bot", log.Lshortfile|log.Ltime)
-
-// Bot contains the Bot's state
-type Bot struct {
-	c  *Controller
-	dg *discordgo.Session
-	fc *FeedChecker
-}
-
-// NewBot creates a new bot instance
-func NewBot(token string) (*Bot, error) {
-	session, err := discordgo.New(token)
-	if err != nil {
-		return nil, err
-	}
-
-	c, err := NewController()
-	if err != nil {
-		return nil, err
-	}
-
-	fc, err := NewFeedChecker(c)
-	if err != nil {
-		return nil, err
-	}
-
-	bot := &Bot{
-		c:  c,
-		dg: session,
-		fc: fc,
-	}
-
-	session.AddHandler(bot.onReady)
-	session.AddHandler(bot.onMessageCreate)
-
-	return bot, nil
-}
-
-// Run the bot
-func (bot *Bot) Run() error {
-	err := bot.dg.Open()
-	if err != nil {
-		return err
-	}
-
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, os.Interrupt, os.Kill)
-	<-sc
-
-	return nil
-}
-
-func (bot *Bot) onGuildCreate(s *discordgo.Session, e *discordgo.GuildCreate) {
-	if e.Guild.Unavailable {
-		return
-	}
-	println("joined guild", e.Name)
-	contact := "u:" + e.OwnerID
-	err := bot.c.CreateGuildConfig(e.ID, contact)
-	if err != nil {
-		log.Println(fmt.Sprintf("evt:join err:%v", err))
-	}
-}
-func (bot *Bot) onGuildDelete(s *discordgo.Session, e *discordgo.GuildDelete) {
-	if e.Guild.Unavailable {
-		return
-	}
-	println("left guild", e.Name)
-}
+package feedbot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+)
+
+// Bot contains the Bot's state
+type Bot struct {
+	c Storage
+	// db is the database the bot opened, and must close; nil if given a Storage
+	db      *Controller
+	shards  *shards
+	fc      *FeedChecker
+	sources *Sources
+	vault   *Vault
+	log     *slog.Logger
+	// metrics and ops are nil unless an ops listener is configured
+	metrics      *Metrics
+	ops          *opsServer
+	healthWindow time.Duration
+	// leader is nil unless instances elect a leader
+	leader *Leader
+	// shardLeaders elect which instance answers each shard's commands, by shard ID; they
+	// are created before the shards are connected, and nil unless leader is set
+	shardLeaders map[int]*Leader
+
+	router         *router
+	owners         []string
+	guildRetention time.Duration
+	feedRetention  time.Duration
+
+	// ctx lives as long as the bot, every command, check and delivery derives from it;
+	// it is cancelled once shutdown gives up waiting for them
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// stopping is closed when shutdown begins, so no new check or purge is started
+	stopping        chan struct{}
+	shutdownTimeout time.Duration
+
+	// mu guards closing; once it is set, wg is no longer added to
+	mu      sync.Mutex
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// Config contains the settings used to create a Bot; see LoadConfig
+type Config struct {
+	// Token is the Discord token, including its "Bot " prefix
+	Token string
+	// Owners may run owner-only commands, along with the owner of the bot's application
+	Owners []string
+	// Prefix is what commands start with, besides a mention of the bot, in direct messages
+	// and guilds which haven't set their own
+	Prefix string
+	// LogLevel is the least severe kind of message which is logged
+	LogLevel LogLevel
+	// LogFormat is how log records are written to stdout, LogText or LogJSON
+	LogFormat string
+	// Logger is used instead of LogLevel and LogFormat when set
+	Logger *slog.Logger
+	// Database contains the location of the database and its connection settings
+	Database DatabaseConfig
+	// Storage is used instead of opening Database when set, e.g. with a MemoryStorage
+	Storage Storage
+	// Checker contains how often, and how many at a time, feeds are polled
+	Checker CheckerConfig
+	// Fetcher contains the limits applied when fetching feeds
+	Fetcher FetcherConfig
+	// LocalSources allows the bot's owner to add file:// and exec:// feeds
+	LocalSources bool
+	// WebSub configures push subscriptions; they are disabled without a CallbackURL
+	WebSub WebSubConfig
+	// GuildRetention is how long a guild's data is kept after the bot is removed from it
+	GuildRetention time.Duration
+	// FeedRetention is how long a feed nobody subscribes to is kept before it is deleted
+	FeedRetention time.Duration
+	// SecretKey encrypts feed credentials at rest; the auth command is disabled without one
+	SecretKey []byte
+	// OpsAddr is where Prometheus metrics, and health and readiness checks, are served
+	// from, e.g. ":9090"; the listener is disabled when it is empty
+	OpsAddr string
+	// HealthWindow is how long the checker may go without completing a check before the
+	// bot is unhealthy; zero means three checker intervals
+	HealthWindow time.Duration
+	// LeaderLease lets several instances share a database, one checking feeds while the
+	// others stand by, and one answering the commands of each shard; the leader holds a
+	// lease for this long, renewing it as it goes, and a standby takes over once it
+	// expires. Zero means this is the only instance.
+	LeaderLease time.Duration
+	// Shards contains which gateway shards this process runs; feeds are checked once per
+	// process, however many shards it runs
+	Shards ShardConfig
+	// ShutdownTimeout is how long in-flight commands, checks and deliveries are given to
+	// finish once the bot is asked to stop
+	ShutdownTimeout time.Duration
+}
+
+// NewBot creates a new bot instance
+func NewBot(config Config) (*Bot, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	log := config.Logger
+	if log == nil {
+		var err error
+		if log, err = NewLogger(os.Stdout, config.LogLevel, config.LogFormat); err != nil {
+			return nil, err
+		}
+	}
+
+	shards, err := newShards(config.Token, config.Shards)
+	if err != nil {
+		return nil, err
+	}
+
+	var db *Controller
+	c := config.Storage
+	if c == nil {
+		if db, err = NewController(config.Database, log); err != nil {
+			return nil, err
+		}
+		if err = db.CheckSchema(context.Background()); err != nil {
+			db.Close()
+			return nil, err
+		}
+		c = db
+	}
+
+	var vault *Vault
+	if len(config.SecretKey) > 0 {
+		if vault, err = NewVault(config.SecretKey); err != nil {
+			return nil, err
+		}
+	}
+
+	var metrics *Metrics
+	if config.OpsAddr != "" {
+		metrics = NewMetrics(c)
+		if db != nil {
+			db.metrics = metrics
+		}
+	}
+
+	fetcher := NewFetcher(config.Fetcher)
+	fetcher.metrics = metrics
+	sources := NewSources(fetcher, config.LocalSources)
+	fc, err := NewFeedChecker(config.Checker, c, sources, vault, log)
+	if err != nil {
+		return nil, err
+	}
+	fc.metrics = metrics
+	fc.delivery = NewDelivery(c, shards.forGuild, log)
+	fc.delivery.metrics = metrics
+	if config.WebSub.CallbackURL != "" {
+		fc.websub = NewWebSub(config.WebSub, c, fetcher, fc.handleFeed, log)
+	}
+	if config.LeaderLease > 0 {
+		fc.leader = NewLeader(c, checkerLease, config.LeaderLease, log)
+	}
+
+	healthWindow := config.HealthWindow
+	if healthWindow == 0 {
+		healthWindow = 3 * config.Checker.Interval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bot := &Bot{
+		c:       c,
+		db:      db,
+		shards:  shards,
+		fc:      fc,
+		sources: sources,
+		vault:   vault,
+		log:     log,
+		metrics: metrics,
+		leader:  fc.leader,
+
+		healthWindow: healthWindow,
+
+		router:         newRouter(c, config.Prefix),
+		owners:         config.Owners,
+		guildRetention: config.GuildRetention,
+		feedRetention:  config.FeedRetention,
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		stopping:        make(chan struct{}),
+		shutdownTimeout: config.ShutdownTimeout,
+	}
+	if config.OpsAddr != "" {
+		bot.ops = newOpsServer(config.OpsAddr, metrics, bot.healthz, bot.readyz)
+	}
+
+	shards.addHandler(bot.onReady)
+	shards.addHandler(bot.onResumed)
+	shards.addHandler(bot.onDisconnect)
+	shards.addHandler(bot.onMessageCreate)
+	shards.addHandler(bot.onGuildCreate)
+	shards.addHandler(bot.onGuildDelete)
+	shards.addHandler(bot.onRateLimit)
+
+	return bot, nil
+}
+
+// Run the bot until it receives SIGINT or SIGTERM, and then shut it down
+func (bot *Bot) Run() error {
+	defer bot.cancel()
+
+	if bot.ops != nil {
+		// not spawned, it keeps serving until everything else has shut down
+		go func() {
+			if err := bot.ops.ListenAndServe(); err != nil {
+				bot.log.Error("ops server failed", "err", err)
+			}
+		}()
+	}
+
+	ids, count, err := bot.shards.create()
+	if err != nil {
+		return err
+	}
+	if bot.leader != nil {
+		// not spawned, the leases are kept until everything else has finished
+		go bot.leader.Run(bot.ctx)
+		bot.shardLeaders = map[int]*Leader{}
+		for _, id := range ids {
+			l := NewLeader(bot.c, shardLease(id, count), bot.leader.ttl, bot.log)
+			bot.shardLeaders[id] = l
+			go l.Run(bot.ctx)
+		}
+	}
+	if err = bot.shards.open(); err != nil {
+		return err
+	}
+
+	if bot.fc.websub != nil {
+		bot.spawn(func() {
+			if err := bot.fc.websub.ListenAndServe(bot.ctx); err != nil {
+				bot.log.Error("websub server failed", "err", err)
+			}
+		})
+	}
+	bot.spawn(func() { bot.fc.Run(bot.ctx, bot.stopping) })
+	bot.spawn(func() { bot.purge(bot.ctx, bot.stopping) })
+
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, os.Interrupt, syscall.SIGTERM)
+	sig := <-sc
+	signal.Stop(sc)
+	bot.log.Info("shutting down", "signal", sig.String())
+
+	return bot.shutdown()
+}
+
+// healthz fails once the checker hasn't completed a check within the health window, so an
+// orchestrator restarts a bot which has wedged
+func (bot *Bot) healthz(w http.ResponseWriter, r *http.Request) {
+	last := bot.fc.LastCheck()
+	if !last.IsZero() && time.Since(last) > bot.healthWindow {
+		http.Error(w, fmt.Sprintf("feeds last checked %v ago", time.Since(last).Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz succeeds once every shard is connected and ready, while the database can be
+// reached
+func (bot *Bot) readyz(w http.ResponseWriter, r *http.Request) {
+	if !bot.shards.allReady() {
+		http.Error(w, "not connected to discord", http.StatusServiceUnavailable)
+		return
+	}
+	if bot.db != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		if err := bot.db.Ping(ctx); err != nil {
+			bot.log.Warn("couldn't ping the database", "err", err)
+			http.Error(w, "couldn't reach the database", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// isOwner reports whether a user may run owner-only commands
+func (bot *Bot) isOwner(userID string) bool {
+	if bot.router.isOwner(userID) {
+		return true
+	}
+	for _, id := range bot.owners {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// track registers a unit of work for shutdown to wait on; it reports false, and the work
+// should be dropped, once shutdown has begun. Callers must call wg.Done when finished.
+func (bot *Bot) track() bool {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if bot.closing {
+		return false
+	}
+	bot.wg.Add(1)
+	return true
+}
+
+// spawn runs f in a goroutine which shutdown waits on
+func (bot *Bot) spawn(f func()) {
+	if !bot.track() {
+		return
+	}
+	go func() {
+		defer bot.wg.Done()
+		f()
+	}()
+}
+
+// cancelGrace is how long in-flight work is given to stop once cancelled on shutdown
+const cancelGrace = 5 * time.Second
+
+// shutdown stops accepting commands and pushes, and gives in-flight work until the
+// shutdown timeout to finish before cancelling it. The shards and database are closed
+// last, so that work can still reply and record what it delivered.
+func (bot *Bot) shutdown() error {
+	bot.shards.setAllReady(false)
+	bot.mu.Lock()
+	bot.closing = true
+	bot.mu.Unlock()
+	close(bot.stopping)
+
+	deadline, cancel := context.WithTimeout(context.Background(), bot.shutdownTimeout)
+	defer cancel()
+
+	if bot.fc.websub != nil {
+		// waits for pushes being delivered, within the deadline
+		if err := bot.fc.websub.Shutdown(deadline); err != nil {
+			bot.log.Warn("couldn't shut down the websub server", "err", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		bot.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-deadline.Done():
+		bot.log.Warn("in-flight work didn't finish in time, cancelling it", "duration", bot.shutdownTimeout)
+		bot.cancel()
+		// everything gives up promptly once cancelled, except a Discord request which is
+		// already in flight; those are abandoned if they hang, closing the sessions under them
+		select {
+		case <-done:
+		case <-time.After(cancelGrace):
+			bot.log.Error("in-flight work didn't stop once cancelled, abandoning it", "duration", cancelGrace)
+		}
+	}
+	bot.cancel()
+
+	resign, cancelResign := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelResign()
+	bot.leader.resign(resign)
+	for _, l := range bot.shardLeaders {
+		l.resign(resign)
+	}
+
+	var errs []error
+	if err := bot.shards.close(); err != nil {
+		errs = append(errs, err)
+	}
+	if bot.db != nil {
+		if err := bot.db.Close(); err != nil {
+			errs = append(errs, errors.Wrap(err, "couldn't close the database"))
+		}
+	}
+	if bot.ops != nil {
+		if err := bot.ops.Close(); err != nil {
+			errs = append(errs, errors.Wrap(err, "couldn't close the ops server"))
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	bot.log.Info("shut down cleanly")
+	return nil
+}
+
+func (bot *Bot) onResumed(s *discordgo.Session, e *discordgo.Resumed) {
+	bot.shards.setReady(s, true)
+}
+
+func (bot *Bot) onDisconnect(s *discordgo.Session, e *discordgo.Disconnect) {
+	bot.shards.setReady(s, false)
+	bot.log.Warn("disconnected from discord", "shard", s.ShardID)
+}
+
+func (bot *Bot) onRateLimit(s *discordgo.Session, e *discordgo.RateLimit) {
+	bot.metrics.rateLimited()
+	bot.log.Debug("rate limited by discord", "url", e.URL)
+}
+
+func (bot *Bot) onGuildCreate(s *discordgo.Session, e *discordgo.GuildCreate) {
+	if e.Guild.Unavailable || !bot.track() {
+		return
+	}
+	defer bot.wg.Done()
+	log := bot.log.With("guild_id", e.ID)
+	log.Info("joined guild", "name", e.Name)
+	contact := "u:" + e.OwnerID
+	err := bot.c.CreateGuildConfig(bot.ctx, e.ID, contact)
+	if err != nil {
+		log.Error("couldn't create the guild's config", "err", err)
+	}
+}
+func (bot *Bot) onGuildDelete(s *discordgo.Session, e *discordgo.GuildDelete) {
+	// an unavailable guild is an outage, we haven't actually been removed
+	if e.Guild.Unavailable || !bot.track() {
+		return
+	}
+	defer bot.wg.Done()
+	log := bot.log.With("guild_id", e.ID)
+	log.Info("left guild")
+	bot.router.forget(e.ID)
+	err := bot.c.MarkGuildLeft(bot.ctx, e.ID, time.Now())
+	if err != nil {
+		log.Error("couldn't mark the guild as left", "err", err)
+	}
+}
+
+// purge runs hourly, and as soon as this instance is elected leader, destroying the data
+// of guilds the bot left more than guildRetention ago, and then feeds which have had no
+// subscribers for feedRetention. The grace period means a guild that kicks and re-invites
+// the bot keeps its setup.
+func (bot *Bot) purge(ctx context.Context, stop <-chan struct{}) {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	elected := bot.leader.Elected()
+
+	for {
+		// the leader purges for every instance
+		if bot.leader.Leading() {
+			bot.purgeGuilds(ctx)
+			bot.purgeFeeds(ctx)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		case <-elected:
+		}
+	}
+}
+
+func (bot *Bot) purgeGuilds(ctx context.Context) {
+	ids, err := bot.c.GetDepartedGuilds(ctx, time.Now().Add(-bot.guildRetention))
+	if err != nil {
+		bot.log.Error("couldn't find departed guilds", "err", err)
+		return
+	}
+	for _, id := range ids {
+		if err = bot.c.DestroyGuildData(ctx, id); err != nil {
+			bot.log.Error("couldn't purge guild", "guild_id", id, "err", err)
+			continue
+		}
+		bot.log.Info("purged guild", "guild_id", id)
+	}
+}
+
+func (bot *Bot) purgeFeeds(ctx context.Context) {
+	now := time.Now()
+	if err := bot.c.MarkOrphanedFeeds(ctx, now); err != nil {
+		bot.log.Error("couldn't mark orphaned feeds", "err", err)
+		return
+	}
+	n, err := bot.c.DestroyOrphanedFeeds(ctx, now.Add(-bot.feedRetention), now)
+	if err != nil {
+		bot.log.Error("couldn't collect orphaned feeds", "err", err)
+		return
+	}
+	if n > 0 {
+		bot.log.Info("collected orphaned feeds", "feeds", n)
+	}
+}
@@ -1,26 +1,50 @@
-package main
-
-import (
-	"flag"
-	"fmt"
-
-	"github.com/foxbot/feedbot"
-)
-
-var token = flag.String("token", "", "token=unprefixed token")
-
-func main() {
-	println("feedbot")
-	flag.Parse()
-
-	t := fmt.Sprintf("Bot %s", *token)
-	bot, err := feedbot.NewBot(t)
-	if err != nil {
-		panic(err)
-	}
-
-	err = bot.Run()
-	if err != nil {
-		panic(err)
-	}
-}
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/foxbot/feedbot"
+)
+
+const usage = `usage: feedbot [flags]
+
+settings are read from the file given by -config or FEEDBOT_CONFIG, then from FEEDBOT_*
+environment variables, and then from flags; see feedbot.example.toml.
+
+flags:
+`
+
+func main() {
+	println("feedbot")
+
+	path := feedbot.ConfigPath(os.Args[1:])
+	config, err := feedbot.LoadConfig(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	flag.String("config", path, "config=path to a TOML config file")
+	config.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err = config.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	bot, err := feedbot.NewBot(config)
+	if err != nil {
+		panic(err)
+	}
+
+	err = bot.Run()
+	if err != nil {
+		panic(err)
+	}
+}
@@ -1,23 +1,104 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
 	"os"
+	"strconv"
 
 	"github.com/foxbot/feedbot"
 )
 
+const usage = `usage: migrate [flags] <command>
+
+the database is the one feedbot uses: settings are read from the file given by -config or
+FEEDBOT_CONFIG, then from FEEDBOT_DATABASE_* environment variables, and then from flags.
+
+commands:
+  up        apply every pending migration
+  down      revert the most recently applied migration
+  to <n>    apply or revert migrations until the database is at version n
+  status    list every migration, and whether it has been applied
+
+flags:
+`
+
 func main() {
-	if _, err := os.Stat("data.db"); !os.IsNotExist(err) {
-		panic("databae already exists, please remove first")
+	path := feedbot.ConfigPath(os.Args[1:])
+	config, err := feedbot.LoadConfig(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	println("migrating up...")
-	c, err := feedbot.NewController()
+	db := config.Database
+	flag.String("config", path, "config=path to a TOML config file")
+	db.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	// each migration is logged as it is applied or reverted
+	c, err := feedbot.NewController(db, slog.Default())
 	if err != nil {
 		panic(err)
 	}
-	err = c.CreateTables()
+
+	switch flag.Arg(0) {
+	case "up":
+		println("migrating up...")
+		err = c.MigrateUp(ctx)
+	case "down":
+		println("migrating down...")
+		err = c.MigrateDown(ctx)
+	case "to":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		n, convErr := strconv.Atoi(flag.Arg(1))
+		if convErr != nil {
+			flag.Usage()
+			os.Exit(2)
+		}
+		println("migrating to", n, "...")
+		err = c.MigrateTo(ctx, n)
+	case "status":
+		err = status(ctx, c)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 	if err != nil {
 		panic(err)
 	}
-	println("ok!")
+
+	v, err := c.SchemaVersion(ctx)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("ok! database is at version %d\n", v)
+}
+
+func status(ctx context.Context, c *feedbot.Controller) error {
+	migrations, err := c.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		applied := "pending"
+		if m.Applied {
+			applied = "applied " + m.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%04d %-24s %s\n", m.Version, m.Name, applied)
+	}
+	return nil
 }
@@ -1,130 +1,323 @@
 package feedbot
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/pkg/errors"
 )
 
-type context struct {
-	bot  *Bot
-	s    *discordgo.Session
-	m    *discordgo.MessageCreate
+// commandContext is the context a command runs under; it is cancelled once the command
+// times out, or the bot shuts down
+type commandContext struct {
+	context.Context
+	bot *Bot
+	s   *discordgo.Session
+	m   *discordgo.MessageCreate
+	// path is the command being run, after any parent commands
+	path []*command
 	args []string
+	log  *slog.Logger
 }
 
 // Reply sends a message to the source channel
-func (c *context) Reply(m string) error {
+func (c *commandContext) Reply(m string) error {
 	_, err := c.s.ChannelMessageSend(c.m.ChannelID, m)
 	return err
 }
 
-type commandHandler = func(c *context) error
+// ReplyFile sends a message to the source channel, with a file attached
+func (c *commandContext) ReplyFile(m string, name string, r io.Reader) error {
+	_, err := c.s.ChannelMessageSendComplex(c.m.ChannelID, &discordgo.MessageSend{
+		Content: m,
+		Files:   []*discordgo.File{{Name: name, Reader: r}},
+	})
+	return err
+}
+
+// ReplyUsage replies with the command's usage, and an optional hint about its arguments
+func (c *commandContext) ReplyUsage(hint string) error {
+	m := fmt.Sprintf("**usage:** `%s`", fmtUsage(c.path))
+	if hint != "" {
+		m += "; " + hint
+	}
+	return c.Reply(m)
+}
 
-var mentionPrefix = "<@0>"
-var mentionPrefixLen = len(mentionPrefix)
-var prefix = "/feed:"
-var prefixLen = len(prefix)
-var owner = "<@0>"
+type commandHandler = func(c *commandContext) error
+
+// commandTimeout bounds how long a command may spend on the database and fetching feeds
+const commandTimeout = 30 * time.Second
 
 var channelRegex = regexp.MustCompile(`<#\d+>`)
 
-var mux = map[string]commandHandler{
-	"help":        help,
-	"add":         add,
-	"remove":      remove,
-	"list":        list,
-	"set":         set,
-	"dbg~migrate": dbgMigrate,
+// newCommands creates the registry of every command; help is generated from it
+func newCommands() *registry {
+	return newRegistry(
+		&command{
+			name:        "help",
+			usage:       "[command]",
+			description: "print this message, or describe a command",
+			handler:     help,
+		},
+		&command{
+			name:        "add",
+			usage:       "<uri> [channel]",
+			description: "add a feed by its URI; optionally specifying a channel where updates will be posted",
+			permission:  permAdmin,
+			handler:     add,
+		},
+		&command{
+			name:        "remove",
+			aliases:     []string{"rm"},
+			usage:       "<id>",
+			description: "remove a subscription by its ID (see the list command)",
+			permission:  permAdmin,
+			handler:     remove,
+		},
+		&command{
+			name:        "list",
+			aliases:     []string{"ls"},
+			description: "list the feeds active in this guild, and any additional configuration options",
+			permission:  permAdmin,
+			handler:     list,
+		},
+		&command{
+			name:        "pause",
+			usage:       "<id> [duration]",
+			description: "stop posting a subscription's updates, until it is resumed or for a duration such as `12h` or `3d`; its ID and settings are kept",
+			permission:  permAdmin,
+			handler:     pause,
+		},
+		&command{
+			name:        "resume",
+			usage:       "<id> <deliver|skip>",
+			description: "resume a paused subscription, and either post the most recent items it missed or skip them",
+			permission:  permAdmin,
+			handler:     resume,
+		},
+		&command{
+			name:        "import",
+			usage:       "[channel|folders]",
+			description: "subscribe to every feed in an attached OPML file, in this channel or the one given; with `folders`, each folder's feeds are posted in the channel of the same name",
+			permission:  permAdmin,
+			handler:     importOPML,
+			subcommands: []*command{
+				{
+					name:        "config",
+					usage:       "[apply]",
+					description: "show what restoring an attached snapshot from `export config` would change; with `apply`, restore it. nothing is removed.",
+					handler:     importConfig,
+				},
+			},
+		},
+		&command{
+			name:        "export",
+			description: "export this guild's subscriptions as an OPML file, with a folder for each channel",
+			permission:  permAdmin,
+			handler:     exportOPML,
+			subcommands: []*command{
+				{
+					name:        "config",
+					description: "export a snapshot of this guild's config and subscriptions, which `import config` restores",
+					handler:     exportConfig,
+				},
+			},
+		},
+		&command{
+			name:        "set",
+			description: "change how this guild, or one of its subscriptions, behaves",
+			permission:  permAdmin,
+			subcommands: []*command{
+				{
+					name:        "channel",
+					usage:       "<id> [channel]",
+					description: "set the channel a subscription should write to; will assume the current channel if unspecified",
+					handler:     setChannel,
+				},
+				{
+					name:        "contact",
+					usage:       "<user|channel>",
+					description: "set the emergency contact for this guild; defaults to the server owner",
+					handler:     setContact,
+				},
+				{
+					name:        "embed",
+					usage:       "<on|off|inherit> [id]",
+					description: "enable or disable embeds for this guild; optionally specifying a subscription to change this behavior for",
+					handler:     setEmbed,
+				},
+				{
+					name:        "webhook",
+					usage:       "<on|off|inherit> [id]",
+					description: "enable or disable webhooks for this guild; optionally specifying a subscription to change this behavior for",
+					handler:     setWebhook,
+				},
+				{
+					name:        "prefix",
+					usage:       "<prefix|reset>",
+					description: "change the prefix commands start with in this guild; mentioning feedbot always works too",
+					handler:     setPrefix,
+				},
+			},
+		},
+		&command{
+			name:        "auth",
+			usage:       "<id> [basic <user> <password>|header <name> [value]|query <key> [value]|clear]",
+			description: "manage the credentials used to fetch a subscription's feed; **only works in a direct message!**",
+			handler:     auth,
+		},
+		&command{
+			name:       "dbg~migrate",
+			permission: permOwner,
+			hidden:     true,
+			handler:    dbgMigrate,
+		},
+	)
 }
 
 // onReady handles the Discord READY event
 func (bot *Bot) onReady(s *discordgo.Session, m *discordgo.Ready) {
-	mentionPrefix = m.User.Mention()
-	mentionPrefixLen = len(mentionPrefix)
-
 	apps, err := s.Application("@me")
 	if err != nil {
 		panic(err)
 	}
-	owner = apps.Owner.ID
+	bot.router.ready(m.User, apps.Owner.ID)
+	bot.shards.setReady(s, true)
+	bot.log.Info("shard ready", "shard", s.ShardID, "shards", s.ShardCount, "guilds", len(m.Guilds))
+}
+
+// answersCommands reports whether this instance answers the commands s receives. Every
+// instance running a shard receives its messages, so only the one leading it answers.
+func (bot *Bot) answersCommands(s *discordgo.Session) bool {
+	if bot.leader == nil {
+		return true
+	}
+	l, ok := bot.shardLeaders[s.ShardID]
+	return ok && l.Leading()
 }
 
 // onMessageCreate handles the Discord MESSAGE_CREATE event
 func (bot *Bot) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
-	if m.Author.Bot {
+	if m.Author.Bot || !bot.answersCommands(s) {
 		return
 	}
-
-	var content string
-	if strings.HasPrefix(m.Content, mentionPrefix) {
-		content = m.Content[mentionPrefixLen:]
-	} else if strings.HasPrefix(m.Content, prefix) {
-		content = m.Content[prefixLen:]
-	} else {
+	// commands are ignored once the bot is shutting down
+	if !bot.track() {
 		return
 	}
+	defer bot.wg.Done()
+
+	cctx, cancel := context.WithTimeout(bot.ctx, commandTimeout)
+	defer cancel()
 
-	parts := strings.Split(content, " ")
-	if len(parts) < 1 {
+	words, err := bot.router.route(cctx, m.Message)
+	if err != nil {
+		bot.log.Error("couldn't route message", "guild_id", m.GuildID, "channel_id", m.ChannelID, "err", err)
 		return
 	}
-	f, ok := mux[parts[0]]
-	if !ok {
+	if len(words) == 0 || words[0] == "" {
 		return
 	}
-
-	var args []string
-	if len(parts) > 1 {
-		args = parts[1:]
+	path, args := bot.router.commands.find(words)
+	name := "unknown"
+	if len(path) > 0 {
+		name = fmtName(path)
 	}
 
+	start := time.Now()
+	ctx := &commandContext{
+		Context: cctx,
+		bot:     bot,
+		s:       s,
+		m:       m,
+		path:    path,
+		args:    args,
+		log:     bot.log.With("command", name, "guild_id", m.GuildID, "channel_id", m.ChannelID, "user_id", m.Author.ID),
+	}
+	// outcome is ok, rejected for an error the user can fix, error, or panic
+	outcome := "ok"
 	defer func() {
-		if err := recover(); err != nil {
-			l.Println(fmt.Sprintf("cmd:%s pnc:%+v", parts[0], err))
-			debug.PrintStack()
+		if v := recover(); v != nil {
+			outcome = "panic"
+			ctx.replyPanic(v, debug.Stack())
 		}
+		bot.metrics.commandRan(name, outcome)
+		ctx.log.Debug("ran command", "outcome", outcome, "duration", time.Since(start))
 	}()
 
-	ctx := &context{
-		bot:  bot,
-		s:    s,
-		m:    m,
-		args: args,
-	}
-	err := f(ctx)
+	err = dispatch(ctx, words[0])
 	if err != nil {
-		l.Println(fmt.Sprintf("cmd:%s err:%+v", parts[0], err))
+		outcome = "error"
+		if _, ok := friendlyError(err); ok {
+			outcome = "rejected"
+		}
+		ctx.replyError(err)
 	}
 }
 
-const helpText = `
-**feedbot**
+// dispatch runs the command a message resolved to, once its permissions are checked; an
+// unknown command is answered with the closest matches
+func dispatch(ctx *commandContext, name string) error {
+	if len(ctx.path) == 0 {
+		return ctx.Reply(fmtUnknown(name, suggest(name, ctx.bot.router.commands.commands)))
+	}
+
+	ok, err := checkPermission(ctx, pathPermission(ctx.path))
+	if err != nil || !ok {
+		return err
+	}
 
-**commands:**
-- help: print this message
-- add <uri> [channel]: add an RSS feed by its URI; optionally specifying a channel where updates will be posted
-- remove <id>: remove an RSS feed by its ID (see the list command)
-- list: list the RSS feeds active in this guild, and any additional configuration options
-- set channel <id> [channel]: set the channel a given feed should write to; will assume current channel if unspecified
-- set contact <user|channel>: set the emergency contact for this guild; defaults to the server owner
-- set embed <on|off|inherit> [id]: enable or disable embeds for this guild; optionally specifying a feed to change this behavior for
-- set webhook <on|off|inherit> [id]: enable or disable webhooks for this guild, optionally specifying a feed to change this behavior for
+	cmd := ctx.path[len(ctx.path)-1]
+	if cmd.handler == nil {
+		// a group of subcommands, without one of them
+		parent := fmtName(ctx.path)
+		if len(ctx.args) == 0 {
+			return ctx.ReplyUsage("see `help " + parent + "`.")
+		}
+		var names []string
+		for _, name := range suggest(ctx.args[0], cmd.subcommands) {
+			names = append(names, parent+" "+name)
+		}
+		return ctx.Reply(fmtUnknown(parent+" "+ctx.args[0], names))
+	}
+	return cmd.handler(ctx)
+}
 
-the inherit flag may only be used when specifying a feed-specific overwrite!
+// fmtUnknown tells the user a command doesn't exist, suggesting the given ones instead
+func fmtUnknown(name string, suggestions []string) string {
+	m := fmt.Sprintf("there's no `%s` command", name)
+	if len(suggestions) > 0 {
+		m += fmt.Sprintf(", did you mean `%s`?", strings.Join(suggestions, "` or `"))
+	} else {
+		m += ", see `help`."
+	}
+	return m
+}
+
+const helpAbout = `
+**feed types:**
+- RSS, Atom and JSON Feed: https://example.com/feed.xml
+- JSON APIs: json+https://example.com/api#items=$.data[*]&title=$.name&link=$.html_url&published=$.created_at;
+  each field is a JSONPath expression relative to an item, the defaults are $.title, $.url, $.id, $.published and $.description
 
 **how it works:**
-every 60 minutes, feedbot will ping the feeds its users have specified. for feeds that have new content, feedbot
+every %s, feedbot will ping the feeds its users have specified. for feeds that have new content, feedbot
 will find every discord channel with a subscription, and send an update.
 
 **permissions:**
-feedbot will only respect users who poesess the **ADMINISTRATOR** permission in a guild.discordgo
+feedbot will only respect users who possess the **ADMINISTRATOR** permission in a guild.
 
 feedbot by default only requires **READ MESSAGES** and **SEND MESSAGES**.
 
@@ -135,25 +328,48 @@ if webhooks are enabled for a feed, the **MANAGE WEBHOOKS** permission must be g
 if a permission is missing, or a feed is broken, feedbot will notify the emergency contact.
 `
 
-// help
-func help(ctx *context) error {
-	return ctx.Reply(helpText)
-}
+// help [command]
+func help(ctx *commandContext) error {
+	commands := ctx.bot.router.commands
+	if len(ctx.args) > 0 {
+		path, rest := commands.find(ctx.args)
+		if len(path) == 0 || path[0].hidden {
+			return ctx.Reply(fmtUnknown(ctx.args[0], suggest(ctx.args[0], commands.commands)))
+		}
+		if len(rest) > 0 {
+			return ctx.Reply(fmtUnknown(fmtName(path)+" "+rest[0], nil))
+		}
+		return ctx.Reply(fmtCommandHelp(path))
+	}
 
-// add <uri> [channel]
-func add(ctx *context) error {
-	ok, err := checkPrivilege(ctx)
+	prefix, err := ctx.bot.router.guildPrefix(ctx, ctx.m.GuildID)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-	if !ok {
-		return nil
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "**feedbot**\n\ncommands start with `%s`, or a mention of feedbot; see `help <command>` for details.\n\n**commands:**\n", prefix)
+	fmtCommandList(&b, nil, commands.commands)
+	b.WriteString("\nthe inherit flag may only be used when specifying a subscription-specific overwrite!\n")
+	if err = ctx.Reply(b.String()); err != nil {
+		return err
+	}
+	return ctx.Reply(fmt.Sprintf(helpAbout, fmtInterval(ctx.bot.fc.config.Interval)))
+}
+
+// fmtInterval formats a poll interval for the help text, e.g. "60 minutes"
+func fmtInterval(d time.Duration) string {
+	if m := int(d / time.Minute); m != 1 {
+		return fmt.Sprintf("%d minutes", m)
 	}
+	return "minute"
+}
 
+// add <uri> [channel]
+func add(ctx *commandContext) error {
 	if l := len(ctx.args); l < 1 || l > 2 {
-		return ctx.Reply("**usage:** `add <uri> [channel]`; please omit spaces from arguments!")
+		return ctx.ReplyUsage("please omit spaces from arguments!")
 	}
-	uri := ctx.args[0]
 	var channel string
 	if len(ctx.args) == 2 {
 		c := ctx.args[1]
@@ -166,41 +382,57 @@ func add(ctx *context) error {
 		channel = ctx.m.ChannelID
 	}
 
-	feed, err := ctx.bot.c.GetOrCreateFeed(uri)
+	sub, problem, err := subscribe(ctx, channel, ctx.args[0])
 	if err != nil {
 		return err
 	}
-	sub, err := ctx.bot.c.AddSubscription(channel, ctx.m.GuildID, feed.ID)
-	if err == ErrSubExists {
-		return ctx.Reply(fmt.Sprintf("this subscription (#%d) already exists!", sub.ID))
-	} else if err != nil {
-		return err
+	if problem != "" {
+		return ctx.Reply(problem)
 	}
-
 	return ctx.Reply(fmt.Sprintf("subscription #%d created!", sub.ID))
 }
 
-// remove <id>
-func remove(ctx *context) error {
-	ok, err := checkPrivilege(ctx)
+// subscribe subscribes a channel in the guild to the feed at uri; problem explains why
+// the feed can't be subscribed to, when it is refused
+func subscribe(ctx *commandContext, channelID, uri string) (sub *Subscription, problem string, err error) {
+	if problem = feedProblem(ctx, uri); problem != "" {
+		return nil, problem, nil
+	}
+
+	feed, err := ctx.bot.c.GetOrCreateFeed(ctx, uri, ctx.m.GuildID)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-	if !ok {
-		return nil
+	sub, err = ctx.bot.c.AddSubscription(ctx, channelID, ctx.m.GuildID, feed.ID)
+	return sub, "", err
+}
+
+// feedProblem explains why the author can't subscribe to uri, or is empty if they can
+func feedProblem(ctx *commandContext, uri string) string {
+	if err := ctx.bot.sources.Validate(uri); err == ErrSchemeNotAllowed {
+		return "feeds must be an `http://` or `https://` URI, or a `json+https://` API!"
+	} else if err == ErrLocalSourcesDisabled {
+		return "file and command feeds are disabled on this bot."
+	} else if err != nil {
+		return fmt.Sprintf("that feed URI is invalid: %v", errors.Cause(err))
 	}
+	if kind, _ := SourceKind(uri); IsLocalSource(kind) && !ctx.bot.isOwner(ctx.m.Author.ID) {
+		return "only the bot's owner may add file and command feeds."
+	}
+	return ""
+}
 
+// remove <id>
+func remove(ctx *commandContext) error {
 	if len(ctx.args) != 1 {
-		return ctx.Reply("**usage:** `remove <id>`; please omit spaces from arguments?!")
+		return ctx.ReplyUsage("please omit spaces from arguments!")
 	}
 	id, err := strconv.Atoi(ctx.args[0])
 	if err != nil {
 		return ctx.Reply("`id` must be a number!")
 	}
-	sub, err := ctx.bot.c.GetSubscription(id)
-	if err == sql.ErrNoRows {
-		return ctx.Reply("could not find a subscription with that ID, check the list again?")
-	} else if err != nil {
+	sub, err := ctx.bot.c.GetSubscription(ctx, id)
+	if err != nil {
 		return err
 	}
 
@@ -208,37 +440,158 @@ func remove(ctx *context) error {
 		return ctx.Reply(fmt.Sprintf("subscription #%d does not exist in this guild.", id))
 	}
 
-	err = ctx.bot.c.DestroySubscription(id)
+	err = ctx.bot.c.DestroySubscription(ctx, id)
+	if err != nil {
+		return err
+	}
 	return ctx.Reply(fmt.Sprintf("subscription #%d has been deleted.", id))
 }
 
-// list
-func list(ctx *context) error {
-	ok, err := checkPrivilege(ctx)
-	if err != nil {
+// pause <id> [duration]
+func pause(ctx *commandContext) error {
+	if l := len(ctx.args); l < 1 || l > 2 {
+		return ctx.ReplyUsage("please omit spaces from arguments!")
+	}
+	sub, err := guildSubscription(ctx, ctx.args[0])
+	if sub == nil || err != nil {
+		return err
+	}
+	var d time.Duration
+	if len(ctx.args) == 2 {
+		if d, err = parsePauseDuration(ctx.args[1]); err != nil {
+			return ctx.Reply("`duration` must be a number of minutes, hours or days, such as `90m`, `12h` or `3d`.")
+		}
+	}
+
+	// pausing again changes when the pause ends, but it was still paused from the start
+	now := time.Now()
+	p := Pause{At: now}
+	if sub.Paused(now) {
+		p = *sub.Pause
+	} else {
+		feed, err := ctx.bot.c.GetFeed(ctx, sub.FeedID)
+		if err != nil {
+			return err
+		}
+		p.Seen = feed.LastUpdated
+	}
+	p.Until = nil
+	if d > 0 {
+		until := now.Add(d)
+		p.Until = &until
+	}
+	if err = ctx.bot.c.PauseSubscription(ctx, sub.ID, p); err != nil {
 		return err
 	}
-	if !ok {
-		return nil
+
+	if p.Until == nil {
+		return ctx.Reply(fmt.Sprintf("subscription #%d is paused until it is resumed.", sub.ID))
+	}
+	return ctx.Reply(fmt.Sprintf("subscription #%d is paused until <t:%d:f>; the items it misses won't be posted.", sub.ID, p.Until.Unix()))
+}
+
+// resume <id> <deliver|skip>
+func resume(ctx *commandContext) error {
+	if len(ctx.args) != 2 || ctx.args[1] != "deliver" && ctx.args[1] != "skip" {
+		return ctx.ReplyUsage("choose whether to `deliver` the items it missed, or `skip` them.")
+	}
+	sub, err := guildSubscription(ctx, ctx.args[0])
+	if sub == nil || err != nil {
+		return err
+	}
+	if !sub.Paused(time.Now()) {
+		return ctx.Reply(fmt.Sprintf("subscription #%d isn't paused.", sub.ID))
+	}
+
+	posted, missed, err := ctx.bot.fc.Resume(ctx, sub, ctx.args[1] == "deliver")
+	if errors.Cause(err) == ErrNotPaused {
+		// its pause ended, or someone else resumed it, since it was looked up
+		return ctx.Reply(fmt.Sprintf("subscription #%d isn't paused.", sub.ID))
+	} else if err != nil {
+		return err
+	}
+	m := fmt.Sprintf("subscription #%d has been resumed.", sub.ID)
+	switch {
+	case ctx.args[1] == "skip":
+	case missed == 0:
+		m += " it didn't miss anything the feed still lists."
+	case posted < missed:
+		m += fmt.Sprintf(" it missed %d items, the most recent %d have been posted.", missed, posted)
+	default:
+		m += fmt.Sprintf(" the %d items it missed have been posted.", posted)
+	}
+	return ctx.Reply(m)
+}
+
+// guildSubscription finds a subscription in the guild by its ID; if the ID is invalid,
+// or the subscription is in another guild, the user is told so, and sub is nil
+func guildSubscription(ctx *commandContext, arg string) (sub *Subscription, err error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, ctx.Reply("`id` must be a number!")
+	}
+	sub, err = ctx.bot.c.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if sub.GuildID != ctx.m.GuildID {
+		return nil, ctx.Reply(fmt.Sprintf("subscription #%d does not exist in this guild.", id))
 	}
+	return sub, nil
+}
 
-	gc, err := ctx.bot.c.GetGuildConfig(ctx.m.GuildID)
+// parsePauseDuration parses a duration such as "90m", "12h", or "3d"
+func parsePauseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, errors.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// fmtPause describes whether a subscription is paused, for list
+func fmtPause(s *Subscription, now time.Time) string {
+	switch {
+	case !s.Paused(now):
+		return "no"
+	case s.Pause.Until == nil:
+		return "yes"
+	default:
+		return fmt.Sprintf("until <t:%d:f>", s.Pause.Until.Unix())
+	}
+}
+
+// list
+func list(ctx *commandContext) error {
+	gc, err := ctx.bot.c.GetGuildConfig(ctx, ctx.m.GuildID)
 	if err != nil {
 		return err
 	}
-	subs, err := ctx.bot.c.GetSubscriptions(ctx.m.GuildID)
+	subs, err := ctx.bot.c.GetSubscriptions(ctx, ctx.m.GuildID)
+	if err != nil {
+		return err
+	}
+	prefix, err := ctx.bot.router.guildPrefix(ctx, ctx.m.GuildID)
 	if err != nil {
 		return err
 	}
 
 	var b strings.Builder
-	b.WriteString(fmt.Sprintf("**Guild Contact:** `%s`\n**Embeds?** %v\n**Webhooks?** %v\n\n",
-		gc.Contact, gc.Embeds, gc.Webhooks))
+	b.WriteString(fmt.Sprintf("**Guild Contact:** `%s`\n**Prefix:** `%s`\n**Embeds?** %v\n**Webhooks?** %v\n\n",
+		gc.Contact, prefix, gc.Embeds, gc.Webhooks))
 
-	b.WriteString("**Sub ID | Channel | Feed URI | Embed? | Webhook?\n\n**")
+	b.WriteString("**Sub ID | Channel | Feed URI | Embed? | Webhook? | Paused?\n\n**")
+	now := time.Now()
 	for _, s := range subs {
-		b.WriteString(fmt.Sprintf("%d | <#%s> | `%s` | %v | %v\n",
-			s.ID, s.ChannelID, s.Feed.URI, fmtBool(s.Overwrite.Embeds), fmtBool(s.Overwrite.Webhooks)))
+		b.WriteString(fmt.Sprintf("%d | <#%s> | `%s` | %v | %v | %s\n",
+			s.ID, s.ChannelID, s.Feed.URI, fmtBool(s.Overwrite.Embeds), fmtBool(s.Overwrite.Webhooks), fmtPause(&s, now)))
 
 		if b.Len() > 1900 {
 			err = ctx.Reply(b.String())
@@ -252,44 +605,278 @@ func list(ctx *context) error {
 	return ctx.Reply(b.String())
 }
 
-// set <channel|contact|embed|webhook> [...]
-func set(ctx *context) error {
-	ok, err := checkPrivilege(ctx)
+// import [channel|folders]
+func importOPML(ctx *commandContext) error {
+	if len(ctx.args) > 1 {
+		return ctx.ReplyUsage("please omit spaces from arguments!")
+	}
+	channel := ctx.m.ChannelID
+	// folders maps channel names to IDs, when importing folders into channels
+	var folders map[string]string
+	switch {
+	case len(ctx.args) == 0:
+	case ctx.args[0] == "folders":
+		channels, err := guildChannels(ctx)
+		if err != nil {
+			return err
+		}
+		folders = map[string]string{}
+		for _, c := range channels {
+			folders[c.Name] = c.ID
+		}
+	case channelRegex.MatchString(ctx.args[0]):
+		// <#...>
+		channel = ctx.args[0][2 : len(ctx.args[0])-1]
+	default:
+		return ctx.ReplyUsage("please use a #channel mention, or `folders`.")
+	}
+
+	body, err := readAttachment(ctx, "OPML", maxOPMLSize)
+	if body == nil || err != nil {
+		return err
+	}
+	feeds, err := parseOPML(bytes.NewReader(body))
+	if err != nil {
+		return ctx.Reply(fmt.Sprintf("that file isn't valid OPML: %v", errors.Cause(err)))
+	}
+	if len(feeds) == 0 {
+		return ctx.Reply("that file doesn't list any feeds.")
+	}
+	if len(feeds) > maxImportFeeds {
+		return ctx.Reply(fmt.Sprintf("that file lists %d feeds, at most %d may be imported at once.", len(feeds), maxImportFeeds))
+	}
+
+	var created, existing int
+	var skipped []string
+	for _, f := range feeds {
+		target := channel
+		if folders != nil && f.Folder != "" {
+			name := channelName(f.Folder)
+			id, ok := folders[name]
+			if !ok {
+				skipped = append(skipped, fmt.Sprintf("`%s`: there's no channel named #%s", f.URI, name))
+				continue
+			}
+			target = id
+		}
+		_, problem, err := subscribe(ctx, target, f.URI)
+		switch {
+		case errors.Cause(err) == ErrSubExists:
+			existing++
+		case err != nil:
+			return err
+		case problem != "":
+			skipped = append(skipped, fmt.Sprintf("`%s`: %s", f.URI, problem))
+		default:
+			created++
+		}
+	}
+
+	m := fmt.Sprintf("created %d subscriptions, %d already existed.", created, existing)
+	if len(skipped) > 0 {
+		m += fmt.Sprintf("\nskipped %d feeds:\n", len(skipped)) + fmtLines(skipped, 1900-len(m))
+	}
+	return ctx.Reply(m)
+}
+
+// export
+func exportOPML(ctx *commandContext) error {
+	subs, err := ctx.bot.c.GetSubscriptions(ctx, ctx.m.GuildID)
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 {
+		return ctx.Reply("this guild has no subscriptions to export.")
+	}
+	channels, err := guildChannels(ctx)
 	if err != nil {
 		return err
 	}
-	if !ok {
-		return nil
+	names := map[string]string{}
+	for _, c := range channels {
+		names[c.ID] = c.Name
 	}
 
-	if len(ctx.args) == 0 {
-		return ctx.Reply("**usage:** set <channel|contact|embed|webhook> ..., see help command.")
+	var folders []opmlFolder
+	index := map[string]int{}
+	for _, s := range subs {
+		i, ok := index[s.ChannelID]
+		if !ok {
+			name := names[s.ChannelID]
+			if name == "" {
+				name = s.ChannelID
+			}
+			i = len(folders)
+			index[s.ChannelID] = i
+			folders = append(folders, opmlFolder{Name: name})
+		}
+		folders[i].URIs = append(folders[i].URIs, s.Feed.URI)
 	}
-	subCommand := ctx.args[0]
-	switch subCommand {
-	case "channel":
-		err = setChannel(ctx)
-	case "contact":
-		err = setContact(ctx)
-	case "embed":
-		err = setEmbed(ctx)
-	case "webhook":
-		err = setWebhook(ctx)
-	default:
-		err = ctx.Reply("subcommand must be one of channel|contact|embed|webhook, see help command.")
+
+	var buf bytes.Buffer
+	if err = writeOPML(&buf, "feedbot subscriptions", folders); err != nil {
+		return err
 	}
-	return err
+	m := fmt.Sprintf("exported %d subscriptions, with a folder for each channel; `import folders` restores them.", len(subs))
+	return ctx.ReplyFile(m, "feedbot.opml", &buf)
+}
+
+// import config [apply]
+func importConfig(ctx *commandContext) error {
+	if len(ctx.args) > 1 || len(ctx.args) == 1 && ctx.args[0] != "apply" {
+		return ctx.ReplyUsage("")
+	}
+	apply := len(ctx.args) == 1
+
+	body, err := readAttachment(ctx, "snapshot", maxSnapshotSize)
+	if body == nil || err != nil {
+		return err
+	}
+	snap, err := parseGuildSnapshot(bytes.NewReader(body))
+	if err != nil {
+		return ctx.Reply(fmt.Sprintf("that snapshot can't be imported: %v", errors.Cause(err)))
+	}
+	if len(snap.Subscriptions) > maxImportFeeds {
+		return ctx.Reply(fmt.Sprintf("that snapshot has %d subscriptions, at most %d may be imported at once.", len(snap.Subscriptions), maxImportFeeds))
+	}
+
+	gc, err := ctx.bot.c.GetGuildConfig(ctx, ctx.m.GuildID)
+	if err != nil {
+		return err
+	}
+	subs, err := ctx.bot.c.GetSubscriptions(ctx, ctx.m.GuildID)
+	if err != nil {
+		return err
+	}
+	channels, err := guildChannels(ctx)
+	if err != nil {
+		return err
+	}
+	plan := planSnapshot(gc, subs, snap, channels)
+	if plan.empty() {
+		return ctx.Reply("this guild already matches the snapshot.\n" + fmtLines(plan.lines, 1800))
+	}
+	if !apply {
+		return ctx.Reply("**dry run**, nothing has been changed:\n" + fmtLines(plan.lines, 1800) +
+			"\nto restore the snapshot, attach it to `import config apply`.")
+	}
+
+	// feeds are checked and created first, the import itself is applied all at once; a
+	// feed nobody ends up subscribed to is purged like any other orphaned feed
+	var imp GuildImport
+	if plan.changed {
+		imp.Config = &plan.config
+	}
+	var skipped []string
+	for _, s := range plan.add {
+		if problem := feedProblem(ctx, s.Feed); problem != "" {
+			skipped = append(skipped, fmt.Sprintf("`%s`: %s", s.Feed, problem))
+			continue
+		}
+		feed, err := ctx.bot.c.GetOrCreateFeed(ctx, s.Feed, ctx.m.GuildID)
+		if err != nil {
+			return err
+		}
+		imp.Subscriptions = append(imp.Subscriptions, ImportedSubscription{
+			ChannelID: s.ChannelID,
+			FeedID:    feed.ID,
+			Embeds:    nullBool(s.Embeds),
+			Webhooks:  nullBool(s.Webhooks),
+		})
+	}
+	for _, o := range plan.modify {
+		imp.Subscriptions = append(imp.Subscriptions, ImportedSubscription{ID: o.subID, Embeds: o.embeds, Webhooks: o.webhooks})
+	}
+	created, err := ctx.bot.c.ImportGuild(ctx, ctx.m.GuildID, imp)
+	if err != nil {
+		return err
+	}
+	if plan.changed {
+		ctx.bot.router.setPrefix(ctx.m.GuildID, plan.config.Prefix)
+	}
+	updated := len(plan.modify)
+
+	m := fmt.Sprintf("snapshot restored: created %d subscriptions, and updated %d.", created, updated)
+	if plan.changed {
+		m += " the guild's config was updated."
+	}
+	if len(skipped) > 0 {
+		m += fmt.Sprintf("\nskipped %d feeds:\n", len(skipped)) + fmtLines(skipped, 1900-len(m))
+	}
+	return ctx.Reply(m)
+}
+
+// export config
+func exportConfig(ctx *commandContext) error {
+	gc, err := ctx.bot.c.GetGuildConfig(ctx, ctx.m.GuildID)
+	if err != nil {
+		return err
+	}
+	subs, err := ctx.bot.c.GetSubscriptions(ctx, ctx.m.GuildID)
+	if err != nil {
+		return err
+	}
+	channels, err := guildChannels(ctx)
+	if err != nil {
+		return err
+	}
+	names := map[string]string{}
+	for _, c := range channels {
+		names[c.ID] = c.Name
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(newGuildSnapshot(gc, subs, names)); err != nil {
+		return errors.WithStack(err)
+	}
+	m := fmt.Sprintf("exported this guild's config and %d subscriptions; feed credentials aren't included. `import config` restores them.", len(subs))
+	return ctx.ReplyFile(m, "feedbot-config.json", &buf)
+}
+
+// readAttachment downloads the one file attached to the command; if there isn't one, or
+// it is too large, the user is told so, and data is nil
+func readAttachment(ctx *commandContext, kind string, limit int) (data []byte, err error) {
+	if len(ctx.m.Attachments) != 1 {
+		return nil, ctx.ReplyUsage(fmt.Sprintf("please attach one %s file.", kind))
+	}
+	att := ctx.m.Attachments[0]
+	if att.Size > limit {
+		return nil, ctx.Reply(fmt.Sprintf("that file is too large, %s files may be at most %d KiB.", kind, limit>>10))
+	}
+
+	body, err := ctx.bot.sources.fetcher.Get(ctx, att.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err = io.ReadAll(io.LimitReader(body, int64(limit)))
+	return data, errors.WithStack(err)
+}
+
+// fmtLines joins lines, leaving out those which would take it past limit bytes
+func fmtLines(lines []string, limit int) string {
+	var b strings.Builder
+	for i, l := range lines {
+		if b.Len()+len(l) > limit {
+			fmt.Fprintf(&b, "...and %d more", len(lines)-i)
+			break
+		}
+		b.WriteString(l + "\n")
+	}
+	return b.String()
 }
 
 // set channel <id> [channel]
-func setChannel(ctx *context) error {
-	if len(ctx.args) < 2 {
-		return ctx.Reply("**usage:** `set channel <id> [channel]`; please omit spaces from arguments?!")
+func setChannel(ctx *commandContext) error {
+	if len(ctx.args) < 1 {
+		return ctx.ReplyUsage("please omit spaces from arguments!")
 	}
 
 	var channelID string
-	if len(ctx.args) == 3 {
-		c := ctx.args[2]
+	if len(ctx.args) == 2 {
+		c := ctx.args[1]
 		if !channelRegex.MatchString(c) {
 			return ctx.Reply("when specifying a channel ID, please use a #channel mention!")
 		}
@@ -299,14 +886,12 @@ func setChannel(ctx *context) error {
 		channelID = ctx.m.ChannelID
 	}
 
-	id, err := strconv.Atoi(ctx.args[1])
+	id, err := strconv.Atoi(ctx.args[0])
 	if err != nil {
 		return ctx.Reply("`id` must be a number!")
 	}
-	sub, err := ctx.bot.c.GetSubscription(id)
-	if err == sql.ErrNoRows {
-		return ctx.Reply("could not find a subscription with that ID, check the list again?")
-	} else if err != nil {
+	sub, err := ctx.bot.c.GetSubscription(ctx, id)
+	if err != nil {
 		return err
 	}
 
@@ -314,7 +899,7 @@ func setChannel(ctx *context) error {
 		return ctx.Reply(fmt.Sprintf("subscription #%d does not exist in this guild.", id))
 	}
 
-	err = ctx.bot.c.ModifySubscriptionChannel(id, channelID)
+	err = ctx.bot.c.ModifySubscriptionChannel(ctx, id, channelID)
 	if err != nil {
 		return err
 	}
@@ -323,11 +908,11 @@ func setChannel(ctx *context) error {
 }
 
 // set contact <user|channel>
-func setContact(ctx *context) error {
-	if len(ctx.args) != 2 {
-		return ctx.Reply("**usage:** `set contact <user|channel>`; please use a user mention, user id, or channel mention, and omit spaces.")
+func setContact(ctx *commandContext) error {
+	if len(ctx.args) != 1 {
+		return ctx.ReplyUsage("please use a user mention, user id, or channel mention, and omit spaces.")
 	}
-	arg := ctx.args[1]
+	arg := ctx.args[0]
 
 	var id string
 	if channelRegex.MatchString(arg) {
@@ -343,7 +928,7 @@ func setContact(ctx *context) error {
 		return ctx.Reply("contact must be a user mention, user id, or channel mention; not a user name or channel name.")
 	}
 
-	err := ctx.bot.c.ModifyGuildContact(ctx.m.GuildID, id)
+	err := ctx.bot.c.ModifyGuildContact(ctx, ctx.m.GuildID, id)
 	if err != nil {
 		return err
 	}
@@ -351,12 +936,12 @@ func setContact(ctx *context) error {
 }
 
 // set embed <on|off|inherit> [id]
-func setEmbed(ctx *context) error {
-	if len(ctx.args) < 2 {
-		return ctx.Reply("**usage:** `set embed <on|off|inherit> [id]`")
+func setEmbed(ctx *commandContext) error {
+	if len(ctx.args) < 1 {
+		return ctx.ReplyUsage("")
 	}
 
-	a := ctx.args[1]
+	a := ctx.args[0]
 	var val sql.NullBool
 	if a == "on" {
 		val = sql.NullBool{Bool:true, Valid:true}
@@ -368,23 +953,21 @@ func setEmbed(ctx *context) error {
 		return ctx.Reply("parameter must be one of on|off")
 	}
 
-	if len(ctx.args) == 2 {
+	if len(ctx.args) == 1 {
 		if !val.Valid {
 			return ctx.Reply("`inherit` is only a valid flag on overwrites, please specify on|off")
 		}
-		err := ctx.bot.c.ModifyGuildEmbeds(ctx.m.GuildID, val.Bool)
+		err := ctx.bot.c.ModifyGuildEmbeds(ctx, ctx.m.GuildID, val.Bool)
 		if err != nil {
 			return err
 		}
 	} else {
-		id, err := strconv.Atoi(ctx.args[2])
+		id, err := strconv.Atoi(ctx.args[1])
 		if err != nil {
 			return ctx.Reply("`id` must be a number!")
 		}
-		sub, err := ctx.bot.c.GetSubscription(id)
-		if err == sql.ErrNoRows {
-			return ctx.Reply("could not find a subscription with that ID, check the list again?")
-		} else if err != nil {
+		sub, err := ctx.bot.c.GetSubscription(ctx, id)
+		if err != nil {
 			return err
 		}
 
@@ -392,7 +975,7 @@ func setEmbed(ctx *context) error {
 			return ctx.Reply(fmt.Sprintf("subscription #%d does not exist in this guild.", id))
 		}
 
-		err = ctx.bot.c.ModifyOverwriteEmbeds(sub.ID, val)
+		err = ctx.bot.c.ModifyOverwriteEmbeds(ctx, sub.ID, val)
 		if err != nil {
 			return err
 		}
@@ -407,13 +990,13 @@ func setEmbed(ctx *context) error {
 	return ctx.Reply("feedbot will default to the guild-wide behavior for embeds.")
 }
 
-// set webhook <on|off> [id]
-func setWebhook(ctx *context) error {
-	if len(ctx.args) < 2 {
-		return ctx.Reply("**usage:** `set webhook <on|off> [id]`")
+// set webhook <on|off|inherit> [id]
+func setWebhook(ctx *commandContext) error {
+	if len(ctx.args) < 1 {
+		return ctx.ReplyUsage("")
 	}
 
-	a := ctx.args[1]
+	a := ctx.args[0]
 	var val sql.NullBool
 	if a == "on" {
 		val = sql.NullBool{Bool:true, Valid:true}
@@ -425,23 +1008,21 @@ func setWebhook(ctx *context) error {
 		return ctx.Reply("parameter must be one of on|off")
 	}
 
-	if len(ctx.args) == 2 {
+	if len(ctx.args) == 1 {
 		if !val.Valid {
 			return ctx.Reply("`inherit` is only a valid flag on overwrites, please specify on|off")
 		}
-		err := ctx.bot.c.ModifyGuildWebhooks(ctx.m.GuildID, val.Bool)
+		err := ctx.bot.c.ModifyGuildWebhooks(ctx, ctx.m.GuildID, val.Bool)
 		if err != nil {
 			return err
 		}
 	} else {
-		id, err := strconv.Atoi(ctx.args[2])
+		id, err := strconv.Atoi(ctx.args[1])
 		if err != nil {
 			return ctx.Reply("`id` must be a number!")
 		}
-		sub, err := ctx.bot.c.GetSubscription(id)
-		if err == sql.ErrNoRows {
-			return ctx.Reply("could not find a subscription with that ID, check the list again?")
-		} else if err != nil {
+		sub, err := ctx.bot.c.GetSubscription(ctx, id)
+		if err != nil {
 			return err
 		}
 
@@ -449,7 +1030,7 @@ func setWebhook(ctx *context) error {
 			return ctx.Reply(fmt.Sprintf("subscription #%d does not exist in this guild.", id))
 		}
 
-		err = ctx.bot.c.ModifyOverwriteWebhooks(sub.ID, val)
+		err = ctx.bot.c.ModifyOverwriteWebhooks(ctx, sub.ID, val)
 		if err != nil {
 			return err
 		}
@@ -464,17 +1045,155 @@ func setWebhook(ctx *context) error {
 	return ctx.Reply("feedbot will default to the guild-wide behavior for webhooks.")
 }
 
-const adminOnly = "Sorry, feedbot requires the **ADMINISTRATOR** privilege!"
+// set prefix <prefix|reset>
+func setPrefix(ctx *commandContext) error {
+	if len(ctx.args) != 1 {
+		return ctx.ReplyUsage("the prefix can't contain spaces.")
+	}
+
+	prefix := ctx.args[0]
+	if prefix == "reset" {
+		prefix = ""
+	} else if !validPrefix(prefix) {
+		return ctx.Reply(fmt.Sprintf("a prefix must be at most %d characters, without spaces or backticks.", maxPrefixLen))
+	}
+
+	err := ctx.bot.c.ModifyGuildPrefix(ctx, ctx.m.GuildID, prefix)
+	if err != nil {
+		return err
+	}
+	ctx.bot.router.setPrefix(ctx.m.GuildID, prefix)
+
+	if prefix == "" {
+		prefix = ctx.bot.router.prefix
+	}
+	return ctx.Reply(fmt.Sprintf("commands in this guild now start with `%s`, or a mention of feedbot.", prefix))
+}
+
+// auth <id> [basic <user> <password>|header <name> [value]|query <key> [value]|clear]
+func auth(ctx *commandContext) error {
+	if ctx.m.GuildID != "" {
+		// don't leave secrets sitting in a guild channel
+		ctx.s.ChannelMessageDelete(ctx.m.ChannelID, ctx.m.ID)
+		return ctx.Reply("credentials can only be managed in a direct message! if your message contained any, consider them leaked.")
+	}
+	if ctx.bot.vault == nil {
+		return ctx.Reply("feed credentials are disabled, the bot's operator has not configured a secret key.")
+	}
+	if len(ctx.args) < 1 {
+		return ctx.ReplyUsage("")
+	}
+
+	id, err := strconv.Atoi(ctx.args[0])
+	if err != nil {
+		return ctx.Reply("`id` must be a number!")
+	}
+	sub, err := ctx.bot.c.GetSubscription(ctx, id)
+	if err != nil {
+		return err
+	}
+	// DMs arrive on shard 0, only the guild's own shard has its members and roles
+	ok, err := memberHasPermission(ctx.bot.shards.forGuild(sub.GuildID), sub.GuildID, ctx.m.Author.ID, discordgo.PermissionAdministrator)
+	if err != nil || !ok {
+		// either way, this user has no business with the subscription
+		return ctx.Reply(adminOnly)
+	}
 
-func checkPrivilege(ctx *context) (bool, error) {
-	ok, err := memberHasPermission(ctx.s, ctx.m.GuildID, ctx.m.Author.ID, discordgo.PermissionAdministrator)
+	fc, err := ctx.bot.c.GetFeedCredentials(ctx, sub.FeedID)
 	if err != nil {
-		return false, err
+		return err
 	}
-	if !ok {
-		if err = ctx.Reply(adminOnly); err != nil {
+	a := &FeedAuth{}
+	if fc != nil {
+		if fc.GuildID != sub.GuildID {
+			return ctx.Reply("the credentials for this feed belong to another guild.")
+		}
+		if a, err = ctx.bot.vault.Open(fc.Data); err != nil {
+			return err
+		}
+	}
+
+	if len(ctx.args) == 1 {
+		return ctx.Reply(fmt.Sprintf("subscription #%d is fetched with %s.", id, a.Describe()))
+	}
+
+	switch ctx.args[1] {
+	case "basic":
+		if len(ctx.args) == 2 {
+			a.Username, a.Password = "", ""
+		} else if len(ctx.args) >= 4 {
+			a.Username, a.Password = ctx.args[2], strings.Join(ctx.args[3:], " ")
+		} else {
+			return ctx.ReplyUsage("")
+		}
+	case "header":
+		if len(ctx.args) < 3 || !ValidHeader(ctx.args[2]) {
+			return ctx.ReplyUsage("")
+		}
+		a.Headers = setOrDelete(a.Headers, ctx.args[2], strings.Join(ctx.args[3:], " "))
+	case "query":
+		if len(ctx.args) < 3 {
+			return ctx.ReplyUsage("")
+		}
+		a.Query = setOrDelete(a.Query, ctx.args[2], strings.Join(ctx.args[3:], " "))
+	case "clear":
+		a = &FeedAuth{}
+	default:
+		return ctx.ReplyUsage("")
+	}
+
+	if a.Empty() {
+		err = ctx.bot.c.DestroyFeedCredentials(ctx, sub.FeedID)
+	} else {
+		var sealed []byte
+		if sealed, err = ctx.bot.vault.Seal(a); err != nil {
+			return err
+		}
+		// credentials are only ever set on the guild's own copy of a feed, so other guilds
+		// subscribed to the same URI are neither fetched with them nor locked out by them
+		var feed *Feed
+		if feed, err = ctx.bot.c.PrivatizeFeed(ctx, sub.FeedID, sub.GuildID); err != nil {
+			return err
+		}
+		err = ctx.bot.c.SetFeedCredentials(ctx, feed.ID, sub.GuildID, sealed)
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.Reply(fmt.Sprintf("subscription #%d will now be fetched with %s.", id, a.Describe()))
+}
+
+func setOrDelete(m map[string]string, k, v string) map[string]string {
+	if m == nil {
+		m = map[string]string{}
+	}
+	if v == "" {
+		delete(m, k)
+	} else {
+		m[k] = v
+	}
+	return m
+}
+
+const adminOnly = "Sorry, feedbot requires the **ADMINISTRATOR** privilege!"
+
+// checkPermission reports whether the author may run a command, replying if they may not
+func checkPermission(ctx *commandContext, p permission) (bool, error) {
+	switch p {
+	case permOwner:
+		// other users aren't told owner-only commands exist
+		return ctx.bot.isOwner(ctx.m.Author.ID), nil
+	case permAdmin:
+		if ctx.m.GuildID == "" {
+			return false, ctx.Reply("this command can only be used in a guild.")
+		}
+		ok, err := memberHasPermission(ctx.s, ctx.m.GuildID, ctx.m.Author.ID, discordgo.PermissionAdministrator)
+		if err != nil {
 			return false, err
 		}
+		if !ok {
+			return false, ctx.Reply(adminOnly)
+		}
 	}
 	return true, nil
 }
@@ -489,10 +1208,19 @@ func memberHasPermission(s *discordgo.Session, guildID string, userID string, pe
 
 	// Iterate through the role IDs stored in member.Roles
 	// to check permissions
+	var roles []*discordgo.Role
 	for _, roleID := range member.Roles {
 		role, err := s.State.Role(guildID, roleID)
 		if err != nil {
-			return false, err
+			// the guild is on a shard another process runs, so it isn't in our state
+			if roles == nil {
+				if roles, err = s.GuildRoles(guildID); err != nil {
+					return false, err
+				}
+			}
+			if role = findRole(roles, roleID); role == nil {
+				continue
+			}
 		}
 		if role.Permissions&permission != 0 {
 			return true, nil
@@ -502,7 +1230,39 @@ func memberHasPermission(s *discordgo.Session, guildID string, userID string, pe
 	return false, nil
 }
 
-func findChannel(ctx *context, id string) (*discordgo.Channel, error) {
+func findRole(roles []*discordgo.Role, id string) *discordgo.Role {
+	for _, r := range roles {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// guildChannels lists the text channels in the guild
+func guildChannels(ctx *commandContext) ([]*discordgo.Channel, error) {
+	var all []*discordgo.Channel
+	if guild, err := ctx.s.State.Guild(ctx.m.GuildID); err == nil {
+		all = guild.Channels
+	} else if all, err = ctx.s.GuildChannels(ctx.m.GuildID); err != nil {
+		return nil, errors.Wrap(err, "err fetching channels from api")
+	}
+
+	var channels []*discordgo.Channel
+	for _, c := range all {
+		if c.Type == discordgo.ChannelTypeGuildText {
+			channels = append(channels, c)
+		}
+	}
+	return channels, nil
+}
+
+// channelName turns a folder name into the name Discord would give a channel for it
+func channelName(folder string) string {
+	return strings.ToLower(strings.Join(strings.Fields(folder), "-"))
+}
+
+func findChannel(ctx *commandContext, id string) (*discordgo.Channel, error) {
 	channel, err := ctx.s.State.Channel(id)
 	if err != nil {
 		return nil, errors.Wrap(err, "err fetching channel from state")
@@ -517,11 +1277,7 @@ func findChannel(ctx *context, id string) (*discordgo.Channel, error) {
 }
 
 // dbg~migrate
-func dbgMigrate(ctx *context) error {
-	if ctx.m.Author.ID != owner {
-		return nil
-	}
-
+func dbgMigrate(ctx *commandContext) error {
 	guild, err := ctx.s.State.Guild(ctx.m.GuildID)
 	if err != nil {
 		return err
@@ -531,7 +1287,7 @@ func dbgMigrate(ctx *context) error {
 	}
 
 	c := "u:" + guild.OwnerID
-	err = ctx.bot.c.CreateGuildConfig(guild.ID, c)
+	err = ctx.bot.c.CreateGuildConfig(ctx, guild.ID, c)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,391 @@
+package feedbot
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// DefaultConfig returns the settings used for anything a config file, the environment
+// or a flag doesn't set
+func DefaultConfig() Config {
+	return Config{
+		Prefix:          "/feed:",
+		LogLevel:        LogInfo,
+		LogFormat:       LogText,
+		Database:        DefaultDatabaseConfig,
+		Checker:         DefaultCheckerConfig,
+		Fetcher:         DefaultFetcherConfig,
+		WebSub:          DefaultWebSubConfig,
+		GuildRetention:  7 * 24 * time.Hour,
+		FeedRetention:   7 * 24 * time.Hour,
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// configFile is the layout of a TOML config file; every key may also be set by an
+// environment variable named after its path, e.g. FEEDBOT_CHECKER_WORKERS for
+// workers under [checker]. Lists are comma separated in the environment.
+type configFile struct {
+	Token           *string  `toml:"token"`
+	Owners          []string `toml:"owners"`
+	Prefix          *string  `toml:"prefix"`
+	LogLevel        *string  `toml:"log_level"`
+	LogFormat       *string  `toml:"log_format"`
+	SecretKey       *string  `toml:"secret_key"`
+	LocalSources    *bool    `toml:"local_sources"`
+	GuildRetention  *string  `toml:"guild_retention"`
+	FeedRetention   *string  `toml:"feed_retention"`
+	ShutdownTimeout *string  `toml:"shutdown_timeout"`
+	OpsAddr         *string  `toml:"ops_addr"`
+	HealthWindow    *string  `toml:"health_window"`
+	LeaderLease     *string  `toml:"leader_lease"`
+
+	Database struct {
+		Driver          *string `toml:"driver"`
+		DSN             *string `toml:"dsn"`
+		JournalMode     *string `toml:"journal_mode"`
+		Synchronous     *string `toml:"synchronous"`
+		BusyTimeout     *string `toml:"busy_timeout"`
+		MaxOpenConns    *int    `toml:"max_open_conns"`
+		MaxIdleConns    *int    `toml:"max_idle_conns"`
+		ConnMaxLifetime *string `toml:"conn_max_lifetime"`
+	} `toml:"database"`
+
+	Checker struct {
+		Interval *string `toml:"interval"`
+		Workers  *int    `toml:"workers"`
+	} `toml:"checker"`
+
+	Fetcher struct {
+		Timeout      *string  `toml:"timeout"`
+		MaxSize      *int64   `toml:"max_size"`
+		MaxRedirects *int     `toml:"max_redirects"`
+		UserAgent    *string  `toml:"user_agent"`
+		Allow        []string `toml:"allow"`
+	} `toml:"fetcher"`
+
+	WebSub struct {
+		Addr        *string `toml:"addr"`
+		CallbackURL *string `toml:"callback_url"`
+		Lease       *string `toml:"lease"`
+	} `toml:"websub"`
+
+	Shards struct {
+		Count *int     `toml:"count"`
+		IDs   []string `toml:"ids"`
+	} `toml:"shards"`
+}
+
+// LoadConfig builds a Config from the defaults, then the TOML file at path, if one is
+// given, then FEEDBOT_* environment variables. The result should be validated once any
+// flags have been applied.
+func LoadConfig(path string) (Config, error) {
+	var file configFile
+	if path != "" {
+		md, err := toml.DecodeFile(path, &file)
+		if err != nil {
+			return Config{}, errors.Wrapf(err, "couldn't read config file %s", path)
+		}
+		if keys := md.Undecoded(); len(keys) > 0 {
+			return Config{}, errors.Errorf("unknown keys in config file %s: %v", path, keys)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&file).Elem(), "FEEDBOT"); err != nil {
+		return Config{}, err
+	}
+
+	config := DefaultConfig()
+	return config, file.apply(&config)
+}
+
+// applyEnv sets each field of a configFile from the environment variable named after it
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		key := prefix + "_" + strings.ToUpper(t.Field(i).Tag.Get("toml"))
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, key); err != nil {
+				return err
+			}
+			continue
+		}
+		s := os.Getenv(key)
+		if s == "" {
+			continue
+		}
+
+		if field.Kind() == reflect.Slice {
+			field.Set(reflect.ValueOf(strings.Split(s, ",")))
+			continue
+		}
+		p := reflect.New(field.Type().Elem())
+		switch p.Elem().Kind() {
+		case reflect.String:
+			p.Elem().SetString(s)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return errors.Errorf("%s must be a number, not %q", key, s)
+			}
+			p.Elem().SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return errors.Errorf("%s must be true or false, not %q", key, s)
+			}
+			p.Elem().SetBool(b)
+		}
+		field.Set(p)
+	}
+	return nil
+}
+
+// apply copies every setting which was given onto a Config
+func (f *configFile) apply(c *Config) error {
+	var problems []string
+	duration := func(key string, s *string, dst *time.Duration) {
+		if s == nil {
+			return
+		}
+		d, err := time.ParseDuration(*s)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s must be a duration such as \"90s\" or \"2h\", not %q", key, *s))
+			return
+		}
+		*dst = d
+	}
+	str := func(s *string, dst *string) {
+		if s != nil {
+			*dst = *s
+		}
+	}
+	num := func(n *int, dst *int) {
+		if n != nil {
+			*dst = *n
+		}
+	}
+
+	if f.Token != nil {
+		c.Token = "Bot " + strings.TrimPrefix(*f.Token, "Bot ")
+	}
+	if f.Owners != nil {
+		c.Owners = f.Owners
+	}
+	str(f.Prefix, &c.Prefix)
+	if f.LogLevel != nil {
+		lv, err := ParseLogLevel(*f.LogLevel)
+		if err != nil {
+			problems = append(problems, "log_level: "+err.Error())
+		}
+		c.LogLevel = lv
+	}
+	str(f.LogFormat, &c.LogFormat)
+	if f.SecretKey != nil && *f.SecretKey != "" {
+		key, err := ParseSecretKey(*f.SecretKey)
+		if err != nil {
+			problems = append(problems, "secret_key must be 32 bytes, base64 encoded")
+		}
+		c.SecretKey = key
+	}
+	if f.LocalSources != nil {
+		c.LocalSources = *f.LocalSources
+	}
+	duration("guild_retention", f.GuildRetention, &c.GuildRetention)
+	duration("feed_retention", f.FeedRetention, &c.FeedRetention)
+	duration("shutdown_timeout", f.ShutdownTimeout, &c.ShutdownTimeout)
+	str(f.OpsAddr, &c.OpsAddr)
+	duration("health_window", f.HealthWindow, &c.HealthWindow)
+	duration("leader_lease", f.LeaderLease, &c.LeaderLease)
+
+	db := &f.Database
+	str(db.Driver, &c.Database.Driver)
+	str(db.DSN, &c.Database.DSN)
+	str(db.JournalMode, &c.Database.JournalMode)
+	str(db.Synchronous, &c.Database.Synchronous)
+	duration("database.busy_timeout", db.BusyTimeout, &c.Database.BusyTimeout)
+	num(db.MaxOpenConns, &c.Database.MaxOpenConns)
+	num(db.MaxIdleConns, &c.Database.MaxIdleConns)
+	duration("database.conn_max_lifetime", db.ConnMaxLifetime, &c.Database.ConnMaxLifetime)
+
+	duration("checker.interval", f.Checker.Interval, &c.Checker.Interval)
+	num(f.Checker.Workers, &c.Checker.Workers)
+
+	duration("fetcher.timeout", f.Fetcher.Timeout, &c.Fetcher.Timeout)
+	if f.Fetcher.MaxSize != nil {
+		c.Fetcher.MaxSize = *f.Fetcher.MaxSize
+	}
+	num(f.Fetcher.MaxRedirects, &c.Fetcher.MaxRedirects)
+	str(f.Fetcher.UserAgent, &c.Fetcher.UserAgent)
+	if f.Fetcher.Allow != nil {
+		allow, err := ParseCIDRs(f.Fetcher.Allow)
+		if err != nil {
+			problems = append(problems, "fetcher.allow: "+errors.Cause(err).Error())
+		}
+		c.Fetcher.Allow = allow
+	}
+
+	str(f.WebSub.Addr, &c.WebSub.Addr)
+	str(f.WebSub.CallbackURL, &c.WebSub.CallbackURL)
+	duration("websub.lease", f.WebSub.Lease, &c.WebSub.Lease)
+
+	num(f.Shards.Count, &c.Shards.Count)
+	if f.Shards.IDs != nil {
+		ids, err := ParseShardIDs(f.Shards.IDs)
+		if err != nil {
+			problems = append(problems, "shards.ids: "+errors.Cause(err).Error())
+		}
+		c.Shards.IDs = ids
+	}
+
+	return configError(problems)
+}
+
+// RegisterFlags adds flags for the most commonly changed settings to a FlagSet; each
+// defaults to the Config's current value, so flags override the file and environment
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.Func("token", "token=unprefixed token", func(s string) error {
+		c.Token = "Bot " + s
+		return nil
+	})
+	fs.Func("secret-key", "secret-key=base64 encoded 32 byte key for encrypting feed credentials", func(s string) error {
+		key, err := ParseSecretKey(s)
+		c.SecretKey = key
+		return err
+	})
+	fs.Func("owners", "owners=comma separated IDs of users who may run owner-only commands", func(s string) error {
+		c.Owners = strings.Split(s, ",")
+		return nil
+	})
+	fs.StringVar(&c.Prefix, "prefix", c.Prefix, "prefix=default command prefix")
+	fs.Func("log-level", "log-level=debug, info, warn or error (default "+c.LogLevel.String()+")", func(s string) error {
+		lv, err := ParseLogLevel(s)
+		c.LogLevel = lv
+		return err
+	})
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log-format=text (logfmt) or json")
+	fs.BoolVar(&c.LocalSources, "local-sources", c.LocalSources, "local-sources=allow the bot owner to add file:// and exec:// feeds")
+	fs.DurationVar(&c.Checker.Interval, "poll-interval", c.Checker.Interval, "poll-interval=how often feeds are polled")
+	fs.IntVar(&c.Checker.Workers, "workers", c.Checker.Workers, "workers=how many feeds are fetched at once")
+	fs.DurationVar(&c.Fetcher.Timeout, "fetch-timeout", c.Fetcher.Timeout, "fetch-timeout=how long fetching a feed may take")
+	fs.StringVar(&c.Fetcher.UserAgent, "user-agent", c.Fetcher.UserAgent, "user-agent=User-Agent sent when fetching feeds")
+	fs.Func("allow-net", "allow-net=comma separated networks feeds may be fetched from, despite being private", func(s string) error {
+		allow, err := ParseCIDRs(strings.Split(s, ","))
+		c.Fetcher.Allow = allow
+		return err
+	})
+	fs.StringVar(&c.WebSub.Addr, "websub-addr", c.WebSub.Addr, "websub-addr=address the WebSub callback server listens on")
+	fs.StringVar(&c.WebSub.CallbackURL, "websub-url", c.WebSub.CallbackURL, "websub-url=public URL of the WebSub callback server; WebSub is disabled if unset")
+	fs.DurationVar(&c.GuildRetention, "guild-retention", c.GuildRetention, "guild-retention=how long to keep a guild's data after the bot is removed")
+	fs.DurationVar(&c.FeedRetention, "feed-retention", c.FeedRetention, "feed-retention=how long to keep a feed after its last subscription is removed")
+	fs.StringVar(&c.OpsAddr, "ops-addr", c.OpsAddr, "ops-addr=address to serve Prometheus metrics and health checks on, e.g. :9090")
+	fs.DurationVar(&c.HealthWindow, "health-window", c.HealthWindow, "health-window=how long since the last completed check before the bot is unhealthy (default 3 poll intervals)")
+	fs.DurationVar(&c.LeaderLease, "leader-lease", c.LeaderLease, "leader-lease=how long the instances checking feeds and answering commands hold their leases, 0 if this is the only instance")
+	fs.IntVar(&c.Shards.Count, "shard-count", c.Shards.Count, "shard-count=how many shards the bot has in total, 0 to use Discord's recommendation")
+	fs.Func("shard-ids", "shard-ids=comma separated shards this process runs, such as 0-3,8; every shard if unset", func(s string) error {
+		ids, err := ParseShardIDs(strings.Split(s, ","))
+		c.Shards.IDs = ids
+		return err
+	})
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "shutdown-timeout=how long in-flight work is given to finish when stopping")
+	c.Database.RegisterFlags(fs)
+}
+
+// Validate reports every setting which the bot can't run with
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(strings.TrimPrefix(c.Token, "Bot ") != "", "a token is required")
+	for _, id := range c.Owners {
+		_, err := strconv.ParseUint(id, 10, 64)
+		check(err == nil, "owners must be Discord user IDs, not %q", id)
+	}
+	check(validPrefix(c.Prefix), "prefix must be 1-%d characters without spaces or backticks, got %q", maxPrefixLen, c.Prefix)
+	check(c.LogLevel >= LogDebug && c.LogLevel <= LogError, "log_level is invalid")
+	check(c.Logger != nil || c.LogFormat == LogText || c.LogFormat == LogJSON, "log_format must be text or json, not %q", c.LogFormat)
+	check(len(c.SecretKey) == 0 || len(c.SecretKey) == 32, "secret_key must be 32 bytes")
+	check(c.GuildRetention >= 0, "guild_retention must not be negative")
+	check(c.FeedRetention >= 0, "feed_retention must not be negative")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+	check(c.HealthWindow >= 0, "health_window must not be negative")
+	check(c.LeaderLease == 0 || c.LeaderLease >= 3*time.Second, "leader_lease must be 0 or at least 3s, got %v", c.LeaderLease)
+
+	_, err := dialectFor(c.Database.Driver)
+	check(err == nil, "database.driver must be sqlite3 or postgres, not %q", c.Database.Driver)
+	check(c.Database.DSN != "", "database.dsn is required")
+	check(c.Database.BusyTimeout >= 0, "database.busy_timeout must not be negative")
+	check(c.Database.MaxOpenConns >= 0, "database.max_open_conns must not be negative")
+	check(c.Database.MaxIdleConns >= 0, "database.max_idle_conns must not be negative")
+	check(c.Database.ConnMaxLifetime >= 0, "database.conn_max_lifetime must not be negative")
+
+	check(c.Checker.Interval >= time.Minute, "checker.interval must be at least 1m, got %v", c.Checker.Interval)
+	check(c.Checker.Workers >= 1, "checker.workers must be at least 1, got %d", c.Checker.Workers)
+
+	check(c.Fetcher.Timeout > 0, "fetcher.timeout must be positive")
+	check(c.Fetcher.MaxSize > 0, "fetcher.max_size must be positive")
+	check(c.Fetcher.MaxRedirects >= 0, "fetcher.max_redirects must not be negative")
+	check(c.Fetcher.UserAgent != "", "fetcher.user_agent is required")
+
+	if c.WebSub.CallbackURL != "" {
+		u, err := url.Parse(c.WebSub.CallbackURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"websub.callback_url must be an http or https URL, got %q", c.WebSub.CallbackURL)
+		check(c.WebSub.Addr != "", "websub.addr is required when websub.callback_url is set")
+		check(c.WebSub.Lease > 0, "websub.lease must be positive")
+	}
+
+	check(c.Shards.Count >= 0, "shards.count must not be negative")
+	check(len(c.Shards.IDs) == 0 || c.Shards.Count > 0, "shards.count is required when shards.ids is set")
+	seen := map[int]bool{}
+	for _, id := range c.Shards.IDs {
+		check(c.Shards.Count == 0 || id < c.Shards.Count, "shard %d is out of range for %d shards", id, c.Shards.Count)
+		check(!seen[id], "shard %d is listed twice", id)
+		seen[id] = true
+	}
+
+	return configError(problems)
+}
+
+func configError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  - " + strings.Join(problems, "\n  - "))
+}
+
+// ConfigPath finds the -config flag among a binary's arguments, or else FEEDBOT_CONFIG;
+// it is needed ahead of flag.Parse, since the file supplies the defaults for every other flag
+func ConfigPath(args []string) string {
+	path := os.Getenv("FEEDBOT_CONFIG")
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if strings.HasPrefix(name, "config=") {
+			path = strings.TrimPrefix(name, "config=")
+		} else if name == "config" && i+1 < len(args) {
+			path = args[i+1]
+			i++
+		}
+	}
+	return path
+}
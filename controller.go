@@ -1,424 +1,1011 @@
-package feedbot
-
-import (
-	"database/sql"
-	"time"
-
-	_ "github.com/mattn/go-sqlite3" // driver for database/sql
-	"github.com/pkg/errors"
-)
-
-const schema string = `
-CREATE TABLE feeds (
-	id INTEGER PRIMARY KEY,
-	uri text UNIQUE NOT NULL,
-	last_updated timestamp NOT NULL
-);
-
-CREATE TABLE guild_config (
-	id text PRIMARY KEY,
-	contact text NOT NULL,
-	enable_embeds int NOT NULL,
-	enable_webhooks int NOT NULL
-);
-
-CREATE TABLE subscriptions (
-	id INTEGER PRIMARY KEY,
-	guild_id text NOT NULL,
-	channel_id text NOT NULL,
-	feed_id int NOT NULL,
-
-	FOREIGN KEY(feed_id) REFERENCES feeds(id)
-);
-
-CREATE TABLE subscription_overrides (
-	id INTEGER PRIMARY KEY,
-	sub_id int NOT NULL,
-	enable_embeds int,
-	enable_webhooks int,
-
-	FOREIGN KEY(sub_id) REFERENCES subscriptions(id) ON DELETE CASCADE
-);
-`
-
-// Feed contains the ID and URI of a RSS feed in the database
-type Feed struct {
-	ID          int
-	URI         string
-	LastUpdated time.Time
-}
-
-// Subscription contains the metadata for a subscription to a feed
-type Subscription struct {
-	ID        int
-	GuildID   string
-	ChannelID string
-	FeedID    int
-	Feed      *Feed
-	Overwrite *Overwrite
-}
-
-// GuildConfig contains guild-wide configuration
-type GuildConfig struct {
-	ID       string
-	Contact  string
-	Embeds   bool
-	Webhooks bool
-}
-
-// Overwrite contains a subscription overwrite
-type Overwrite struct {
-	ID             int
-	SubscriptionID int
-	Embeds         sql.NullBool
-	Webhooks       sql.NullBool
-}
-
-// Controller contains logic for manipulating the database
-type Controller struct {
-	db *sql.DB
-}
-
-var (
-	// ErrSubExists is returned when a subscription already exists for a feed/channel
-	ErrSubExists = errors.New("a subscription already exists")
-)
-
-// NewController creates a new controller
-func NewController() (*Controller, error) {
-	db, err := sql.Open("sqlite3", "./data.db")
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = db.Exec("PRAGMA foreign_keys = ON;")
-	if err != nil {
-		return nil, err
-	}
-
-	return &Controller{
-		db: db,
-	}, nil
-}
-
-// CreateTables should only be called once; this will initalize the
-// database for use with the bot.
-func (c *Controller) CreateTables() error {
-	_, err := c.db.Exec(schema)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	return nil
-}
-
-// GetOrCreateFeed will insert a new RSS Feed to the database if one does not exist, and return
-// a Feed for it.
-func (c *Controller) GetOrCreateFeed(uri string) (*Feed, error) {
-	_, err := c.db.Exec(`
-	INSERT OR IGNORE INTO feeds (uri, last_updated) VALUES ($1, $2);
-	`, uri, time.Time{})
-
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	rs, err := c.db.Query("SELECT id, uri, last_updated FROM feeds WHERE uri = $1;", uri)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	defer rs.Close()
-	rs.Next()
-
-	var f Feed
-	err = rs.Scan(&f.ID, &f.URI, &f.LastUpdated)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	return &f, nil
-}
-
-// GetFeeds will get a list of feeds to query from the database
-func (c *Controller) GetFeeds() ([]Feed, error) {
-	f := []Feed{}
-	r, err := c.db.Query("SELECT id, uri, last_updated FROM feeds;")
-	if err != nil {
-		return f, err
-	}
-	defer r.Close()
-
-	for r.Next() {
-		var i Feed
-		if err = r.Scan(&i.ID, &i.URI, &i.LastUpdated); err != nil {
-			return f, errors.WithStack(err)
-		}
-		f = append(f, i)
-	}
-
-	return f, nil
-}
-
-// UpdateFeedTimestamp updates a feed's last_updated value
-func (c *Controller) UpdateFeedTimestamp(feed *Feed, timestamp *time.Time) error {
-	r, err := c.db.Exec("UPDATE feeds SET last_updated = ? WHERE id = ?;",
-		timestamp, feed.ID)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	if n, err := r.RowsAffected(); err != nil {
-		return errors.WithStack(err)
-	} else if n != 1 {
-		return errors.New("invalid number of rows affected")
-	}
-
-	return nil
-}
-
-// AddSubscription adds a subscription to the given feed for a channel
-func (c *Controller) AddSubscription(channelID, guildID string, feedID int) (*Subscription, error) {
-	// ensure subscriptions don't already exist
-	r, err := c.db.Query(`
-	SELECT id FROM subscriptions WHERE feed_id = ? AND channel_id = ?;
-	`, feedID, channelID)
-
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	defer r.Close()
-	if r.Next() {
-		var s Subscription
-		err = r.Scan(&s.ID)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		s.ChannelID = channelID
-		s.FeedID = feedID
-		return &s, ErrSubExists
-	}
-
-	_, err = c.db.Exec(`
-	INSERT INTO subscriptions (guild_id, channel_id, feed_id)
-	VALUES (?, ?, ?);
-	`, guildID, channelID, feedID)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	_, err = c.db.Exec(`
-	INSERT INTO subscription_overrides (sub_id) 
-		SELECT id FROM subscriptions WHERE channel_id = ? AND feed_id = ?
-	`, channelID, feedID)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	rs, err := c.db.Query("SELECT id FROM subscriptions WHERE channel_id = $1 AND feed_id = $2;",
-		channelID, feedID)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	defer rs.Close()
-	rs.Next()
-
-	var s Subscription
-	err = rs.Scan(&s.ID)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	s.GuildID = guildID
-	s.ChannelID = channelID
-	s.FeedID = feedID
-	return &s, nil
-}
-
-// GetSubscription gets a subscription from its ID
-func (c *Controller) GetSubscription(id int) (*Subscription, error) {
-	r, err := c.db.Query("SELECT id, guild_id, channel_id, feed_id FROM subscriptions WHERE id = ?;", id)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	defer r.Close()
-	r.Next()
-
-	var s Subscription
-	err = r.Scan(&s.ID, &s.GuildID, &s.ChannelID, &s.FeedID)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	return &s, nil
-}
-
-// GetSubscriptions selects all subscriptions for a given guild
-func (c *Controller) GetSubscriptions(guildID string) ([]Subscription, error) {
-	var subs []Subscription
-	r, err := c.db.Query(`
-	SELECT s.id, s.channel_id, f.uri, o.enable_embeds, o.enable_webhooks
-		FROM subscriptions as s
-		INNER JOIN feeds as f ON f.id = s.feed_id
-		INNER JOIN subscription_overrides as o ON o.sub_id = s.id
-		WHERE s.guild_id = ?;
-	`, guildID)
-
-	if err != nil {
-		return subs, errors.WithStack(err)
-	}
-	defer r.Close()
-	for r.Next() {
-		var s Subscription
-		var f Feed
-		var o Overwrite
-		err = r.Scan(&s.ID, &s.ChannelID, &f.URI, &o.Embeds, &o.Webhooks)
-		if err != nil {
-			return subs, errors.WithStack(err)
-		}
-		s.Feed = &f
-		s.Overwrite = &o
-		subs = append(subs, s)
-	}
-	return subs, nil
-}
-
-// ModifySubscriptionChannel changes the channel_id for a Subscription
-func (c *Controller) ModifySubscriptionChannel(id int, channelID string) error {
-	r, err := c.db.Exec("UPDATE subscriptions SET channel_id = ? WHERE id = ?;", channelID, id)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if n, err := r.RowsAffected(); err == nil {
-		if n == 0 {
-			return sql.ErrNoRows
-		}
-	}
-	return err
-}
-
-// DestroySubscription deletes a subscription from the database
-func (c *Controller) DestroySubscription(id int) error {
-	r, err := c.db.Exec("DELETE FROM subscriptions WHERE id = ?;", id)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if n, err := r.RowsAffected(); err == nil {
-		if n == 0 {
-			return errors.Wrap(sql.ErrNoRows, "no rows on subscription delete")
-		}
-	}
-	return err
-}
-
-// CreateGuildConfig creates an empty GuildConfig for a guild
-func (c *Controller) CreateGuildConfig(guildID string, ownerContact string) error {
-	r, err := c.db.Exec(`
-	INSERT INTO guild_config (id, contact, enable_embeds, enable_webhooks)
-	VALUES (?, ?, 0, 0);
-	`, guildID, ownerContact)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if n, err := r.RowsAffected(); err == nil {
-		if n == 0 {
-			return errors.Wrap(sql.ErrNoRows, "no rows on modify guild embeds")
-		}
-	}
-	return err
-}
-
-// GetGuildConfig gets a guild's config
-func (c *Controller) GetGuildConfig(guildID string) (*GuildConfig, error) {
-	r, err := c.db.Query(`
-	SELECT id, contact, enable_embeds, enable_webhooks
-	FROM guild_config WHERE id = ?;
-	`, guildID)
-
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	defer r.Close()
-	r.Next()
-
-	var g GuildConfig
-	err = r.Scan(&g.ID, &g.Contact, &g.Embeds, &g.Webhooks)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	return &g, nil
-}
-
-// ModifyGuildContact changes the guild's contact address
-func (c *Controller) ModifyGuildContact(guildID string, contact string) error {
-	r, err := c.db.Exec("UPDATE guild_config SET contact = ? WHERE id = ?;", contact, guildID)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if n, err := r.RowsAffected(); err == nil {
-		if n == 0 {
-			return errors.Wrap(sql.ErrNoRows, "no rows on modify guild contact")
-		}
-	}
-	return errors.WithStack(err)
-}
-
-// ModifyGuildEmbeds changes the guild's embed rule
-func (c *Controller) ModifyGuildEmbeds(guildID string, embeds bool) error {
-	r, err := c.db.Exec("UPDATE guild_config SET enable_embeds = ? WHERE id = ?;", embeds, guildID)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if n, err := r.RowsAffected(); err == nil {
-		if n == 0 {
-			return errors.Wrap(sql.ErrNoRows, "no rows on modify guild embeds")
-		}
-	}
-	return errors.WithStack(err)
-}
-
-// ModifyGuildWebhooks changes the guild's webhook rule
-func (c *Controller) ModifyGuildWebhooks(guildID string, embeds bool) error {
-	r, err := c.db.Exec("UPDATE guild_config SET enable_embeds = ? WHERE id = ?;", embeds, guildID)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if n, err := r.RowsAffected(); err == nil {
-		if n == 0 {
-			return errors.Wrap(sql.ErrNoRows, "no rows on modify guild webhooks")
-		}
-	}
-	return errors.WithStack(err)
-}
-
-// DestroyGuildData removes all data assosciated with a guild.
-func (c *Controller) DestroyGuildData(guildID string) {
-	// TODO
-}
-
-// ModifyOverwriteEmbeds changes the embeds policy of a subscription overwrite
-func (c *Controller) ModifyOverwriteEmbeds(subID int, embeds sql.NullBool) error {
-	r, err := c.db.Exec("UPDATE subscription_overrides SET enable_embeds = ? WHERE sub_id = ?",
-		embeds, subID)
-	if err != nil {
-		return err
-	}
-	if n, err := r.RowsAffected(); err == nil {
-		if n == 0 {
-			return errors.Wrap(sql.ErrNoRows, "no rows on modify override embeds")
-		}
-	}
-	return errors.WithStack(err)
-}
-
-// ModifyOverwriteWebhooks changes the webhooks policy of a subscription overwrite
-func (c *Controller) ModifyOverwriteWebhooks(subID int, webhooks sql.NullBool) error {
-	r, err := c.db.Exec("UPDATE subscription_overrides SET enable_webhooks = ? WHERE sub_id = ?",
-		webhooks, subID)
-	if err != nil {
-		return err
-	}
-	if n, err := r.RowsAffected(); err == nil {
-		if n == 0 {
-			return errors.Wrap(sql.ErrNoRows, "no rows on modify override embeds")
-		}
-	}
-	return errors.WithStack(err)
-}
+package feedbot
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"           // driver for database/sql
+	_ "github.com/mattn/go-sqlite3" // driver for database/sql
+	"github.com/pkg/errors"
+)
+
+// Feed contains the ID and URI of a RSS feed in the database
+type Feed struct {
+	ID  int
+	URI string
+	// GuildID is set on a feed private to one guild, fetched with its credentials; it
+	// is empty for a feed any guild may subscribe to
+	GuildID     string
+	LastUpdated time.Time
+	// Credentials is a sealed FeedAuth, or nil if the feed doesn't require any
+	Credentials []byte
+	// PushedUntil is when the feed's WebSub lease expires, or nil if it is polled
+	PushedUntil *time.Time
+}
+
+// FeedCredentials contains the sealed credentials for a feed, and the guild which owns them
+type FeedCredentials struct {
+	FeedID  int
+	GuildID string
+	Data    []byte
+}
+
+// WebSubSubscription contains the state of a feed's subscription to a WebSub hub
+type WebSubSubscription struct {
+	FeedID int
+	Hub    string
+	Topic  string
+	Secret string
+	// Active is set once the hub has verified the subscription
+	Active       bool
+	LeaseExpires time.Time
+	// Callback is the token in the callback URL of the verified subscription, which the
+	// hub pushes to
+	Callback string
+	// Pending is the token in the callback URL of a request the hub hasn't yet verified;
+	// empty if there is none
+	Pending string
+}
+
+// Subscription contains the metadata for a subscription to a feed
+type Subscription struct {
+	ID        int
+	GuildID   string
+	ChannelID string
+	FeedID    int
+	Feed      *Feed
+	Overwrite *Overwrite
+	// Pause is set while the subscription is paused; see Paused
+	Pause *Pause
+}
+
+// Pause records that a subscription was paused, so nothing is posted for it
+type Pause struct {
+	At time.Time
+	// Until is when the pause ends by itself; nil pauses it until it is resumed
+	Until *time.Time
+	// Seen is the feed's timestamp when it was paused, items after it were missed
+	Seen time.Time
+}
+
+// Paused reports whether a subscription is paused at the given time
+func (s *Subscription) Paused(now time.Time) bool {
+	return s.Pause != nil && (s.Pause.Until == nil || now.Before(*s.Pause.Until))
+}
+
+// pauseColumns scans a subscription's paused_at, paused_until and paused_seen columns
+type pauseColumns struct {
+	at, until, seen *time.Time
+}
+
+func (p *pauseColumns) dest() []interface{} {
+	return []interface{}{&p.at, &p.until, &p.seen}
+}
+
+func (p *pauseColumns) pause() *Pause {
+	if p.at == nil {
+		return nil
+	}
+	pause := &Pause{At: *p.at, Until: p.until}
+	if p.seen != nil {
+		pause.Seen = *p.seen
+	}
+	return pause
+}
+
+// GuildConfig contains guild-wide configuration
+type GuildConfig struct {
+	ID       string
+	Contact  string
+	Embeds   bool
+	Webhooks bool
+	// Prefix is the guild's command prefix; empty when it uses the bot's default
+	Prefix string
+}
+
+// Stats counts what the bot is serving; departed guilds, and their subscriptions, are
+// left out
+type Stats struct {
+	Guilds        int
+	Subscriptions int
+	// ActiveFeeds are the feeds GetFeeds lists
+	ActiveFeeds int
+}
+
+// GuildImport is a set of changes to a guild, which ImportGuild applies all at once
+type GuildImport struct {
+	// Config replaces the guild's contact, embeds, webhooks and prefix; nil keeps them
+	Config *GuildConfig
+	// Subscriptions are added to the guild, or have their overwrites set
+	Subscriptions []ImportedSubscription
+}
+
+// ImportedSubscription is a subscription in a GuildImport
+type ImportedSubscription struct {
+	// ID is an existing subscription of the guild's whose overwrites are set; zero
+	// subscribes ChannelID to FeedID, or sets the overwrites of the channel's existing
+	// subscription to it
+	ID        int
+	ChannelID string
+	FeedID    int
+	Embeds    sql.NullBool
+	Webhooks  sql.NullBool
+}
+
+// Overwrite contains a subscription overwrite
+type Overwrite struct {
+	ID             int
+	SubscriptionID int
+	Embeds         sql.NullBool
+	Webhooks       sql.NullBool
+}
+
+// Controller contains logic for manipulating the database; it implements Storage for
+// both SQLite and Postgres
+type Controller struct {
+	db      *sql.DB
+	driver  string
+	dialect dialect
+	log     *slog.Logger
+	metrics *Metrics
+}
+
+var _ Storage = (*Controller)(nil)
+
+var (
+	// ErrSubExists is returned when a subscription already exists for a feed/channel
+	ErrSubExists = errors.New("a subscription already exists")
+)
+
+// NewController creates a new controller; every query is logged at debug level
+func NewController(config DatabaseConfig, log *slog.Logger) (*Controller, error) {
+	d, err := dialectFor(config.Driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(config.Driver, config.dsn())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+
+	// sql.Open doesn't connect; fail now rather than on the first command
+	if err = db.Ping(); err != nil {
+		return nil, errors.Wrapf(err, "couldn't open %s database", config.Driver)
+	}
+
+	return &Controller{
+		db:      db,
+		driver:  config.Driver,
+		dialect: d,
+		log:     log,
+	}, nil
+}
+
+// Close closes the database
+func (c *Controller) Close() error {
+	return c.db.Close()
+}
+
+// Ping checks that the database can still be reached
+func (c *Controller) Ping(ctx context.Context) error {
+	return errors.WithStack(c.db.PingContext(ctx))
+}
+
+func (c *Controller) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	defer c.observe(ctx, "exec", query, time.Now())
+	return c.db.ExecContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *Controller) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	defer c.observe(ctx, "query", query, time.Now())
+	return c.db.QueryContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *Controller) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	defer c.observe(ctx, "query", query, time.Now())
+	return c.db.QueryRowContext(ctx, c.dialect.rebind(query), args...)
+}
+
+// observe logs a query, and records how long it took to start returning results
+func (c *Controller) observe(ctx context.Context, op string, query string, start time.Time) {
+	d := time.Since(start)
+	c.metrics.queried(op, d)
+	if c.log.Enabled(ctx, slog.LevelDebug) {
+		c.log.DebugContext(ctx, "query", "query", strings.Join(strings.Fields(query), " "), "duration", d)
+	}
+}
+
+// tx is a transaction whose queries are rebound and observed like the Controller's, and
+// run under the context it was begun with
+type tx struct {
+	*sql.Tx
+	ctx context.Context
+	c   *Controller
+}
+
+func (t *tx) exec(query string, args ...interface{}) (sql.Result, error) {
+	defer t.c.observe(t.ctx, "exec", query, time.Now())
+	return t.ExecContext(t.ctx, t.c.dialect.rebind(query), args...)
+}
+
+func (t *tx) queryRow(query string, args ...interface{}) *sql.Row {
+	defer t.c.observe(t.ctx, "query", query, time.Now())
+	return t.QueryRowContext(t.ctx, t.c.dialect.rebind(query), args...)
+}
+
+// transact runs fn in a transaction, which is committed if fn returns nil and rolled
+// back otherwise; fn's error is returned as-is, so sentinels like ErrSubExists survive
+func (c *Controller) transact(ctx context.Context, fn func(t *tx) error) error {
+	t, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = fn(&tx{Tx: t, ctx: ctx, c: c}); err != nil {
+		t.Rollback()
+		return err
+	}
+	return errors.WithStack(t.Commit())
+}
+
+// GetOrCreateFeed gets the feed a guild subscribes to for a URI; that is the guild's
+// private feed if it has one, or else the shared feed, which is created if it doesn't exist.
+func (c *Controller) GetOrCreateFeed(ctx context.Context, uri string, guildID string) (*Feed, error) {
+	var f Feed
+	err := c.transact(ctx, func(t *tx) error {
+		err := t.queryRow("SELECT id, uri, guild_id, last_updated FROM feeds WHERE uri = ? AND guild_id = ?;", uri, guildID).
+			Scan(&f.ID, &f.URI, &f.GuildID, &f.LastUpdated)
+		if err != sql.ErrNoRows {
+			return errors.WithStack(err)
+		}
+
+		_, err = t.exec(`
+		INSERT INTO feeds (uri, guild_id, last_updated) VALUES (?, '', ?)
+		ON CONFLICT(uri, guild_id) DO NOTHING;
+		`, uri, time.Time{})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = t.queryRow("SELECT id, uri, guild_id, last_updated FROM feeds WHERE uri = ? AND guild_id = '';", uri).
+			Scan(&f.ID, &f.URI, &f.GuildID, &f.LastUpdated)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// activeSubscriptions matches the subscriptions to feed f from guilds the bot is still in
+const activeSubscriptions = `
+	SELECT 1 FROM subscriptions as s
+		LEFT JOIN guild_config as g ON g.id = s.guild_id
+		WHERE s.feed_id = f.id AND g.left_at IS NULL
+`
+
+// GetFeeds will get a list of feeds to query from the database; feeds nobody is
+// subscribed to are left out
+func (c *Controller) GetFeeds(ctx context.Context) ([]Feed, error) {
+	f := []Feed{}
+	r, err := c.query(ctx, `
+	SELECT f.id, f.uri, f.last_updated, fc.data, w.active, w.lease_expires
+		FROM feeds as f
+		LEFT JOIN feed_credentials as fc ON fc.feed_id = f.id
+		LEFT JOIN websub_subscriptions as w ON w.feed_id = f.id
+		WHERE EXISTS (`+activeSubscriptions+`);
+	`)
+	if err != nil {
+		return f, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var i Feed
+		var active sql.NullBool
+		var expires *time.Time
+		if err = r.Scan(&i.ID, &i.URI, &i.LastUpdated, &i.Credentials, &active, &expires); err != nil {
+			return f, errors.WithStack(err)
+		}
+		if active.Bool {
+			i.PushedUntil = expires
+		}
+		f = append(f, i)
+	}
+
+	return f, nil
+}
+
+// MarkOrphanedFeeds records when each feed lost its last subscription, and forgets that
+// time for any feed which has since gained one. Subscriptions from departed guilds still
+// count, the feed is only orphaned once those guilds are purged.
+func (c *Controller) MarkOrphanedFeeds(ctx context.Context, now time.Time) error {
+	return c.transact(ctx, func(t *tx) error {
+		_, err := t.exec(`
+		UPDATE feeds SET orphaned_at = ?
+			WHERE orphaned_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM subscriptions WHERE feed_id = feeds.id);
+		`, now)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = t.exec(`
+		UPDATE feeds SET orphaned_at = NULL
+			WHERE orphaned_at IS NOT NULL
+			AND EXISTS (SELECT 1 FROM subscriptions WHERE feed_id = feeds.id);
+		`)
+		return errors.WithStack(err)
+	})
+}
+
+// DestroyOrphanedFeeds deletes every feed, along with its credentials and WebSub state,
+// which has had no subscriptions since before the given time. A feed whose WebSub lease
+// is still running at now is kept until it lapses, so its hub isn't left pushing to a
+// callback which no longer exists.
+func (c *Controller) DestroyOrphanedFeeds(ctx context.Context, before, now time.Time) (int64, error) {
+	// re-check for subscriptions, in case one was added since the feed was marked
+	const orphaned = `
+	SELECT id FROM feeds WHERE orphaned_at < ?
+		AND NOT EXISTS (SELECT 1 FROM subscriptions WHERE feed_id = feeds.id)
+		AND NOT EXISTS (
+			SELECT 1 FROM websub_subscriptions
+			WHERE feed_id = feeds.id AND active = TRUE AND lease_expires > ?
+		)
+	`
+	queries := []string{
+		"DELETE FROM feed_credentials WHERE feed_id IN (" + orphaned + ");",
+		"DELETE FROM websub_subscriptions WHERE feed_id IN (" + orphaned + ");",
+	}
+
+	var n int64
+	err := c.transact(ctx, func(t *tx) error {
+		for _, q := range queries {
+			if _, err := t.exec(q, before, now); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		r, err := t.exec("DELETE FROM feeds WHERE id IN ("+orphaned+");", before, now)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		n, err = r.RowsAffected()
+		return errors.WithStack(err)
+	})
+	return n, err
+}
+
+// GetFeed gets a feed from its ID
+func (c *Controller) GetFeed(ctx context.Context, id int) (*Feed, error) {
+	r, err := c.query(ctx, "SELECT id, uri, guild_id, last_updated FROM feeds WHERE id = ?;", id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer r.Close()
+	if !r.Next() {
+		return nil, errors.WithStack(sql.ErrNoRows)
+	}
+
+	var f Feed
+	err = r.Scan(&f.ID, &f.URI, &f.GuildID, &f.LastUpdated)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &f, nil
+}
+
+// UpdateFeedTimestamp updates a feed's last_updated value
+func (c *Controller) UpdateFeedTimestamp(ctx context.Context, feed *Feed, timestamp *time.Time) error {
+	r, err := c.exec(ctx, "UPDATE feeds SET last_updated = ? WHERE id = ?;",
+		timestamp, feed.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if n, err := r.RowsAffected(); err != nil {
+		return errors.WithStack(err)
+	} else if n != 1 {
+		return errors.New("invalid number of rows affected")
+	}
+
+	return nil
+}
+
+// GetFeedCredentials gets the sealed credentials for a feed; if the feed has none,
+// both return values will be nil.
+func (c *Controller) GetFeedCredentials(ctx context.Context, feedID int) (*FeedCredentials, error) {
+	r, err := c.query(ctx, "SELECT feed_id, guild_id, data FROM feed_credentials WHERE feed_id = ?;", feedID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer r.Close()
+	if !r.Next() {
+		return nil, errors.WithStack(r.Err())
+	}
+
+	var fc FeedCredentials
+	err = r.Scan(&fc.FeedID, &fc.GuildID, &fc.Data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &fc, nil
+}
+
+// SetFeedCredentials stores sealed credentials for a feed, replacing any it already had
+func (c *Controller) SetFeedCredentials(ctx context.Context, feedID int, guildID string, data []byte) error {
+	_, err := c.exec(ctx, `
+	INSERT INTO feed_credentials (feed_id, guild_id, data)
+	VALUES (?, ?, ?)
+	ON CONFLICT(feed_id) DO UPDATE SET guild_id = excluded.guild_id, data = excluded.data;
+	`, feedID, guildID, data)
+	return errors.WithStack(err)
+}
+
+// DestroyFeedCredentials removes the credentials for a feed
+func (c *Controller) DestroyFeedCredentials(ctx context.Context, feedID int) error {
+	_, err := c.exec(ctx, "DELETE FROM feed_credentials WHERE feed_id = ?;", feedID)
+	return errors.WithStack(err)
+}
+
+// GetWebSubSubscription gets the WebSub state for a feed; if the feed has none,
+// both return values will be nil.
+func (c *Controller) GetWebSubSubscription(ctx context.Context, feedID int) (*WebSubSubscription, error) {
+	r, err := c.query(ctx, `
+	SELECT feed_id, hub, topic, secret, active, lease_expires, callback_token, pending_token
+	FROM websub_subscriptions WHERE feed_id = ?;
+	`, feedID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer r.Close()
+	if !r.Next() {
+		return nil, errors.WithStack(r.Err())
+	}
+
+	var w WebSubSubscription
+	err = r.Scan(&w.FeedID, &w.Hub, &w.Topic, &w.Secret, &w.Active, &w.LeaseExpires, &w.Callback, &w.Pending)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &w, nil
+}
+
+// GetExpiringWebSubSubscriptions gets every WebSub subscription whose lease expires before
+// the given time, including those which were never verified. Feeds nobody is subscribed to
+// are left out, so their leases lapse before the feeds are destroyed.
+func (c *Controller) GetExpiringWebSubSubscriptions(ctx context.Context, before time.Time) ([]WebSubSubscription, error) {
+	var subs []WebSubSubscription
+	r, err := c.query(ctx, `
+	SELECT w.feed_id, w.hub, w.topic, w.secret, w.active, w.lease_expires, w.callback_token, w.pending_token
+		FROM websub_subscriptions as w
+		INNER JOIN feeds as f ON f.id = w.feed_id
+		WHERE w.lease_expires < ? AND EXISTS (`+activeSubscriptions+`);
+	`, before)
+	if err != nil {
+		return subs, errors.WithStack(err)
+	}
+	defer r.Close()
+	for r.Next() {
+		var w WebSubSubscription
+		err = r.Scan(&w.FeedID, &w.Hub, &w.Topic, &w.Secret, &w.Active, &w.LeaseExpires, &w.Callback, &w.Pending)
+		if err != nil {
+			return subs, errors.WithStack(err)
+		}
+		subs = append(subs, w)
+	}
+	return subs, errors.WithStack(r.Err())
+}
+
+// SetWebSubSubscription stores the WebSub state for a feed, replacing any it already had
+func (c *Controller) SetWebSubSubscription(ctx context.Context, w *WebSubSubscription) error {
+	_, err := c.exec(ctx, `
+	INSERT INTO websub_subscriptions (feed_id, hub, topic, secret, active, lease_expires, callback_token, pending_token)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(feed_id) DO UPDATE SET hub = excluded.hub, topic = excluded.topic,
+		secret = excluded.secret, active = excluded.active, lease_expires = excluded.lease_expires,
+		callback_token = excluded.callback_token, pending_token = excluded.pending_token;
+	`, w.FeedID, w.Hub, w.Topic, w.Secret, w.Active, w.LeaseExpires, w.Callback, w.Pending)
+	return errors.WithStack(err)
+}
+
+// DestroyWebSubSubscription removes the WebSub state for a feed, returning it to polling
+func (c *Controller) DestroyWebSubSubscription(ctx context.Context, feedID int) error {
+	_, err := c.exec(ctx, "DELETE FROM websub_subscriptions WHERE feed_id = ?;", feedID)
+	return errors.WithStack(err)
+}
+
+// PrivatizeFeed moves a guild's subscriptions to a feed onto the guild's private feed for
+// the same URI, creating it if needed, so credentials can be set on it without other
+// guilds' subscriptions being fetched with them
+func (c *Controller) PrivatizeFeed(ctx context.Context, feedID int, guildID string) (*Feed, error) {
+	var f Feed
+	err := c.transact(ctx, func(t *tx) error {
+		var uri string
+		var last time.Time
+		err := t.queryRow("SELECT uri, last_updated FROM feeds WHERE id = ?;", feedID).Scan(&uri, &last)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// the private feed starts where the shared one is, so nothing is posted twice
+		_, err = t.exec(`
+		INSERT INTO feeds (uri, guild_id, last_updated) VALUES (?, ?, ?)
+		ON CONFLICT(uri, guild_id) DO NOTHING;
+		`, uri, guildID, last)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = t.queryRow("SELECT id, uri, guild_id, last_updated FROM feeds WHERE uri = ? AND guild_id = ?;", uri, guildID).
+			Scan(&f.ID, &f.URI, &f.GuildID, &f.LastUpdated)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		_, err = t.exec("UPDATE subscriptions SET feed_id = ? WHERE feed_id = ? AND guild_id = ?;", f.ID, feedID, guildID)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// AddSubscription adds a subscription to the given feed for a channel; if the channel is
+// already subscribed, the existing subscription is returned along with ErrSubExists.
+func (c *Controller) AddSubscription(ctx context.Context, channelID, guildID string, feedID int) (*Subscription, error) {
+	s := Subscription{
+		GuildID:   guildID,
+		ChannelID: channelID,
+		FeedID:    feedID,
+	}
+	err := c.transact(ctx, func(t *tx) error {
+		// UNIQUE(channel_id, feed_id) settles concurrent adds; the loser inserts nothing
+		err := t.queryRow(`
+		INSERT INTO subscriptions (guild_id, channel_id, feed_id)
+		VALUES (?, ?, ?)
+		ON CONFLICT(channel_id, feed_id) DO NOTHING
+		RETURNING id;
+		`, guildID, channelID, feedID).Scan(&s.ID)
+		if err == sql.ErrNoRows {
+			err = t.queryRow("SELECT id FROM subscriptions WHERE channel_id = ? AND feed_id = ?;",
+				channelID, feedID).Scan(&s.ID)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return ErrSubExists
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		_, err = t.exec("INSERT INTO subscription_overrides (sub_id) VALUES (?);", s.ID)
+		return errors.WithStack(err)
+	})
+	if err == ErrSubExists {
+		return &s, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetSubscription gets a subscription from its ID
+func (c *Controller) GetSubscription(ctx context.Context, id int) (*Subscription, error) {
+	r, err := c.query(ctx, `
+	SELECT id, guild_id, channel_id, feed_id, paused_at, paused_until, paused_seen
+	FROM subscriptions WHERE id = ?;
+	`, id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer r.Close()
+	if !r.Next() {
+		return nil, errors.WithStack(sql.ErrNoRows)
+	}
+
+	var s Subscription
+	var p pauseColumns
+	err = r.Scan(append([]interface{}{&s.ID, &s.GuildID, &s.ChannelID, &s.FeedID}, p.dest()...)...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s.Pause = p.pause()
+	return &s, nil
+}
+
+// GetSubscriptions selects all subscriptions for a given guild
+func (c *Controller) GetSubscriptions(ctx context.Context, guildID string) ([]Subscription, error) {
+	var subs []Subscription
+	r, err := c.query(ctx, `
+	SELECT s.id, s.channel_id, f.uri, o.enable_embeds, o.enable_webhooks,
+		s.paused_at, s.paused_until, s.paused_seen
+		FROM subscriptions as s
+		INNER JOIN feeds as f ON f.id = s.feed_id
+		INNER JOIN subscription_overrides as o ON o.sub_id = s.id
+		WHERE s.guild_id = ?;
+	`, guildID)
+
+	if err != nil {
+		return subs, errors.WithStack(err)
+	}
+	defer r.Close()
+	for r.Next() {
+		var s Subscription
+		var f Feed
+		var o Overwrite
+		var p pauseColumns
+		err = r.Scan(append([]interface{}{&s.ID, &s.ChannelID, &f.URI, &o.Embeds, &o.Webhooks}, p.dest()...)...)
+		if err != nil {
+			return subs, errors.WithStack(err)
+		}
+		s.Feed = &f
+		s.Overwrite = &o
+		s.Pause = p.pause()
+		subs = append(subs, s)
+	}
+	return subs, nil
+}
+
+// GetFeedSubscriptions selects the subscriptions to a feed from guilds the bot is still in,
+// along with their overwrites
+func (c *Controller) GetFeedSubscriptions(ctx context.Context, feedID int) ([]Subscription, error) {
+	var subs []Subscription
+	r, err := c.query(ctx, `
+	SELECT s.id, s.guild_id, s.channel_id, s.feed_id, o.enable_embeds, o.enable_webhooks,
+		s.paused_at, s.paused_until, s.paused_seen
+		FROM subscriptions as s
+		INNER JOIN subscription_overrides as o ON o.sub_id = s.id
+		LEFT JOIN guild_config as g ON g.id = s.guild_id
+		WHERE s.feed_id = ? AND g.left_at IS NULL
+		ORDER BY s.id;
+	`, feedID)
+	if err != nil {
+		return subs, errors.WithStack(err)
+	}
+	defer r.Close()
+	for r.Next() {
+		var s Subscription
+		var o Overwrite
+		var p pauseColumns
+		err = r.Scan(append([]interface{}{&s.ID, &s.GuildID, &s.ChannelID, &s.FeedID, &o.Embeds, &o.Webhooks}, p.dest()...)...)
+		if err != nil {
+			return subs, errors.WithStack(err)
+		}
+		o.SubscriptionID = s.ID
+		s.Overwrite = &o
+		s.Pause = p.pause()
+		subs = append(subs, s)
+	}
+	return subs, errors.WithStack(r.Err())
+}
+
+// ModifySubscriptionChannel changes the channel_id for a Subscription
+func (c *Controller) ModifySubscriptionChannel(ctx context.Context, id int, channelID string) error {
+	r, err := c.exec(ctx, "UPDATE subscriptions SET channel_id = ? WHERE id = ?;", channelID, id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		if n == 0 {
+			return sql.ErrNoRows
+		}
+	}
+	return err
+}
+
+// PauseSubscription pauses a subscription, or changes how it is paused
+func (c *Controller) PauseSubscription(ctx context.Context, id int, pause Pause) error {
+	r, err := c.exec(ctx, "UPDATE subscriptions SET paused_at = ?, paused_until = ?, paused_seen = ? WHERE id = ?;",
+		pause.At, pause.Until, pause.Seen, id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n, err := r.RowsAffected(); err == nil && n == 0 {
+		return errors.WithStack(sql.ErrNoRows)
+	}
+	return nil
+}
+
+// ResumeSubscription resumes a paused subscription
+func (c *Controller) ResumeSubscription(ctx context.Context, id int) error {
+	r, err := c.exec(ctx, "UPDATE subscriptions SET paused_at = NULL, paused_until = NULL, paused_seen = NULL WHERE id = ?;", id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n, err := r.RowsAffected(); err == nil && n == 0 {
+		return errors.WithStack(sql.ErrNoRows)
+	}
+	return nil
+}
+
+// DestroySubscription deletes a subscription from the database
+func (c *Controller) DestroySubscription(ctx context.Context, id int) error {
+	r, err := c.exec(ctx, "DELETE FROM subscriptions WHERE id = ?;", id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		if n == 0 {
+			return errors.Wrap(sql.ErrNoRows, "no rows on subscription delete")
+		}
+	}
+	return err
+}
+
+// CreateGuildConfig creates an empty GuildConfig for a guild; if the guild already has one,
+// it is kept, and the guild is no longer considered departed.
+func (c *Controller) CreateGuildConfig(ctx context.Context, guildID string, ownerContact string) error {
+	_, err := c.exec(ctx, `
+	INSERT INTO guild_config (id, contact, enable_embeds, enable_webhooks)
+	VALUES (?, ?, FALSE, FALSE)
+	ON CONFLICT(id) DO UPDATE SET left_at = NULL;
+	`, guildID, ownerContact)
+	return errors.WithStack(err)
+}
+
+// MarkGuildLeft records that the bot was removed from a guild; its data is kept until
+// it is purged, in case the removal was a mistake
+func (c *Controller) MarkGuildLeft(ctx context.Context, guildID string, at time.Time) error {
+	_, err := c.exec(ctx, "UPDATE guild_config SET left_at = ? WHERE id = ? AND left_at IS NULL;", at, guildID)
+	return errors.WithStack(err)
+}
+
+// GetDepartedGuilds gets the IDs of every guild the bot left before the given time
+func (c *Controller) GetDepartedGuilds(ctx context.Context, before time.Time) ([]string, error) {
+	var ids []string
+	r, err := c.query(ctx, "SELECT id FROM guild_config WHERE left_at IS NOT NULL AND left_at < ?;", before)
+	if err != nil {
+		return ids, errors.WithStack(err)
+	}
+	defer r.Close()
+	for r.Next() {
+		var id string
+		if err = r.Scan(&id); err != nil {
+			return ids, errors.WithStack(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, errors.WithStack(r.Err())
+}
+
+// GetGuildConfig gets a guild's config
+func (c *Controller) GetGuildConfig(ctx context.Context, guildID string) (*GuildConfig, error) {
+	r, err := c.query(ctx, `
+	SELECT id, contact, enable_embeds, enable_webhooks, COALESCE(prefix, '')
+	FROM guild_config WHERE id = ?;
+	`, guildID)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer r.Close()
+	if !r.Next() {
+		return nil, errors.WithStack(sql.ErrNoRows)
+	}
+
+	var g GuildConfig
+	err = r.Scan(&g.ID, &g.Contact, &g.Embeds, &g.Webhooks, &g.Prefix)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &g, nil
+}
+
+// ModifyGuildContact changes the guild's contact address
+func (c *Controller) ModifyGuildContact(ctx context.Context, guildID string, contact string) error {
+	r, err := c.exec(ctx, "UPDATE guild_config SET contact = ? WHERE id = ?;", contact, guildID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		if n == 0 {
+			return errors.Wrap(sql.ErrNoRows, "no rows on modify guild contact")
+		}
+	}
+	return errors.WithStack(err)
+}
+
+// ModifyGuildEmbeds changes the guild's embed rule
+func (c *Controller) ModifyGuildEmbeds(ctx context.Context, guildID string, embeds bool) error {
+	r, err := c.exec(ctx, "UPDATE guild_config SET enable_embeds = ? WHERE id = ?;", embeds, guildID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		if n == 0 {
+			return errors.Wrap(sql.ErrNoRows, "no rows on modify guild embeds")
+		}
+	}
+	return errors.WithStack(err)
+}
+
+// ModifyGuildWebhooks changes the guild's webhook rule
+func (c *Controller) ModifyGuildWebhooks(ctx context.Context, guildID string, webhooks bool) error {
+	r, err := c.exec(ctx, "UPDATE guild_config SET enable_webhooks = ? WHERE id = ?;", webhooks, guildID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		if n == 0 {
+			return errors.Wrap(sql.ErrNoRows, "no rows on modify guild webhooks")
+		}
+	}
+	return errors.WithStack(err)
+}
+
+// ModifyGuildPrefix changes the guild's command prefix; an empty prefix restores the default
+func (c *Controller) ModifyGuildPrefix(ctx context.Context, guildID string, prefix string) error {
+	var val sql.NullString
+	if prefix != "" {
+		val = sql.NullString{String: prefix, Valid: true}
+	}
+	r, err := c.exec(ctx, "UPDATE guild_config SET prefix = ? WHERE id = ?;", val, guildID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		if n == 0 {
+			return errors.Wrap(sql.ErrNoRows, "no rows on modify guild prefix")
+		}
+	}
+	return errors.WithStack(err)
+}
+
+// DestroyGuildData removes all data assosciated with a guild.
+func (c *Controller) DestroyGuildData(ctx context.Context, guildID string) error {
+	queries := []string{
+		"DELETE FROM subscription_overrides WHERE sub_id IN (SELECT id FROM subscriptions WHERE guild_id = ?);",
+		"DELETE FROM subscriptions WHERE guild_id = ?;",
+		"DELETE FROM feed_credentials WHERE guild_id = ?;",
+		"DELETE FROM guild_config WHERE id = ?;",
+	}
+	return c.transact(ctx, func(t *tx) error {
+		for _, q := range queries {
+			if _, err := t.exec(q, guildID); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+}
+
+// ModifyOverwriteEmbeds changes the embeds policy of a subscription overwrite
+func (c *Controller) ModifyOverwriteEmbeds(ctx context.Context, subID int, embeds sql.NullBool) error {
+	r, err := c.exec(ctx, "UPDATE subscription_overrides SET enable_embeds = ? WHERE sub_id = ?",
+		embeds, subID)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		if n == 0 {
+			return errors.Wrap(sql.ErrNoRows, "no rows on modify override embeds")
+		}
+	}
+	return errors.WithStack(err)
+}
+
+// ModifyOverwriteWebhooks changes the webhooks policy of a subscription overwrite
+func (c *Controller) ModifyOverwriteWebhooks(ctx context.Context, subID int, webhooks sql.NullBool) error {
+	r, err := c.exec(ctx, "UPDATE subscription_overrides SET enable_webhooks = ? WHERE sub_id = ?",
+		webhooks, subID)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		if n == 0 {
+			return errors.Wrap(sql.ErrNoRows, "no rows on modify override embeds")
+		}
+	}
+	return errors.WithStack(err)
+}
+
+// ImportGuild applies every change in imp to a guild in one transaction, so an import
+// which fails part way changes nothing; it returns how many subscriptions were created
+func (c *Controller) ImportGuild(ctx context.Context, guildID string, imp GuildImport) (created int, err error) {
+	err = c.transact(ctx, func(t *tx) error {
+		created = 0
+		if g := imp.Config; g != nil {
+			var prefix sql.NullString
+			if g.Prefix != "" {
+				prefix = sql.NullString{String: g.Prefix, Valid: true}
+			}
+			r, err := t.exec(`
+			UPDATE guild_config SET contact = ?, enable_embeds = ?, enable_webhooks = ?, prefix = ?
+			WHERE id = ?;
+			`, g.Contact, g.Embeds, g.Webhooks, prefix, guildID)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if n, err := r.RowsAffected(); err != nil {
+				return errors.WithStack(err)
+			} else if n == 0 {
+				return errors.Wrap(sql.ErrNoRows, "no rows on import guild config")
+			}
+		}
+
+		for _, s := range imp.Subscriptions {
+			id := s.ID
+			if id == 0 {
+				err := t.queryRow(`
+				INSERT INTO subscriptions (guild_id, channel_id, feed_id)
+				VALUES (?, ?, ?)
+				ON CONFLICT(channel_id, feed_id) DO NOTHING
+				RETURNING id;
+				`, guildID, s.ChannelID, s.FeedID).Scan(&id)
+				if err == sql.ErrNoRows {
+					err = t.queryRow("SELECT id FROM subscriptions WHERE channel_id = ? AND feed_id = ?;",
+						s.ChannelID, s.FeedID).Scan(&id)
+				} else if err == nil {
+					created++
+					_, err = t.exec("INSERT INTO subscription_overrides (sub_id) VALUES (?);", id)
+				}
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+
+			r, err := t.exec(`
+			UPDATE subscription_overrides SET enable_embeds = ?, enable_webhooks = ?
+			WHERE sub_id = ? AND sub_id IN (SELECT id FROM subscriptions WHERE guild_id = ?);
+			`, s.Embeds, s.Webhooks, id, guildID)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if n, err := r.RowsAffected(); err != nil {
+				return errors.WithStack(err)
+			} else if n == 0 {
+				return errors.Wrap(sql.ErrNoRows, "no rows on import subscription overrides")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return created, nil
+}
+
+// GetStats counts the guilds, subscriptions and feeds the bot is serving
+func (c *Controller) GetStats(ctx context.Context) (*Stats, error) {
+	var s Stats
+	err := c.queryRow(ctx, `
+	SELECT
+		(SELECT COUNT(*) FROM guild_config WHERE left_at IS NULL),
+		(SELECT COUNT(*) FROM subscriptions as s
+			LEFT JOIN guild_config as g ON g.id = s.guild_id
+			WHERE g.left_at IS NULL),
+		(SELECT COUNT(*) FROM feeds as f WHERE EXISTS (`+activeSubscriptions+`));
+	`).Scan(&s.Guilds, &s.Subscriptions, &s.ActiveFeeds)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &s, nil
+}
+
+// AcquireLease takes the named lease for holder until ttl after now, or renews it if
+// holder already has it; it reports false while another holder's lease hasn't expired
+func (c *Controller) AcquireLease(ctx context.Context, name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	r, err := c.exec(ctx, `
+	INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+	ON CONFLICT(name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at < ?;
+	`, name, holder, now.Add(ttl), now)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	n, err := r.RowsAffected()
+	return n == 1, errors.WithStack(err)
+}
+
+// ReleaseLease gives up holder's lease early, so that another holder can take it at once
+func (c *Controller) ReleaseLease(ctx context.Context, name, holder string) error {
+	_, err := c.exec(ctx, "DELETE FROM leases WHERE name = ? AND holder = ?;", name, holder)
+	return errors.WithStack(err)
+}
@@ -0,0 +1,124 @@
+package feedbot_test
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxbot/feedbot"
+	"github.com/foxbot/feedbot/storagetest"
+)
+
+// newTestController opens a Controller on an empty database, and migrates it up; the
+// database is migrated back down once the test is done
+func newTestController(t *testing.T, db feedbot.DatabaseConfig) *feedbot.Controller {
+	ctx := context.Background()
+	c, err := feedbot.NewController(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	// the suite leaves rows behind, so never run it against a database in use
+	if v, err := c.SchemaVersion(ctx); err != nil {
+		t.Fatal(err)
+	} else if v != 0 {
+		t.Fatalf("the database is at version %d, the tests need an empty one", v)
+	}
+	if err = c.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := c.MigrateTo(ctx, 0); err != nil {
+			t.Errorf("couldn't migrate back down: %+v", err)
+		}
+	})
+	return c
+}
+
+func TestControllerSQLite(t *testing.T) {
+	db := feedbot.DefaultDatabaseConfig
+	db.DSN = filepath.Join(t.TempDir(), "feedbot.db")
+	storagetest.Run(t, newTestController(t, db))
+}
+
+// TestControllerPostgres runs against the scratch database FEEDBOT_TEST_POSTGRES names, e.g.
+// "postgres://localhost/feedbot_test?sslmode=disable"
+func TestControllerPostgres(t *testing.T) {
+	dsn := os.Getenv("FEEDBOT_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("FEEDBOT_TEST_POSTGRES isn't set")
+	}
+	db := feedbot.DefaultDatabaseConfig
+	db.Driver, db.DSN = "postgres", dsn
+	storagetest.Run(t, newTestController(t, db))
+}
+
+// TestMigrations applies every migration, reverts them all, and applies them again
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	db := feedbot.DefaultDatabaseConfig
+	db.DSN = filepath.Join(t.TempDir(), "feedbot.db")
+	c := newTestController(t, db)
+
+	if err := c.MigrateTo(ctx, 0); err != nil {
+		t.Fatalf("couldn't revert every migration: %+v", err)
+	}
+	if err := c.MigrateUp(ctx); err != nil {
+		t.Fatalf("couldn't reapply every migration: %+v", err)
+	}
+	if err := c.CheckSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMigrateDuplicateSubscriptions upgrades a database from before subscriptions were
+// unique, in which a channel is subscribed to a feed three times
+func TestMigrateDuplicateSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	db := feedbot.DefaultDatabaseConfig
+	db.DSN = filepath.Join(t.TempDir(), "feedbot.db")
+	c, err := feedbot.NewController(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err = c.MigrateTo(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := sql.Open("sqlite3", db.DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	for _, q := range []string{
+		"INSERT INTO feeds (id, uri, last_updated) VALUES (1, 'https://feeds.example.com/duplicate', '2020-01-01 00:00:00');",
+		"INSERT INTO subscriptions (id, guild_id, channel_id, feed_id) VALUES (1, 'guild', 'channel', 1), (2, 'guild', 'channel', 1), (3, 'guild', 'channel', 1);",
+		"INSERT INTO subscription_overrides (sub_id, enable_embeds) VALUES (1, 1), (2, 0), (3, 0);",
+	} {
+		if _, err = raw.ExecContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = c.MigrateUp(ctx); err != nil {
+		t.Fatalf("couldn't migrate up: %+v", err)
+	}
+	var subs, overrides int
+	var embeds bool
+	err = raw.QueryRowContext(ctx, `
+	SELECT (SELECT COUNT(*) FROM subscriptions), (SELECT COUNT(*) FROM subscription_overrides),
+		(SELECT enable_embeds FROM subscription_overrides WHERE sub_id = 1);
+	`).Scan(&subs, &overrides, &embeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subs != 1 || overrides != 1 || !embeds {
+		t.Errorf("%d subscriptions and %d overrides are left, expected the oldest of each", subs, overrides)
+	}
+}
@@ -0,0 +1,90 @@
+package feedbot
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DatabaseConfig contains the location of the database, and how connections to it are made
+type DatabaseConfig struct {
+	// Driver is either "sqlite3" or "postgres"
+	Driver string
+	// DSN is a filename or "file:" DSN for SQLite, or a connection string for Postgres;
+	// for SQLite, parameters given in the DSN take precedence over the settings below
+	DSN string
+	// JournalMode is the SQLite journal_mode; WAL lets readers run alongside a writer
+	JournalMode string
+	// Synchronous is the SQLite synchronous level; NORMAL is durable enough under WAL
+	Synchronous string
+	// BusyTimeout is how long a connection waits on a locked database before failing
+	BusyTimeout time.Duration
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// DefaultDatabaseConfig contains the settings feedbot is run with in production
+var DefaultDatabaseConfig = DatabaseConfig{
+	Driver:       "sqlite3",
+	DSN:          "data.db",
+	JournalMode:  "WAL",
+	Synchronous:  "NORMAL",
+	BusyTimeout:  5 * time.Second,
+	MaxOpenConns: 4,
+	MaxIdleConns: 4,
+}
+
+// RegisterFlags adds flags for the DatabaseConfig to a FlagSet, so every binary which
+// opens the database accepts the same options
+func (c *DatabaseConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Driver, "db-driver", c.Driver, "db-driver=sqlite3 or postgres")
+	fs.StringVar(&c.DSN, "db", c.DSN, "db=path or DSN of the database")
+	fs.StringVar(&c.JournalMode, "db-journal-mode", c.JournalMode, "db-journal-mode=sqlite journal_mode")
+	fs.StringVar(&c.Synchronous, "db-synchronous", c.Synchronous, "db-synchronous=sqlite synchronous level")
+	fs.DurationVar(&c.BusyTimeout, "db-busy-timeout", c.BusyTimeout, "db-busy-timeout=how long to wait on a locked database")
+	fs.IntVar(&c.MaxOpenConns, "db-max-open", c.MaxOpenConns, "db-max-open=maximum open connections, 0 for unlimited")
+	fs.IntVar(&c.MaxIdleConns, "db-max-idle", c.MaxIdleConns, "db-max-idle=maximum idle connections")
+	fs.DurationVar(&c.ConnMaxLifetime, "db-conn-lifetime", c.ConnMaxLifetime, "db-conn-lifetime=maximum lifetime of a connection, 0 for unlimited")
+}
+
+// dsn builds the DSN passed to the driver. For go-sqlite3, pragmas passed this way are
+// applied to every connection in the pool, not just whichever one happens to run a
+// PRAGMA statement.
+func (c *DatabaseConfig) dsn() string {
+	if c.Driver != "sqlite3" {
+		return c.DSN
+	}
+
+	path, query := c.DSN, ""
+	if i := strings.IndexByte(path, '?'); i != -1 {
+		path, query = path[:i], path[i+1:]
+	}
+	if !strings.HasPrefix(path, "file:") {
+		path = "file:" + path
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		params = url.Values{}
+	}
+	setDefault := func(k, v string) {
+		if v != "" && params.Get(k) == "" {
+			params.Set(k, v)
+		}
+	}
+	setDefault("_foreign_keys", "on")
+	setDefault("_journal_mode", c.JournalMode)
+	setDefault("_synchronous", c.Synchronous)
+	if c.BusyTimeout > 0 {
+		setDefault("_busy_timeout", fmt.Sprint(int64(c.BusyTimeout/time.Millisecond)))
+	}
+	// take the write lock when a transaction begins, rather than failing with SQLITE_BUSY
+	// when a reader tries to upgrade partway through
+	setDefault("_txlock", "immediate")
+
+	return path + "?" + params.Encode()
+}
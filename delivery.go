@@ -0,0 +1,144 @@
+package feedbot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/mmcdole/gofeed"
+	"github.com/pkg/errors"
+)
+
+// Delivery posts new feed items to the channels subscribed to them
+type Delivery struct {
+	storage Storage
+	// session finds the session to post to a guild through, that of its shard
+	session func(guildID string) *discordgo.Session
+	log     *slog.Logger
+	metrics *Metrics
+}
+
+// NewDelivery creates a new Delivery, which posts to each guild through the session
+// returned by session
+func NewDelivery(s Storage, session func(guildID string) *discordgo.Session, log *slog.Logger) *Delivery {
+	return &Delivery{
+		storage: s,
+		session: session,
+		log:     log,
+	}
+}
+
+// Deliver posts items, which are ordered most recent first, to each of a feed's
+// subscriptions, oldest first; paused subscriptions are skipped. A channel which fails is
+// logged and skipped, so it can't hold up the rest; once ctx is done, no more messages
+// are sent.
+func (d *Delivery) Deliver(ctx context.Context, feedID int, subs []Subscription, feed *gofeed.Feed, items []*gofeed.Item) error {
+	now := time.Now()
+	guilds := map[string]*GuildConfig{}
+	for _, sub := range subs {
+		log := d.log.With("feed_id", feedID, "sub_id", sub.ID, "guild_id", sub.GuildID, "channel_id", sub.ChannelID)
+		if sub.Paused(now) {
+			log.Debug("skipped paused subscription", "items", len(items))
+			continue
+		}
+		err := d.deliverTo(ctx, sub, feed, items, guilds)
+		if ctx.Err() != nil {
+			return errors.WithStack(ctx.Err())
+		} else if err != nil {
+			log.Warn("couldn't deliver subscription", "err", err)
+			continue
+		}
+		log.Debug("delivered subscription", "items", len(items))
+	}
+	return nil
+}
+
+// deliverTo posts items to one subscription's channel, oldest first, whether or not it is
+// paused; guild configs are cached in guilds
+func (d *Delivery) deliverTo(ctx context.Context, sub Subscription, feed *gofeed.Feed, items []*gofeed.Item, guilds map[string]*GuildConfig) error {
+	embeds, err := d.embeds(ctx, sub, guilds)
+	if err != nil {
+		return err
+	}
+	// webhooks aren't supported yet, every update is posted as the bot
+	for i := len(items) - 1; i >= 0; i-- {
+		if err = ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		err = d.send(d.session(sub.GuildID), sub.ChannelID, feed, items[i], embeds)
+		d.metrics.messageSent(err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// embeds resolves whether a subscription is posted as an embed, from its overwrite or
+// else its guild's config; guild configs are cached in guilds
+func (d *Delivery) embeds(ctx context.Context, sub Subscription, guilds map[string]*GuildConfig) (bool, error) {
+	if sub.Overwrite != nil && sub.Overwrite.Embeds.Valid {
+		return sub.Overwrite.Embeds.Bool, nil
+	}
+	gc, ok := guilds[sub.GuildID]
+	if !ok {
+		var err error
+		gc, err = d.storage.GetGuildConfig(ctx, sub.GuildID)
+		if errors.Cause(err) == sql.ErrNoRows {
+			gc = &GuildConfig{ID: sub.GuildID}
+		} else if err != nil {
+			return false, err
+		}
+		guilds[sub.GuildID] = gc
+	}
+	return gc.Embeds, nil
+}
+
+func (d *Delivery) send(session *discordgo.Session, channelID string, feed *gofeed.Feed, item *gofeed.Item, embeds bool) error {
+	if !embeds {
+		_, err := session.ChannelMessageSend(channelID, messageContent(feed, item))
+		return errors.WithStack(err)
+	}
+
+	embed := &discordgo.MessageEmbed{
+		URL:    item.Link,
+		Title:  truncate(item.Title, maxTitle),
+		Author: &discordgo.MessageEmbedAuthor{Name: truncate(feed.Title, maxTitle)},
+	}
+	if item.PublishedParsed != nil {
+		embed.Timestamp = item.PublishedParsed.Format(time.RFC3339)
+	}
+	_, err := session.ChannelMessageSendEmbed(channelID, embed)
+	return errors.WithStack(err)
+}
+
+const (
+	// maxTitle is the longest feed or item title posted, Discord's limit for embed titles
+	maxTitle = 256
+	// maxMessage is Discord's limit for a message's content
+	maxMessage = 2000
+)
+
+// mentions neutralises everything which would ping in a message, by following its @ with
+// a zero-width space
+var mentions = strings.NewReplacer("@everyone", "@\u200beveryone", "@here", "@\u200bhere", "<@", "<@\u200b")
+
+// messageContent formats an item as a plain message. The feed controls its text, so it is
+// cut to fit Discord's limits, and can't mention anyone in the guilds it is posted to.
+func messageContent(feed *gofeed.Feed, item *gofeed.Item) string {
+	m := fmt.Sprintf("**%s**: %s\n%s", truncate(feed.Title, maxTitle), truncate(item.Title, maxTitle), item.Link)
+	return truncate(mentions.Replace(m), maxMessage)
+}
+
+// truncate shortens s to at most n runes, to fit Discord's limits
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
@@ -0,0 +1,41 @@
+package feedbot
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestMessageContent(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		feed  string
+		item  string
+		link  string
+		pings []string
+	}{
+		{"everyone", "@everyone", "hello @here", "https://feeds.example.com/1", []string{"@everyone", "@here"}},
+		{"users and roles", "<@123>", "<@&456> and <@!789>", "https://feeds.example.com/2", []string{"<@1", "<@&", "<@!"}},
+		{"long titles", strings.Repeat("f", 5000), strings.Repeat("i", 5000), "https://feeds.example.com/3", nil},
+		{"long link", "feed", "item", "https://feeds.example.com/" + strings.Repeat("l", 5000), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := messageContent(&gofeed.Feed{Title: tc.feed}, &gofeed.Item{Title: tc.item, Link: tc.link})
+			if n := utf8.RuneCountInString(m); n > maxMessage {
+				t.Errorf("message is %d characters long", n)
+			}
+			for _, ping := range tc.pings {
+				if strings.Contains(m, ping) {
+					t.Errorf("message %q still contains %q", m, ping)
+				}
+			}
+		})
+	}
+
+	m := messageContent(&gofeed.Feed{Title: "feed"}, &gofeed.Item{Title: "item", Link: "https://mastodon.example.com/@user/1"})
+	if m != "**feed**: item\nhttps://mastodon.example.com/@user/1" {
+		t.Errorf("message is %q, a link with an @ shouldn't be changed", m)
+	}
+}
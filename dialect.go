@@ -0,0 +1,53 @@
+package feedbot
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dialect papers over the differences between the databases feedbot supports; queries
+// are written once, in the subset of SQL that SQLite and Postgres share, with ? placeholders.
+type dialect struct {
+	// name is the directory holding the dialect's migrations
+	name string
+	// numbered is set for databases which expect $1 style placeholders rather than ?
+	numbered bool
+}
+
+var dialects = map[string]dialect{
+	"sqlite3":  {name: "sqlite"},
+	"postgres": {name: "postgres", numbered: true},
+}
+
+func dialectFor(driver string) (dialect, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return dialect{}, errors.Errorf("unsupported database driver %q", driver)
+	}
+	return d, nil
+}
+
+// rebind rewrites the ? placeholders in a query into the dialect's own style
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for {
+		i := strings.IndexByte(query, '?')
+		if i == -1 {
+			break
+		}
+		n++
+		b.WriteString(query[:i])
+		b.WriteString("$")
+		b.WriteString(strconv.Itoa(n))
+		query = query[i+1:]
+	}
+	b.WriteString(query)
+	return b.String()
+}
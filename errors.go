@@ -0,0 +1,66 @@
+package feedbot
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+)
+
+// friendlyError finds the message shown to a user for an error they can do something
+// about; ok is false for anything else, which is reported as an incident
+func friendlyError(err error) (msg string, ok bool) {
+	cause := errors.Cause(err)
+	switch cause {
+	case sql.ErrNoRows:
+		return "could not find that, check the list again?", true
+	case ErrSubExists:
+		return "this subscription already exists, see the list for its ID!", true
+	case context.DeadlineExceeded:
+		return "that took too long, try again in a little while?", true
+	}
+	if rest, ok := cause.(*discordgo.RESTError); ok && rest.Response != nil {
+		switch rest.Response.StatusCode {
+		case http.StatusForbidden:
+			return "feedbot is missing a permission it needs here, see the permissions section of help.", true
+		case http.StatusNotFound:
+			return "that channel or user doesn't exist, or feedbot can't see it.", true
+		}
+	}
+	return "", false
+}
+
+// newIncidentID creates a short ID, which a user can quote to find their error in the logs
+func newIncidentID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// replyError tells the user a command failed; errors which aren't friendly are logged in
+// full under an incident ID, and the user is only told the ID
+func (c *commandContext) replyError(err error) {
+	msg, ok := friendlyError(err)
+	if ok {
+		c.log.Debug("command failed", "err", err)
+	} else {
+		id := newIncidentID()
+		c.log.Error("command failed", "incident", id, "err", err, stackAttr(err))
+		msg = fmt.Sprintf("something went wrong running that command! if it keeps happening, let the bot's owner know the incident ID `%s`.", id)
+	}
+	if err = c.Reply(msg); err != nil {
+		c.log.Warn("couldn't reply to command", "err", err)
+	}
+}
+
+// replyPanic is replyError for a command which panicked
+func (c *commandContext) replyPanic(v interface{}, stack []byte) {
+	c.replyError(errors.Errorf("panic: %v\n%s", v, stack))
+}
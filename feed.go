@@ -1,96 +1,410 @@
-package feedbot
-
-import (
-	"fmt"
-
-	"github.com/mmcdole/gofeed"
-	"github.com/pkg/errors"
-)
-
-// FeedChecker contains the application logic for checking RSS feeds
-type FeedChecker struct {
-	controller *Controller
-}
-
-// NewFeedChecker creates a new FeedChecker
-func NewFeedChecker(c *Controller) (*FeedChecker, error) {
-	return &FeedChecker{
-		controller: c,
-	}, nil
-}
-
-// Close disposes of the FeedChecker
-func (f *FeedChecker) Close() {
-}
-
-// checkOnce will loop over all feeds in the database, ping the remote, and check for
-// updates.
-//
-// for each feed, we:
-// - check the remote
-// - see if any new items have been appended
-// - make a list of new items, dispatch those elsewhere to be handled
-// - update the database with the new most-recent timestamp
-func (f *FeedChecker) checkOnce() []error {
-	feeds, err := f.controller.GetFeeds()
-	if err != nil {
-		return []error{errors.Wrap(err, "couldn't retrieve feeds")}
-	}
-
-	fp := gofeed.NewParser()
-
-	var errs []error
-
-feedsLoop:
-	for _, dbFeed := range feeds {
-		feed, err := fp.ParseURL(dbFeed.URI)
-
-		// don't halt all progress because one feed bounced a 404 back
-		if err != nil {
-			errs = append(errs, err)
-			continue
-		}
-
-		if len(feed.Items) == 0 {
-			continue
-		}
-
-		// use the timestamp of the feed's most recent entry, rather than the feed's updated time.
-		// some generators use the timestamp of compilation to mark the feed, rather than its most
-		// recent post
-
-		recent := feed.Items[0] // TODO: are RSS feeds always sorted with most-recent at the top?
-		if recent.PublishedParsed == nil {
-			err = errors.New(fmt.Sprintf("the feed at %s contained an entry with no timestamp!", dbFeed.URI))
-			errs = append(errs, err)
-			continue
-		}
-
-		minTime := dbFeed.LastUpdated.Unix()
-		if minTime >= recent.PublishedParsed.Unix() {
-			continue
-		}
-
-		var items []*gofeed.Item
-		for _, item := range feed.Items {
-			if item.PublishedParsed == nil {
-				err = errors.New(fmt.Sprintf("the feed at %s contained an entry with no timestamp!", dbFeed.URI))
-				errs = append(errs, err)
-				continue feedsLoop
-			}
-			if minTime >= item.PublishedParsed.Unix() {
-				break
-			}
-			items = append(items, item)
-		}
-
-		// TODO: send these off to Discord
-		fmt.Printf("handled %d new items for feed %s!", len(items), dbFeed.URI)
-
-		if err = f.controller.UpdateFeedTimestamp(&dbFeed, recent.PublishedParsed); err != nil {
-			errs = append(errs, err)
-		}
-	}
-
-	return errs
-}
+package feedbot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/pkg/errors"
+)
+
+// CheckerConfig contains how often, and how many at a time, feeds are polled
+type CheckerConfig struct {
+	// Interval is how often every feed without a WebSub lease is polled
+	Interval time.Duration
+	// Workers is how many feeds are fetched at once
+	Workers int
+}
+
+// DefaultCheckerConfig polls every feed hourly
+var DefaultCheckerConfig = CheckerConfig{
+	Interval: 60 * time.Minute,
+	Workers:  4,
+}
+
+// FeedChecker contains the application logic for checking RSS feeds
+type FeedChecker struct {
+	config   CheckerConfig
+	storage  Storage
+	sources  *Sources
+	vault    *Vault
+	websub   *WebSub
+	delivery *Delivery
+	log      *slog.Logger
+	metrics  *Metrics
+	// leader decides whether this instance checks feeds; nil for a single instance
+	leader *Leader
+
+	// mu serializes finding a feed's new items, so a push and a poll of the same feed
+	// can't both dispatch the same items; it isn't held while they are delivered
+	mu sync.Mutex
+	// lastCheck is when Run started, or last completed a check, in Unix nanoseconds
+	lastCheck atomic.Int64
+}
+
+// NewFeedChecker creates a new FeedChecker; vault may be nil if no feeds require credentials
+func NewFeedChecker(config CheckerConfig, storage Storage, s *Sources, v *Vault, log *slog.Logger) (*FeedChecker, error) {
+	if config.Workers < 1 {
+		return nil, errors.New("the feed checker needs at least one worker")
+	}
+	return &FeedChecker{
+		config:  config,
+		storage: storage,
+		sources: s,
+		vault:   v,
+		log:     log,
+	}, nil
+}
+
+// Run checks feeds every interval until stop is closed; a check which is in progress is
+// finished first, unless ctx is cancelled. Only the leader checks, and it checks as soon
+// as it is elected; a standby has nothing to do, so it counts as having checked.
+func (f *FeedChecker) Run(ctx context.Context, stop <-chan struct{}) {
+	t := time.NewTicker(f.config.Interval)
+	defer t.Stop()
+	elected := f.leader.Elected()
+	f.lastCheck.Store(time.Now().UnixNano())
+
+	for {
+		if f.leader.Leading() {
+			if err := f.checkOnce(ctx); err != nil {
+				f.log.Error("couldn't check feeds", "err", err)
+			} else {
+				f.lastCheck.Store(time.Now().UnixNano())
+			}
+			if f.websub != nil {
+				// renew anything which would otherwise lapse before the next tick
+				f.websub.renew(ctx, 2*f.config.Interval)
+			}
+		} else {
+			f.log.Debug("standing by, another instance is checking feeds")
+			f.lastCheck.Store(time.Now().UnixNano())
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		case <-elected:
+		}
+	}
+}
+
+// LastCheck is when the checker last completed a check of every feed, or when it started
+// running if it hasn't yet; it is zero before Run is called
+func (f *FeedChecker) LastCheck() time.Time {
+	n := f.lastCheck.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// checkOnce will loop over all feeds in the database, ping the remote, and check for
+// updates; feeds are checked by the configured number of workers at once. A feed which
+// fails is logged, and only failing to check at all is returned.
+func (f *FeedChecker) checkOnce(ctx context.Context) error {
+	start := time.Now()
+	feeds, err := f.storage.GetFeeds(ctx)
+	if err != nil {
+		return errors.Wrap(err, "couldn't retrieve feeds")
+	}
+
+	var (
+		mu      sync.Mutex
+		checked int
+		failed  int
+		wg      sync.WaitGroup
+	)
+	jobs := make(chan Feed)
+	for i := 0; i < f.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dbFeed := range jobs {
+				// don't halt all progress because one feed bounced a 404 back
+				err := f.checkFeed(ctx, dbFeed)
+				if err != nil {
+					f.log.Warn("couldn't check feed", "feed_id", dbFeed.ID, "err", err)
+				}
+				mu.Lock()
+				checked++
+				if err != nil {
+					failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	now := time.Now()
+queue:
+	for _, dbFeed := range feeds {
+		// another instance took over, e.g. because our lease couldn't be renewed
+		if !f.leader.Leading() {
+			f.log.Warn("lost leadership, abandoning the check")
+			break queue
+		}
+		// a WebSub hub is pushing updates to us
+		if dbFeed.PushedUntil != nil && dbFeed.PushedUntil.After(now) {
+			continue
+		}
+		select {
+		case jobs <- dbFeed:
+		case <-ctx.Done():
+			err = errors.WithStack(ctx.Err())
+			break queue
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	f.log.Info("checked feeds", "feeds", checked, "failed", failed, "duration", time.Since(start))
+	return err
+}
+
+// checkFeed checks a single feed; for each feed, we:
+// - check the remote
+// - subscribe to its hub, if it advertises one
+// - hand it off to handleFeed
+func (f *FeedChecker) checkFeed(ctx context.Context, dbFeed Feed) error {
+	auth, err := f.auth(dbFeed)
+	if err != nil {
+		return err
+	}
+
+	feed, err := f.fetch(ctx, dbFeed, auth)
+	if err != nil {
+		return err
+	}
+
+	// hubs can't authenticate to private feeds, so those are always polled
+	if f.websub != nil && auth == nil {
+		if err = f.websub.discover(ctx, &dbFeed, feed); err != nil {
+			// the feed can still be polled, so carry on
+			f.log.Warn("couldn't subscribe to the feed's hub", "feed_id", dbFeed.ID, "err", err)
+		}
+	}
+
+	return f.handleFeed(ctx, dbFeed.ID, feed)
+}
+
+// auth opens a feed's credentials, if it has any
+func (f *FeedChecker) auth(dbFeed Feed) (*FeedAuth, error) {
+	if dbFeed.Credentials == nil {
+		return nil, nil
+	}
+	if f.vault == nil {
+		return nil, errors.Errorf("the feed at %s has credentials, but no secret key is configured", dbFeed.URI)
+	}
+	return f.vault.Open(dbFeed.Credentials)
+}
+
+// fetch fetches a feed from its source
+func (f *FeedChecker) fetch(ctx context.Context, dbFeed Feed, auth *FeedAuth) (*gofeed.Feed, error) {
+	src, err := f.sources.Open(dbFeed.URI, auth)
+	if err != nil {
+		return nil, err
+	}
+	kind, _ := SourceKind(dbFeed.URI)
+	start := time.Now()
+	feed, err := src.Fetch(ctx)
+	f.metrics.feedChecked(kind, time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	f.log.Debug("fetched feed", "feed_id", dbFeed.ID, "items", len(feed.Items))
+	return feed, nil
+}
+
+// handleFeed finds the items of a feed that are newer than the last time we saw it,
+// whether the feed was polled or pushed to us.
+//
+// for each feed, we:
+// - see if any new items have been appended
+// - make a list of new items, and update the database with the new most-recent timestamp
+// - dispatch the new items elsewhere to be handled
+func (f *FeedChecker) handleFeed(ctx context.Context, feedID int, feed *gofeed.Feed) error {
+	items, subs, err := f.newItems(ctx, feedID, feed)
+	if err != nil || len(items) == 0 {
+		return err
+	}
+
+	f.metrics.foundItems(len(items))
+	if f.delivery != nil {
+		// posted outside the lock, so a slow channel doesn't hold up every other feed's checks
+		if err = f.delivery.Deliver(ctx, feedID, subs, feed, items); err != nil {
+			f.log.Error("couldn't deliver feed", "feed_id", feedID, "err", err)
+		}
+	}
+	return nil
+}
+
+// newItems finds a feed's new items under the lock, and records them as seen before they
+// are delivered, since a partial delivery is better than posting the same items twice. The
+// feed's subscriptions are read under the lock too, so an item is delivered to a
+// subscription being resumed either here or by Resume, and never both.
+func (f *FeedChecker) newItems(ctx context.Context, feedID int, feed *gofeed.Feed) (items []*gofeed.Item, subs []Subscription, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(feed.Items) == 0 {
+		return nil, nil, nil
+	}
+
+	// read the feed's timestamp under the lock, another push or poll may have moved it
+	dbFeed, err := f.storage.GetFeed(ctx, feedID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// use the timestamp of the feed's most recent entry, rather than the feed's updated time.
+	// some generators use the timestamp of compilation to mark the feed, rather than its most
+	// recent post
+
+	recent := feed.Items[0] // TODO: are RSS feeds always sorted with most-recent at the top?
+	if recent.PublishedParsed == nil {
+		return nil, nil, errors.New(fmt.Sprintf("the feed at %s contained an entry with no timestamp!", dbFeed.URI))
+	}
+
+	minTime := dbFeed.LastUpdated.Unix()
+	if minTime >= recent.PublishedParsed.Unix() {
+		return nil, nil, nil
+	}
+
+	for _, item := range feed.Items {
+		if item.PublishedParsed == nil {
+			return nil, nil, errors.New(fmt.Sprintf("the feed at %s contained an entry with no timestamp!", dbFeed.URI))
+		}
+		if minTime >= item.PublishedParsed.Unix() {
+			break
+		}
+		items = append(items, item)
+	}
+
+	if f.delivery != nil {
+		if subs, err = f.storage.GetFeedSubscriptions(ctx, feedID); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = f.storage.UpdateFeedTimestamp(ctx, dbFeed, recent.PublishedParsed); err != nil {
+		return nil, nil, err
+	}
+	return items, subs, nil
+}
+
+// maxBackfill is the most missed items posted when a subscription is resumed
+const maxBackfill = 10
+
+// ErrNotPaused is returned when resuming a subscription which isn't paused, including one
+// whose timed pause has already ended
+var ErrNotPaused = errors.New("the subscription isn't paused")
+
+// Resume resumes a paused subscription. With backfill, the items it missed while paused
+// are posted, the most recent maxBackfill of those the feed still lists; missed counts
+// every missed item the feed lists, posted or not. A subscription whose timed pause has
+// ended is already resumed, so ErrNotPaused is returned and nothing is posted.
+func (f *FeedChecker) Resume(ctx context.Context, sub *Subscription, backfill bool) (posted, missed int, err error) {
+	if !sub.Paused(time.Now()) {
+		return 0, 0, ErrNotPaused
+	}
+	var feed *gofeed.Feed
+	if backfill {
+		dbFeed, err := f.storage.GetFeed(ctx, sub.FeedID)
+		if err != nil {
+			return 0, 0, err
+		}
+		// GetFeed leaves out credentials, only checks need them
+		fc, err := f.storage.GetFeedCredentials(ctx, sub.FeedID)
+		if err != nil {
+			return 0, 0, err
+		}
+		if fc != nil {
+			dbFeed.Credentials = fc.Data
+		}
+		auth, err := f.auth(*dbFeed)
+		if err != nil {
+			return 0, 0, err
+		}
+		if feed, err = f.fetch(ctx, *dbFeed, auth); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	items, missed, resumed, err := f.resume(ctx, sub.ID, feed)
+	if err != nil || len(items) == 0 || f.delivery == nil {
+		return 0, missed, err
+	}
+	// posted outside the lock, so a slow channel doesn't hold up every other feed's checks
+	err = f.delivery.deliverTo(ctx, *resumed, feed, items, map[string]*GuildConfig{})
+	return len(items), missed, err
+}
+
+// resume resumes a subscription under the lock, so every item is either missed, or
+// delivered by handleFeed once the subscription is resumed, and never both. The items it
+// missed which feed lists are returned for backfill, along with the subscription and its
+// overwrites as they were before it was resumed.
+func (f *FeedChecker) resume(ctx context.Context, subID int, feed *gofeed.Feed) (items []*gofeed.Item, missed int, sub *Subscription, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// read the subscription again, it may have been resumed, or its pause may have ended,
+	// while the feed was fetched
+	sub, err = f.subscription(ctx, subID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if sub == nil || !sub.Paused(time.Now()) {
+		return nil, 0, nil, ErrNotPaused
+	}
+	dbFeed, err := f.storage.GetFeed(ctx, sub.FeedID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if err = f.storage.ResumeSubscription(ctx, sub.ID); err != nil {
+		return nil, 0, nil, err
+	}
+	if feed == nil {
+		return nil, 0, sub, nil
+	}
+
+	for _, item := range feed.Items {
+		if item.PublishedParsed == nil {
+			continue
+		}
+		if t := item.PublishedParsed.Unix(); t > sub.Pause.Seen.Unix() && t <= dbFeed.LastUpdated.Unix() {
+			items = append(items, item)
+		}
+	}
+	missed = len(items)
+	if len(items) > maxBackfill {
+		// items are most recent first
+		items = items[:maxBackfill]
+	}
+	return items, missed, sub, nil
+}
+
+// subscription finds a subscription with its overwrites, or nil if it doesn't exist
+func (f *FeedChecker) subscription(ctx context.Context, subID int) (*Subscription, error) {
+	sub, err := f.storage.GetSubscription(ctx, subID)
+	if errors.Cause(err) == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	subs, err := f.storage.GetFeedSubscriptions(ctx, sub.FeedID)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range subs {
+		if s.ID == subID {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,109 @@
+package feedbot
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/pkg/errors"
+)
+
+func TestResumeEndedPause(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	f, err := NewFeedChecker(DefaultCheckerConfig, storage, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, err := storage.GetOrCreateFeed(ctx, "https://feeds.example.com/paused", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := storage.AddSubscription(ctx, "channel", "guild", feed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a timed pause which has ended is already resumed, so nothing is fetched or posted
+	now := time.Now()
+	until := now.Add(-time.Minute)
+	if err = storage.PauseSubscription(ctx, sub.ID, Pause{At: now.Add(-time.Hour), Until: &until}); err != nil {
+		t.Fatal(err)
+	}
+	if sub, err = storage.GetSubscription(ctx, sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = f.Resume(ctx, sub, true); errors.Cause(err) != ErrNotPaused {
+		t.Errorf("resuming an ended pause returned %v", err)
+	}
+
+	// a subscription resumed since it was looked up isn't resumed again
+	if err = storage.PauseSubscription(ctx, sub.ID, Pause{At: now}); err != nil {
+		t.Fatal(err)
+	}
+	if sub, err = storage.GetSubscription(ctx, sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = f.Resume(ctx, sub, false); err != nil {
+		t.Fatalf("couldn't resume: %v", err)
+	}
+	if _, _, err = f.Resume(ctx, sub, false); errors.Cause(err) != ErrNotPaused {
+		t.Errorf("resuming twice returned %v", err)
+	}
+	resumed, err := storage.GetSubscription(ctx, sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Pause != nil {
+		t.Errorf("resumed subscription is paused: %+v", resumed.Pause)
+	}
+}
+
+func TestNewItems(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	f, err := NewFeedChecker(DefaultCheckerConfig, storage, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.delivery = &Delivery{}
+	dbFeed, err := storage.GetOrCreateFeed(ctx, "https://feeds.example.com/new", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.AddSubscription(ctx, "channel", "guild", dbFeed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	item := func(title string, published time.Time) *gofeed.Item {
+		return &gofeed.Item{Title: title, PublishedParsed: &published}
+	}
+	now := time.Now().Truncate(time.Second)
+	feed := &gofeed.Feed{Items: []*gofeed.Item{item("b", now), item("a", now.Add(-time.Hour))}}
+
+	items, subs, err := f.newItems(ctx, dbFeed.ID, feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || len(subs) != 1 {
+		t.Fatalf("found %d items for %d subscriptions, expected 2 for 1", len(items), len(subs))
+	}
+	// the items are recorded as seen before they are delivered
+	if dbFeed, err = storage.GetFeed(ctx, dbFeed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !dbFeed.LastUpdated.Equal(now) {
+		t.Errorf("feed was last updated %v, expected %v", dbFeed.LastUpdated, now)
+	}
+
+	feed.Items = append([]*gofeed.Item{item("c", now.Add(time.Minute))}, feed.Items...)
+	if items, _, err = f.newItems(ctx, dbFeed.ID, feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Title != "c" {
+		t.Errorf("found %d new items, expected only c", len(items))
+	}
+}
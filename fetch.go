@@ -0,0 +1,366 @@
+package feedbot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/pkg/errors"
+)
+
+// FetcherConfig contains the safety limits applied when fetching remote feeds
+type FetcherConfig struct {
+	// Timeout bounds an entire request, including redirects and reading the body
+	Timeout time.Duration
+	// MaxSize is the largest response body, in bytes, that will be read
+	MaxSize int64
+	// MaxRedirects is the number of redirects that will be followed
+	MaxRedirects int
+	// UserAgent is sent with every request
+	UserAgent string
+	// Allow lists networks which are exempt from the private address block
+	Allow []*net.IPNet
+}
+
+// DefaultFetcherConfig contains sane limits for fetching feeds off the public internet
+var DefaultFetcherConfig = FetcherConfig{
+	Timeout:      30 * time.Second,
+	MaxSize:      10 << 20,
+	MaxRedirects: 5,
+	UserAgent:    "feedbot (https://github.com/foxbot/feedbot)",
+}
+
+var (
+	// ErrSchemeNotAllowed is returned when a feed URI is not http or https
+	ErrSchemeNotAllowed = errors.New("only http and https feeds are allowed")
+	// ErrAddressBlocked is returned when a feed resolves to a private or reserved address
+	ErrAddressBlocked = errors.New("feed resolves to a blocked address")
+	// ErrTooManyRedirects is returned when a feed redirects more than the configured limit
+	ErrTooManyRedirects = errors.New("feed redirected too many times")
+	// ErrResponseTooLarge is returned when a feed's body exceeds the configured limit
+	ErrResponseTooLarge = errors.New("feed response is too large")
+)
+
+// blockedNetworks are ranges which are never fetched from unless explicitly allowed;
+// loopback, private, link-local (including cloud metadata endpoints) and reserved space,
+// along with the IPv6 transition prefixes which can wrap any IPv4 address.
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	// Teredo and 6to4
+	"2001::/32",
+	"2002::/16",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// Fetcher is an HTTP client for retrieving untrusted feed URIs
+type Fetcher struct {
+	client  *http.Client
+	config  FetcherConfig
+	metrics *Metrics
+}
+
+// NewFetcher creates a new Fetcher with the given limits
+func NewFetcher(config FetcherConfig) *Fetcher {
+	f := &Fetcher{
+		config: config,
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		// Control runs after DNS resolution, for every address we attempt to connect to,
+		// so a hostname can't be pointed at an internal address to sneak past the check.
+		Control: f.checkDial,
+	}
+	transport := &http.Transport{
+		// never use an environment proxy; the dial check would only see the proxy's address
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          16,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	f.client = &http.Client{
+		Transport:     transport,
+		Timeout:       config.Timeout,
+		CheckRedirect: f.checkRedirect,
+	}
+
+	return f
+}
+
+// ValidateURI checks that a feed URI uses a scheme the Fetcher is willing to request
+func ValidateURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrSchemeNotAllowed
+	}
+	if u.Host == "" {
+		return errors.New("feed uri is missing a host")
+	}
+	return nil
+}
+
+// Feed fetches and parses the feed at the given URI; auth may be nil. Any WebSub hub the
+// feed advertises, in its body or its Link header, is recorded in the feed's Custom fields.
+func (f *Fetcher) Feed(ctx context.Context, uri string, auth *FeedAuth) (*gofeed.Feed, error) {
+	resp, err := f.get(ctx, uri, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read %s", uri)
+	}
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse feed at %s", uri)
+	}
+
+	hub, self := discoverHub(resp.Header, body)
+	if hub != "" {
+		if feed.Custom == nil {
+			feed.Custom = map[string]string{}
+		}
+		feed.Custom[customHub] = hub
+		feed.Custom[customSelf] = self
+	}
+	return feed, nil
+}
+
+// Get requests the given URI, returning its body; the body will return ErrResponseTooLarge
+// if it is read past the configured limit. auth may be nil.
+func (f *Fetcher) Get(ctx context.Context, uri string, auth *FeedAuth) (io.ReadCloser, error) {
+	resp, err := f.get(ctx, uri, auth)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (f *Fetcher) get(ctx context.Context, uri string, auth *FeedAuth) (*http.Response, error) {
+	if err := ValidateURI(uri); err != nil {
+		return nil, err
+	}
+
+	if auth != nil {
+		// checkRedirect needs the credentials to take them off redirects
+		ctx = context.WithValue(ctx, feedAuthKey{}, auth)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if auth != nil {
+		auth.apply(req)
+	}
+	return f.do(req)
+}
+
+// PostForm posts a form to the given URI, such as a WebSub hub, discarding the response
+func (f *Fetcher) PostForm(ctx context.Context, uri string, form url.Values) error {
+	if err := ValidateURI(uri); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := f.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do sends a request, failing on any non-2xx response
+func (f *Fetcher) do(req *http.Request) (*http.Response, error) {
+	uri := redactURI(req.URL.String())
+	req.Header.Set("User-Agent", f.config.UserAgent)
+
+	resp, err := f.client.Do(req)
+	if resp != nil {
+		f.metrics.httpResponse(resp.StatusCode)
+	}
+	if err != nil {
+		// the request URL may carry a secret query parameter, keep it out of the logs
+		if ue, ok := err.(*url.Error); ok {
+			ue.URL = redactURI(ue.URL)
+		}
+		return nil, errors.Wrapf(err, "couldn't fetch %s", uri)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, errors.WithStack(&statusError{uri: uri, status: resp.Status})
+	}
+	if resp.ContentLength > f.config.MaxSize {
+		resp.Body.Close()
+		return nil, ErrResponseTooLarge
+	}
+
+	resp.Body = &limitedBody{
+		ReadCloser: resp.Body,
+		remaining:  f.config.MaxSize,
+	}
+	return resp, nil
+}
+
+// feedAuthKey holds the FeedAuth a request was made with in its context
+type feedAuthKey struct{}
+
+// statusError is returned for a response which wasn't a 2xx
+type statusError struct {
+	uri    string
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("couldn't fetch %s: %s", e.uri, e.status)
+}
+
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.config.MaxRedirects {
+		return ErrTooManyRedirects
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return ErrSchemeNotAllowed
+	}
+	// credentials are only for the feed's own host; Go carries custom headers to any
+	// host, and Authorization to any subdomain
+	if auth, ok := req.Context().Value(feedAuthKey{}).(*FeedAuth); ok && req.URL.Host != via[0].URL.Host {
+		auth.strip(req)
+	}
+	return nil
+}
+
+func (f *Fetcher) checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("dialed a non-ip address %s", address)
+	}
+	if !f.allowed(ip) {
+		return errors.Wrap(ErrAddressBlocked, ip.String())
+	}
+	return nil
+}
+
+func (f *Fetcher) allowed(ip net.IP) bool {
+	for _, n := range f.config.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// limitedBody errors once more than remaining bytes are read, rather than silently
+// truncating; a truncated feed would otherwise surface as a confusing parse error.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, ErrResponseTooLarge
+	}
+	return n, err
+}
+
+// ParseCIDRs parses a list of networks in CIDR notation; bare addresses are treated as
+// a network containing just that address.
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(list ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(list)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
@@ -0,0 +1,221 @@
+package feedbot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const testFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>test</title>
+<item><title>hello</title><link>https://feeds.example.com/hello</link></item>
+</channel></rss>`
+
+// newLoopbackFetcher creates a Fetcher which may fetch from the httptest servers on loopback
+func newLoopbackFetcher(t *testing.T, config FetcherConfig) *Fetcher {
+	loopback, err := ParseCIDRs([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Allow = loopback
+	return NewFetcher(config)
+}
+
+func TestFetcherBlockedAddresses(t *testing.T) {
+	f := NewFetcher(DefaultFetcherConfig)
+	for _, tc := range []struct {
+		ip      string
+		allowed bool
+	}{
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		// 6to4 and Teredo can wrap private IPv4 addresses
+		{"2002:7f00:1::1", false},
+		{"2002:a9fe:a9fe::1", false},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", false},
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2606:4700::6810:84e5", true},
+		{"2001:4860:4860::8888", true},
+	} {
+		if got := f.allowed(net.ParseIP(tc.ip)); got != tc.allowed {
+			t.Errorf("%s allowed is %v, expected %v", tc.ip, got, tc.allowed)
+		}
+	}
+
+	f = newLoopbackFetcher(t, DefaultFetcherConfig)
+	if !f.allowed(net.ParseIP("127.0.0.1")) || f.allowed(net.ParseIP("10.0.0.1")) {
+		t.Error("the allow list should exempt loopback, and nothing else")
+	}
+}
+
+func TestFetcherDialsBlockedAddresses(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, testFeed)
+	}))
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+
+	f := NewFetcher(DefaultFetcherConfig)
+	// a hostname is checked once it has been resolved
+	for _, uri := range []string{s.URL, "http://localhost:" + port} {
+		if _, err := f.Feed(context.Background(), uri, nil); !errors.Is(err, ErrAddressBlocked) {
+			t.Errorf("fetching %s returned %v, expected it to be blocked", uri, err)
+		}
+	}
+
+	feed, err := newLoopbackFetcher(t, DefaultFetcherConfig).Feed(context.Background(), s.URL, nil)
+	if err != nil {
+		t.Fatalf("couldn't fetch from an allowed address: %v", err)
+	}
+	if len(feed.Items) != 1 {
+		t.Errorf("feed has %d items", len(feed.Items))
+	}
+}
+
+func TestFetcherRedirects(t *testing.T) {
+	// /n redirects n more times before serving the feed
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file" {
+			http.Redirect(rw, r, "file:///etc/passwd", http.StatusFound)
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if n > 0 {
+			http.Redirect(rw, r, fmt.Sprintf("/%d", n-1), http.StatusFound)
+			return
+		}
+		io.WriteString(rw, testFeed)
+	}))
+	defer s.Close()
+
+	config := DefaultFetcherConfig
+	config.MaxRedirects = 3
+	f := newLoopbackFetcher(t, config)
+	ctx := context.Background()
+	if _, err := f.Feed(ctx, s.URL+"/3", nil); err != nil {
+		t.Errorf("couldn't follow 3 redirects: %v", err)
+	}
+	if _, err := f.Feed(ctx, s.URL+"/4", nil); !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("following 4 redirects returned %v", err)
+	}
+	if _, err := f.Feed(ctx, s.URL+"/file", nil); !errors.Is(err, ErrSchemeNotAllowed) {
+		t.Errorf("following a redirect to a file returned %v", err)
+	}
+	if _, err := f.Feed(ctx, "file:///etc/passwd", nil); !errors.Is(err, ErrSchemeNotAllowed) {
+		t.Errorf("fetching a file returned %v", err)
+	}
+}
+
+func TestFetcherRedirectCredentials(t *testing.T) {
+	// other records the credentials it is sent
+	var got http.Header
+	var query string
+	other := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got, query = r.Header.Clone(), r.URL.RawQuery
+		io.WriteString(rw, testFeed)
+	}))
+	defer other.Close()
+	// the feed's host sends /same back to itself, and everything else to other, passing
+	// the query along
+	var feedGot http.Header
+	var feedQuery string
+	feed := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/done" {
+			feedGot, feedQuery = r.Header.Clone(), r.URL.RawQuery
+			io.WriteString(rw, testFeed)
+			return
+		}
+		target := other.URL + "/feed"
+		if r.URL.Path == "/same" {
+			target = "/done"
+		}
+		http.Redirect(rw, r, target+"?"+r.URL.RawQuery, http.StatusFound)
+	}))
+	defer feed.Close()
+
+	auth := &FeedAuth{
+		Username: "user",
+		Password: "password",
+		Headers:  map[string]string{"X-Api-Key": "key"},
+		Query:    map[string]string{"token": "secret"},
+	}
+	f := newLoopbackFetcher(t, DefaultFetcherConfig)
+	ctx := context.Background()
+
+	if _, err := f.Feed(ctx, feed.URL+"/same?page=1", auth); err != nil {
+		t.Fatal(err)
+	}
+	if feedGot.Get("Authorization") == "" || feedGot.Get("X-Api-Key") != "key" || !strings.Contains(feedQuery, "token=secret") {
+		t.Errorf("a redirect to the feed's own host lost its credentials: %v, query %q", feedGot, feedQuery)
+	}
+
+	if _, err := f.Feed(ctx, feed.URL+"/elsewhere?page=1", auth); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("Authorization") != "" || got.Get("X-Api-Key") != "" || strings.Contains(query, "secret") {
+		t.Errorf("a redirect to another host was sent credentials: %v, query %q", got, query)
+	}
+	if query != "page=1" {
+		t.Errorf("a redirect to another host lost the rest of its query: %q", query)
+	}
+}
+
+func TestFetcherMaxSize(t *testing.T) {
+	body := strings.Repeat("x", 2048)
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// without a Content-Length, the limit is only found by reading
+			rw.(http.Flusher).Flush()
+		}
+		io.WriteString(rw, body)
+	}))
+	defer s.Close()
+
+	config := DefaultFetcherConfig
+	config.MaxSize = 1024
+	f := newLoopbackFetcher(t, config)
+	ctx := context.Background()
+	if _, err := f.Get(ctx, s.URL+"/sized", nil); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("fetching an oversized response returned %v", err)
+	}
+
+	r, err := f.Get(ctx, s.URL+"/chunked", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err = io.ReadAll(r); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("reading an oversized chunked response returned %v", err)
+	}
+
+	config.MaxSize = int64(len(body))
+	r, err = newLoopbackFetcher(t, config).Get(ctx, s.URL+"/chunked", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if b, err := io.ReadAll(r); err != nil || len(b) != len(body) {
+		t.Errorf("reading a response of exactly the limit returned %d bytes, %v", len(b), err)
+	}
+}
@@ -0,0 +1,123 @@
+package feedbot
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// jsonStep is a single step of a JSONPath expression
+type jsonStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses the subset of JSONPath feedbot understands: a root of `$` (or `@`),
+// children by `.name` or `['name']`, array indices by `[n]`, and wildcards by `.*` or `[*]`.
+// A bare expression such as `author.name` is read as relative to the root.
+func parseJSONPath(path string) ([]jsonStep, error) {
+	p := strings.TrimSpace(path)
+	if strings.HasPrefix(p, "$") || strings.HasPrefix(p, "@") {
+		p = p[1:]
+	} else if p != "" {
+		p = "." + p
+	}
+
+	var steps []jsonStep
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end == -1 {
+				end = len(p)
+			}
+			name := p[:end]
+			p = p[end:]
+			if name == "" {
+				return nil, errors.Errorf("empty name in %q", path)
+			}
+			if name == "*" {
+				steps = append(steps, jsonStep{wildcard: true})
+			} else {
+				steps = append(steps, jsonStep{key: name})
+			}
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end == -1 {
+				return nil, errors.Errorf("unclosed bracket in %q", path)
+			}
+			inner := p[1:end]
+			p = p[end+1:]
+			if inner == "*" {
+				steps = append(steps, jsonStep{wildcard: true})
+			} else if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, jsonStep{key: inner[1 : len(inner)-1]})
+			} else if i, err := strconv.Atoi(inner); err == nil {
+				steps = append(steps, jsonStep{index: i, isIndex: true})
+			} else {
+				return nil, errors.Errorf("invalid subscript [%s] in %q", inner, path)
+			}
+		default:
+			return nil, errors.Errorf("unexpected %q in %q", p[0], path)
+		}
+	}
+	return steps, nil
+}
+
+// evalJSONPath returns every value in v matched by the given steps
+func evalJSONPath(v interface{}, steps []jsonStep) []interface{} {
+	values := []interface{}{v}
+	for _, s := range steps {
+		var next []interface{}
+		for _, v := range values {
+			next = append(next, s.apply(v)...)
+		}
+		values = next
+	}
+	return values
+}
+
+func (s jsonStep) apply(v interface{}) []interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if s.wildcard {
+			// keep wildcard matches over objects stable between fetches
+			keys := make([]string, 0, len(t))
+			for k := range t {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			values := make([]interface{}, 0, len(t))
+			for _, k := range keys {
+				values = append(values, t[k])
+			}
+			return values
+		}
+		if s.isIndex {
+			return nil
+		}
+		if child, ok := t[s.key]; ok {
+			return []interface{}{child}
+		}
+	case []interface{}:
+		if s.wildcard {
+			return t
+		}
+		if !s.isIndex {
+			return nil
+		}
+		i := s.index
+		if i < 0 {
+			i += len(t)
+		}
+		if i >= 0 && i < len(t) {
+			return []interface{}{t[i]}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package feedbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	key := func(k string) jsonStep { return jsonStep{key: k} }
+	index := func(i int) jsonStep { return jsonStep{index: i, isIndex: true} }
+	wildcard := jsonStep{wildcard: true}
+
+	for _, tc := range []struct {
+		path  string
+		steps []jsonStep
+	}{
+		{"$", nil},
+		{"", nil},
+		{"$.a.b", []jsonStep{key("a"), key("b")}},
+		{"@.a", []jsonStep{key("a")}},
+		// a bare expression is relative to the root
+		{"author.name", []jsonStep{key("author"), key("name")}},
+		{" $.a ", []jsonStep{key("a")}},
+		{"$['a b'][\"c.d\"]", []jsonStep{key("a b"), key("c.d")}},
+		{"$['']", []jsonStep{key("")}},
+		{"$.items[0].tags[-1]", []jsonStep{key("items"), index(0), key("tags"), index(-1)}},
+		{"$[*]", []jsonStep{wildcard}},
+		{"$.*.name", []jsonStep{wildcard, key("name")}},
+		{"$.data[*]['*']", []jsonStep{key("data"), wildcard, key("*")}},
+	} {
+		steps, err := parseJSONPath(tc.path)
+		if err != nil {
+			t.Errorf("couldn't parse %q: %v", tc.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(steps, tc.steps) {
+			t.Errorf("%q parsed as %+v, expected %+v", tc.path, steps, tc.steps)
+		}
+	}
+
+	for _, path := range []string{
+		"$.",
+		"$..a",
+		"$.a.",
+		"$[0",
+		"$[]",
+		"$[a]",
+		"$['a]",
+		"$['a\"]",
+		"$[1.5]",
+		"$a",
+		"$.a b[0]x",
+	} {
+		if steps, err := parseJSONPath(path); err == nil {
+			t.Errorf("%q parsed as %+v, expected an error", path, steps)
+		}
+	}
+}
+
+func TestEvalJSONPath(t *testing.T) {
+	const doc = `{
+		"title": "root",
+		"odd key": {"x": 1},
+		"list": [{"name": "first"}, {"name": "second"}, {"other": true}],
+		"obj": {"b": 2, "c": 3, "a": 1},
+		"nested": {"a": {"b": "deep"}}
+	}`
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"$.title", "[root]"},
+		{"$.nested.a.b", "[deep]"},
+		{"$['odd key'].x", "[1]"},
+		{"$.list[0].name", "[first]"},
+		{"$.list[-1].other", "[true]"},
+		{"$.list[-3].name", "[first]"},
+		{"$.list[3]", "[]"},
+		{"$.list[-4]", "[]"},
+		// fields missing from some items are skipped
+		{"$.list[*].name", "[first second]"},
+		// wildcards over objects are in key order, so they are stable between fetches
+		{"$.obj.*", "[1 2 3]"},
+		{"$.obj[*]", "[1 2 3]"},
+		{"$.missing", "[]"},
+		{"$.missing.deeper", "[]"},
+		// an index into an object, or a key into an array, matches nothing
+		{"$.obj[0]", "[]"},
+		{"$.list.name", "[]"},
+		{"$.title.length", "[]"},
+	} {
+		steps, err := parseJSONPath(tc.path)
+		if err != nil {
+			t.Fatalf("couldn't parse %q: %v", tc.path, err)
+		}
+		if got := fmt.Sprint(evalJSONPath(v, steps)); got != tc.want {
+			t.Errorf("%s matched %s, expected %s", tc.path, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package feedbot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkerLease is the name of the lease held by the instance which checks feeds
+const checkerLease = "checker"
+
+// shardLease is the name of the lease held by the instance which answers a shard's commands
+func shardLease(id, count int) string {
+	return fmt.Sprintf("shard %d/%d", id, count)
+}
+
+// Leader elects one of several instances sharing a database to hold a lease, such as to
+// check feeds and purge old data, which the leader keeps renewing. The others stand by,
+// trying to take the lease, and one takes over once it expires.
+//
+// A nil *Leader is a single instance, which always leads.
+type Leader struct {
+	storage Storage
+	lease   string
+	holder  string
+	ttl     time.Duration
+	log     *slog.Logger
+
+	// turn serializes campaigning and resigning, so a renewal can't follow a release
+	turn     sync.Mutex
+	resigned bool
+
+	mu sync.Mutex
+	// until is when the lease this instance holds expires; zero while standing by
+	until time.Time
+	// elected are signalled when this instance becomes the leader, one for each caller of
+	// Elected
+	elected []chan struct{}
+}
+
+// NewLeader creates a Leader for the named lease, which it holds for ttl at a time
+func NewLeader(storage Storage, lease string, ttl time.Duration, log *slog.Logger) *Leader {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	holder := fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(b))
+	return &Leader{
+		storage: storage,
+		lease:   lease,
+		holder:  holder,
+		ttl:     ttl,
+		log:     log.With("lease", lease, "holder", holder),
+	}
+}
+
+// Run tries to take or renew the lease three times per ttl, until ctx is cancelled or
+// the leader resigns. The lease is kept while shutting down, until in-flight work has
+// finished, so nobody takes over part way through a check or command.
+func (l *Leader) Run(ctx context.Context) {
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+
+	for {
+		if !l.campaign(ctx) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// campaign tries to take or renew the lease; it reports false once the leader resigned
+func (l *Leader) campaign(ctx context.Context) bool {
+	l.turn.Lock()
+	defer l.turn.Unlock()
+	if l.resigned {
+		return false
+	}
+
+	// the lease is compared across instances, so its times must share a zone
+	now := time.Now().UTC()
+	ok, err := l.storage.AcquireLease(ctx, l.lease, l.holder, now, l.ttl)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	wasLeading := now.Before(l.until)
+	switch {
+	case err != nil:
+		// we may still lead until the lease we last renewed expires
+		l.log.Warn("couldn't renew the lease", "err", err)
+	case ok:
+		l.until = now.Add(l.ttl)
+		if !wasLeading {
+			l.log.Info("took the lease")
+			for _, c := range l.elected {
+				select {
+				case c <- struct{}{}:
+				default:
+				}
+			}
+		}
+	default:
+		l.until = time.Time{}
+		if wasLeading {
+			l.log.Warn("lost the lease, standing by")
+		}
+	}
+	return true
+}
+
+// resign stops campaigning, and releases the lease if this instance holds it, so a
+// standby can take over without waiting for it to expire
+func (l *Leader) resign(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	l.turn.Lock()
+	defer l.turn.Unlock()
+	l.resigned = true
+
+	l.mu.Lock()
+	leading := time.Now().Before(l.until)
+	l.until = time.Time{}
+	l.mu.Unlock()
+	if !leading {
+		return
+	}
+	if err := l.storage.ReleaseLease(ctx, l.lease, l.holder); err != nil {
+		l.log.Warn("couldn't release the lease", "err", err)
+		return
+	}
+	l.log.Info("released the lease")
+}
+
+// Leading reports whether this instance holds an unexpired lease
+func (l *Leader) Leading() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Now().Before(l.until)
+}
+
+// Elected returns a channel which is signalled each time this instance becomes the
+// leader; each caller gets its own, so call it once, before first checking Leading. It
+// is never signalled for a single instance.
+func (l *Leader) Elected() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	c := make(chan struct{}, 1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.elected = append(l.elected, c)
+	return c
+}
@@ -0,0 +1,137 @@
+package feedbot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// leaderTTL is the lease the instances in TestLeaderSharedSQLite hold
+const leaderTTL = 3 * time.Second
+
+// TestLeaderInstance is one instance of TestLeaderSharedSQLite, run in its own process; it
+// campaigns once on the database FEEDBOT_TEST_LEADER_DB names, and reports whether it
+// checks feeds and answers commands
+func TestLeaderInstance(t *testing.T) {
+	dsn := os.Getenv("FEEDBOT_TEST_LEADER_DB")
+	if dsn == "" {
+		t.Skip("only run by TestLeaderSharedSQLite")
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db := DefaultDatabaseConfig
+	db.DSN = dsn
+	c, err := NewController(db, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	bot := &Bot{
+		leader:       NewLeader(c, checkerLease, leaderTTL, log),
+		shardLeaders: map[int]*Leader{0: NewLeader(c, shardLease(0, 1), leaderTTL, log)},
+	}
+	ctx := context.Background()
+	bot.leader.campaign(ctx)
+	bot.shardLeaders[0].campaign(ctx)
+	fmt.Printf("checks=%v answers=%v\n", bot.leader.Leading(), bot.answersCommands(&discordgo.Session{ShardID: 0}))
+}
+
+var instanceResult = regexp.MustCompile(`checks=(true|false) answers=(true|false)`)
+
+// TestLeaderSharedSQLite runs instances as separate processes sharing one SQLite file;
+// only one at a time checks feeds and answers commands, and another takes over once its
+// lease expires
+func TestLeaderSharedSQLite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for a lease to expire")
+	}
+	ctx := context.Background()
+	db := DefaultDatabaseConfig
+	db.DSN = filepath.Join(t.TempDir(), "feedbot.db")
+	c, err := NewController(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// run starts n instances at once, and counts those which check feeds and answer commands
+	run := func(n int) (checking, answering int) {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cmd := exec.Command(os.Args[0], "-test.run=^TestLeaderInstance$")
+				cmd.Env = append(os.Environ(), "FEEDBOT_TEST_LEADER_DB="+db.DSN)
+				out, err := cmd.CombinedOutput()
+				m := instanceResult.FindSubmatch(out)
+				if err != nil || m == nil {
+					t.Errorf("instance failed: %v\n%s", err, out)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if string(m[1]) == "true" {
+					checking++
+				}
+				if string(m[2]) == "true" {
+					answering++
+				}
+			}()
+		}
+		wg.Wait()
+		return checking, answering
+	}
+
+	start := time.Now()
+	if checking, answering := run(2); checking != 1 || answering != 1 {
+		t.Fatalf("of two instances, %d check feeds and %d answer commands", checking, answering)
+	}
+	acquired := time.Now()
+	if checking, answering := run(1); time.Since(start) < leaderTTL && (checking != 0 || answering != 0) {
+		t.Errorf("an instance started while the leases are held checks feeds: %v, answers commands: %v", checking == 1, answering == 1)
+	}
+
+	// the leader went away without releasing its leases, a standby takes over once they expire
+	time.Sleep(time.Until(acquired.Add(leaderTTL)))
+	if checking, answering := run(1); checking != 1 || answering != 1 {
+		t.Errorf("once the leases expired, an instance checks feeds: %v, answers commands: %v", checking == 1, answering == 1)
+	}
+}
+
+// TestLeaderElected checks that every caller of Elected hears of an election, so the purge
+// doesn't wait an hour behind the checker
+func TestLeaderElected(t *testing.T) {
+	l := NewLeader(NewMemoryStorage(), checkerLease, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	checker, purge := l.Elected(), l.Elected()
+	l.campaign(context.Background())
+	for name, c := range map[string]<-chan struct{}{"checker": checker, "purge": purge} {
+		select {
+		case <-c:
+		default:
+			t.Errorf("%s wasn't told of the election", name)
+		}
+	}
+
+	// renewing the lease isn't another election
+	l.campaign(context.Background())
+	select {
+	case <-checker:
+		t.Error("renewing the lease signalled an election")
+	default:
+	}
+}
@@ -0,0 +1,70 @@
+package feedbot
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// LogLevel is the least severe kind of message which is logged; errors are always logged
+type LogLevel int
+
+// Log levels, from most to least verbose
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// ParseLogLevel parses one of "debug", "info", "warn" or "error"
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+func (lv LogLevel) String() string {
+	if lv < LogDebug || lv > LogError {
+		return fmt.Sprintf("LogLevel(%d)", int(lv))
+	}
+	return logLevelNames[lv]
+}
+
+func (lv LogLevel) slogLevel() slog.Level {
+	return []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}[lv]
+}
+
+// Log formats; text is logfmt, one key=value record per line
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// NewLogger creates a structured logger writing records of the given format to w. Records
+// share these keys, so they can be queried across components: guild_id, channel_id,
+// sub_id, feed_id, command, duration and err.
+func NewLogger(w io.Writer, level LogLevel, format string) (*slog.Logger, error) {
+	if level < LogDebug || level > LogError {
+		return nil, fmt.Errorf("unknown log level %v", level)
+	}
+	opts := &slog.HandlerOptions{Level: level.slogLevel()}
+	switch format {
+	case LogText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LogJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected %s or %s", format, LogText, LogJSON)
+}
+
+// stackAttr records an error with its stack trace, for errors nobody expected
+func stackAttr(err error) slog.Attr {
+	return slog.String("stack", fmt.Sprintf("%+v", err))
+}
@@ -0,0 +1,684 @@
+package feedbot
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryStorage is a Storage which keeps everything in memory, for tests and for trying
+// the bot out; nothing survives a restart. Its operations never block, so contexts are
+// ignored.
+type MemoryStorage struct {
+	mu sync.Mutex
+
+	feeds       map[int]*memoryFeed
+	feedsByURI  map[feedKey]int
+	credentials map[int]FeedCredentials
+	websub      map[int]WebSubSubscription
+	subs        map[int]*memorySubscription
+	guilds      map[string]*memoryGuild
+	leases      map[string]memoryLease
+
+	lastFeedID int
+	lastSubID  int
+}
+
+// feedKey is what makes a feed unique; a URI may be shared, and private to several guilds
+type feedKey struct {
+	uri     string
+	guildID string
+}
+
+type memoryFeed struct {
+	Feed
+	orphanedAt *time.Time
+}
+
+type memorySubscription struct {
+	Subscription
+	embeds   sql.NullBool
+	webhooks sql.NullBool
+}
+
+type memoryLease struct {
+	holder    string
+	expiresAt time.Time
+}
+
+type memoryGuild struct {
+	GuildConfig
+	leftAt *time.Time
+}
+
+var _ Storage = (*MemoryStorage)(nil)
+
+// NewMemoryStorage creates an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		feeds:       map[int]*memoryFeed{},
+		feedsByURI:  map[feedKey]int{},
+		credentials: map[int]FeedCredentials{},
+		websub:      map[int]WebSubSubscription{},
+		subs:        map[int]*memorySubscription{},
+		guilds:      map[string]*memoryGuild{},
+		leases:      map[string]memoryLease{},
+	}
+}
+
+// GetOrCreateFeed gets the feed a guild subscribes to for a URI; that is the guild's
+// private feed if it has one, or else the shared feed, which is created if it doesn't exist.
+func (m *MemoryStorage) GetOrCreateFeed(ctx context.Context, uri string, guildID string) (*Feed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok := m.feedsByURI[feedKey{uri, guildID}]
+	if !ok {
+		id = m.createFeed(feedKey{uri, ""}, time.Time{})
+	}
+	return m.feeds[id].copy(), nil
+}
+
+// createFeed returns the feed with the given key, creating it if it doesn't exist
+func (m *MemoryStorage) createFeed(key feedKey, lastUpdated time.Time) int {
+	if id, ok := m.feedsByURI[key]; ok {
+		return id
+	}
+	m.lastFeedID++
+	id := m.lastFeedID
+	m.feeds[id] = &memoryFeed{Feed: Feed{ID: id, URI: key.uri, GuildID: key.guildID, LastUpdated: lastUpdated}}
+	m.feedsByURI[key] = id
+	return id
+}
+
+func (f *memoryFeed) copy() *Feed {
+	return &Feed{ID: f.ID, URI: f.URI, GuildID: f.GuildID, LastUpdated: f.LastUpdated}
+}
+
+// PrivatizeFeed moves a guild's subscriptions to a feed onto the guild's private feed for
+// the same URI, creating it if needed
+func (m *MemoryStorage) PrivatizeFeed(ctx context.Context, feedID int, guildID string) (*Feed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.feeds[feedID]
+	if !ok {
+		return nil, errors.WithStack(sql.ErrNoRows)
+	}
+	id := m.createFeed(feedKey{f.URI, guildID}, f.LastUpdated)
+	for _, s := range m.subs {
+		if s.FeedID == feedID && s.GuildID == guildID {
+			s.FeedID = id
+		}
+	}
+	return m.feeds[id].copy(), nil
+}
+
+// GetFeeds gets every feed with a subscription from a guild the bot is still in
+func (m *MemoryStorage) GetFeeds(ctx context.Context) ([]Feed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f := []Feed{}
+	for id, feed := range m.feeds {
+		if !m.hasActiveSubscription(id) {
+			continue
+		}
+		i := Feed{ID: feed.ID, URI: feed.URI, LastUpdated: feed.LastUpdated}
+		if c, ok := m.credentials[id]; ok {
+			i.Credentials = c.Data
+		}
+		if w, ok := m.websub[id]; ok && w.Active {
+			expires := w.LeaseExpires
+			i.PushedUntil = &expires
+		}
+		f = append(f, i)
+	}
+	sort.Slice(f, func(i, j int) bool { return f[i].ID < f[j].ID })
+	return f, nil
+}
+
+func (m *MemoryStorage) hasActiveSubscription(feedID int) bool {
+	for _, s := range m.subs {
+		if s.FeedID != feedID {
+			continue
+		}
+		// like the LEFT JOIN, a guild without a config counts as present
+		if g, ok := m.guilds[s.GuildID]; !ok || g.leftAt == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStorage) hasSubscription(feedID int) bool {
+	for _, s := range m.subs {
+		if s.FeedID == feedID {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkOrphanedFeeds records when each feed lost its last subscription, and forgets that
+// time for any feed which has since gained one.
+func (m *MemoryStorage) MarkOrphanedFeeds(ctx context.Context, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, f := range m.feeds {
+		subscribed := m.hasSubscription(id)
+		if !subscribed && f.orphanedAt == nil {
+			at := now
+			f.orphanedAt = &at
+		} else if subscribed {
+			f.orphanedAt = nil
+		}
+	}
+	return nil
+}
+
+// DestroyOrphanedFeeds deletes every feed which has had no subscriptions since before
+// the given time, unless its WebSub lease is still running at now
+func (m *MemoryStorage) DestroyOrphanedFeeds(ctx context.Context, before, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for id, f := range m.feeds {
+		if f.orphanedAt == nil || !f.orphanedAt.Before(before) || m.hasSubscription(id) {
+			continue
+		}
+		if w, ok := m.websub[id]; ok && w.Active && w.LeaseExpires.After(now) {
+			continue
+		}
+		delete(m.credentials, id)
+		delete(m.websub, id)
+		delete(m.feedsByURI, feedKey{f.URI, f.GuildID})
+		delete(m.feeds, id)
+		n++
+	}
+	return n, nil
+}
+
+// GetFeed gets a feed from its ID
+func (m *MemoryStorage) GetFeed(ctx context.Context, id int) (*Feed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.feeds[id]
+	if !ok {
+		return nil, errors.WithStack(sql.ErrNoRows)
+	}
+	return f.copy(), nil
+}
+
+// UpdateFeedTimestamp updates a feed's last updated time
+func (m *MemoryStorage) UpdateFeedTimestamp(ctx context.Context, feed *Feed, timestamp *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.feeds[feed.ID]
+	if !ok {
+		return errors.New("invalid number of rows affected")
+	}
+	f.LastUpdated = *timestamp
+	return nil
+}
+
+// GetFeedCredentials gets the sealed credentials for a feed; if the feed has none,
+// both return values will be nil.
+func (m *MemoryStorage) GetFeedCredentials(ctx context.Context, feedID int) (*FeedCredentials, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fc, ok := m.credentials[feedID]
+	if !ok {
+		return nil, nil
+	}
+	return &fc, nil
+}
+
+// SetFeedCredentials stores sealed credentials for a feed, replacing any it already had
+func (m *MemoryStorage) SetFeedCredentials(ctx context.Context, feedID int, guildID string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.feeds[feedID]; !ok {
+		return errors.Errorf("there is no feed %d", feedID)
+	}
+	m.credentials[feedID] = FeedCredentials{
+		FeedID:  feedID,
+		GuildID: guildID,
+		Data:    append([]byte(nil), data...),
+	}
+	return nil
+}
+
+// DestroyFeedCredentials removes the credentials for a feed
+func (m *MemoryStorage) DestroyFeedCredentials(ctx context.Context, feedID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.credentials, feedID)
+	return nil
+}
+
+// GetWebSubSubscription gets the WebSub state for a feed; if the feed has none,
+// both return values will be nil.
+func (m *MemoryStorage) GetWebSubSubscription(ctx context.Context, feedID int) (*WebSubSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.websub[feedID]
+	if !ok {
+		return nil, nil
+	}
+	return &w, nil
+}
+
+// GetExpiringWebSubSubscriptions gets every WebSub subscription whose lease expires before
+// the given time, including those which were never verified; feeds nobody is subscribed
+// to are left out
+func (m *MemoryStorage) GetExpiringWebSubSubscriptions(ctx context.Context, before time.Time) ([]WebSubSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var subs []WebSubSubscription
+	for _, w := range m.websub {
+		if w.LeaseExpires.Before(before) && m.hasActiveSubscription(w.FeedID) {
+			subs = append(subs, w)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].FeedID < subs[j].FeedID })
+	return subs, nil
+}
+
+// SetWebSubSubscription stores the WebSub state for a feed, replacing any it already had
+func (m *MemoryStorage) SetWebSubSubscription(ctx context.Context, w *WebSubSubscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.feeds[w.FeedID]; !ok {
+		return errors.Errorf("there is no feed %d", w.FeedID)
+	}
+	m.websub[w.FeedID] = *w
+	return nil
+}
+
+// DestroyWebSubSubscription removes the WebSub state for a feed, returning it to polling
+func (m *MemoryStorage) DestroyWebSubSubscription(ctx context.Context, feedID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.websub, feedID)
+	return nil
+}
+
+// AddSubscription adds a subscription to the given feed for a channel; if the channel is
+// already subscribed, the existing subscription is returned along with ErrSubExists.
+func (m *MemoryStorage) AddSubscription(ctx context.Context, channelID, guildID string, feedID int) (*Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.subs {
+		if s.FeedID == feedID && s.ChannelID == channelID {
+			return &Subscription{ID: s.ID, GuildID: s.GuildID, ChannelID: channelID, FeedID: feedID}, ErrSubExists
+		}
+	}
+	if _, ok := m.feeds[feedID]; !ok {
+		return nil, errors.Errorf("there is no feed %d", feedID)
+	}
+
+	m.lastSubID++
+	s := Subscription{
+		ID:        m.lastSubID,
+		GuildID:   guildID,
+		ChannelID: channelID,
+		FeedID:    feedID,
+	}
+	m.subs[s.ID] = &memorySubscription{Subscription: s}
+	return &s, nil
+}
+
+// GetSubscription gets a subscription from its ID
+func (m *MemoryStorage) GetSubscription(ctx context.Context, id int) (*Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.subs[id]
+	if !ok {
+		return nil, errors.WithStack(sql.ErrNoRows)
+	}
+	return &Subscription{ID: s.ID, GuildID: s.GuildID, ChannelID: s.ChannelID, FeedID: s.FeedID, Pause: s.Pause}, nil
+}
+
+// GetSubscriptions gets all subscriptions for a given guild, with their feeds and overwrites
+func (m *MemoryStorage) GetSubscriptions(ctx context.Context, guildID string) ([]Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var subs []Subscription
+	for _, s := range m.subs {
+		if s.GuildID != guildID {
+			continue
+		}
+		subs = append(subs, Subscription{
+			ID:        s.ID,
+			ChannelID: s.ChannelID,
+			Feed:      &Feed{URI: m.feeds[s.FeedID].URI},
+			Overwrite: &Overwrite{Embeds: s.embeds, Webhooks: s.webhooks},
+			Pause:     s.Pause,
+		})
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs, nil
+}
+
+// GetFeedSubscriptions gets the subscriptions to a feed from guilds the bot is still in,
+// along with their overwrites
+func (m *MemoryStorage) GetFeedSubscriptions(ctx context.Context, feedID int) ([]Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var subs []Subscription
+	for _, s := range m.subs {
+		if s.FeedID != feedID {
+			continue
+		}
+		if g, ok := m.guilds[s.GuildID]; ok && g.leftAt != nil {
+			continue
+		}
+		sub := s.Subscription
+		sub.Overwrite = &Overwrite{SubscriptionID: s.ID, Embeds: s.embeds, Webhooks: s.webhooks}
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs, nil
+}
+
+// ModifySubscriptionChannel changes the channel of a Subscription
+func (m *MemoryStorage) ModifySubscriptionChannel(ctx context.Context, id int, channelID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.subs[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	s.ChannelID = channelID
+	return nil
+}
+
+// PauseSubscription pauses a subscription, or changes how it is paused
+func (m *MemoryStorage) PauseSubscription(ctx context.Context, id int, pause Pause) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.subs[id]
+	if !ok {
+		return errors.WithStack(sql.ErrNoRows)
+	}
+	// a copy, the pause is shared with callers which have read it
+	s.Pause = &pause
+	return nil
+}
+
+// ResumeSubscription resumes a paused subscription
+func (m *MemoryStorage) ResumeSubscription(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.subs[id]
+	if !ok {
+		return errors.WithStack(sql.ErrNoRows)
+	}
+	s.Pause = nil
+	return nil
+}
+
+// DestroySubscription deletes a subscription, along with its overwrite
+func (m *MemoryStorage) DestroySubscription(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.subs[id]; !ok {
+		return errors.Wrap(sql.ErrNoRows, "no rows on subscription delete")
+	}
+	delete(m.subs, id)
+	return nil
+}
+
+// ModifyOverwriteEmbeds changes the embeds policy of a subscription overwrite
+func (m *MemoryStorage) ModifyOverwriteEmbeds(ctx context.Context, subID int, embeds sql.NullBool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.subs[subID]
+	if !ok {
+		return errors.Wrap(sql.ErrNoRows, "no rows on modify override embeds")
+	}
+	s.embeds = embeds
+	return nil
+}
+
+// ModifyOverwriteWebhooks changes the webhooks policy of a subscription overwrite
+func (m *MemoryStorage) ModifyOverwriteWebhooks(ctx context.Context, subID int, webhooks sql.NullBool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.subs[subID]
+	if !ok {
+		return errors.Wrap(sql.ErrNoRows, "no rows on modify override webhooks")
+	}
+	s.webhooks = webhooks
+	return nil
+}
+
+// CreateGuildConfig creates an empty GuildConfig for a guild; if the guild already has one,
+// it is kept, and the guild is no longer considered departed.
+func (m *MemoryStorage) CreateGuildConfig(ctx context.Context, guildID string, ownerContact string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if g, ok := m.guilds[guildID]; ok {
+		g.leftAt = nil
+		return nil
+	}
+	m.guilds[guildID] = &memoryGuild{GuildConfig: GuildConfig{ID: guildID, Contact: ownerContact}}
+	return nil
+}
+
+// MarkGuildLeft records that the bot was removed from a guild
+func (m *MemoryStorage) MarkGuildLeft(ctx context.Context, guildID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if g, ok := m.guilds[guildID]; ok && g.leftAt == nil {
+		g.leftAt = &at
+	}
+	return nil
+}
+
+// GetDepartedGuilds gets the IDs of every guild the bot left before the given time
+func (m *MemoryStorage) GetDepartedGuilds(ctx context.Context, before time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []string
+	for id, g := range m.guilds {
+		if g.leftAt != nil && g.leftAt.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// GetGuildConfig gets a guild's config
+func (m *MemoryStorage) GetGuildConfig(ctx context.Context, guildID string) (*GuildConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.guilds[guildID]
+	if !ok {
+		return nil, errors.WithStack(sql.ErrNoRows)
+	}
+	gc := g.GuildConfig
+	return &gc, nil
+}
+
+// ModifyGuildContact changes the guild's contact address
+func (m *MemoryStorage) ModifyGuildContact(ctx context.Context, guildID string, contact string) error {
+	return m.modifyGuild(guildID, "contact", func(g *GuildConfig) { g.Contact = contact })
+}
+
+// ModifyGuildEmbeds changes the guild's embed rule
+func (m *MemoryStorage) ModifyGuildEmbeds(ctx context.Context, guildID string, embeds bool) error {
+	return m.modifyGuild(guildID, "embeds", func(g *GuildConfig) { g.Embeds = embeds })
+}
+
+// ModifyGuildWebhooks changes the guild's webhook rule
+func (m *MemoryStorage) ModifyGuildWebhooks(ctx context.Context, guildID string, webhooks bool) error {
+	return m.modifyGuild(guildID, "webhooks", func(g *GuildConfig) { g.Webhooks = webhooks })
+}
+
+// ModifyGuildPrefix changes the guild's command prefix; an empty prefix restores the default
+func (m *MemoryStorage) ModifyGuildPrefix(ctx context.Context, guildID string, prefix string) error {
+	return m.modifyGuild(guildID, "prefix", func(g *GuildConfig) { g.Prefix = prefix })
+}
+
+func (m *MemoryStorage) modifyGuild(guildID, field string, modify func(*GuildConfig)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.guilds[guildID]
+	if !ok {
+		return errors.Wrap(sql.ErrNoRows, "no rows on modify guild "+field)
+	}
+	modify(&g.GuildConfig)
+	return nil
+}
+
+// ImportGuild applies every change in imp to a guild at once, so an import which fails
+// part way changes nothing; it returns how many subscriptions were created
+func (m *MemoryStorage) ImportGuild(ctx context.Context, guildID string, imp GuildImport) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// everything is checked before anything is changed
+	g, ok := m.guilds[guildID]
+	if imp.Config != nil && !ok {
+		return 0, errors.Wrap(sql.ErrNoRows, "no rows on import guild config")
+	}
+	for _, i := range imp.Subscriptions {
+		if i.ID != 0 {
+			if s, ok := m.subs[i.ID]; !ok || s.GuildID != guildID {
+				return 0, errors.Wrap(sql.ErrNoRows, "no rows on import subscription overrides")
+			}
+		} else if _, ok := m.feeds[i.FeedID]; !ok {
+			return 0, errors.Errorf("there is no feed %d", i.FeedID)
+		}
+	}
+
+	if imp.Config != nil {
+		c := *imp.Config
+		c.ID = guildID
+		g.GuildConfig = c
+	}
+	created := 0
+	for _, i := range imp.Subscriptions {
+		s := m.subs[i.ID]
+		if i.ID == 0 {
+			for _, existing := range m.subs {
+				if existing.FeedID == i.FeedID && existing.ChannelID == i.ChannelID {
+					s = existing
+				}
+			}
+		}
+		if s == nil {
+			m.lastSubID++
+			s = &memorySubscription{Subscription: Subscription{
+				ID:        m.lastSubID,
+				GuildID:   guildID,
+				ChannelID: i.ChannelID,
+				FeedID:    i.FeedID,
+			}}
+			m.subs[s.ID] = s
+			created++
+		}
+		s.embeds, s.webhooks = i.Embeds, i.Webhooks
+	}
+	return created, nil
+}
+
+// DestroyGuildData removes all data associated with a guild.
+func (m *MemoryStorage) DestroyGuildData(ctx context.Context, guildID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, s := range m.subs {
+		if s.GuildID == guildID {
+			delete(m.subs, id)
+		}
+	}
+	for id, c := range m.credentials {
+		if c.GuildID == guildID {
+			delete(m.credentials, id)
+		}
+	}
+	delete(m.guilds, guildID)
+	return nil
+}
+
+// GetStats counts the guilds, subscriptions and feeds the bot is serving
+func (m *MemoryStorage) GetStats(ctx context.Context) (*Stats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var s Stats
+	for _, g := range m.guilds {
+		if g.leftAt == nil {
+			s.Guilds++
+		}
+	}
+	for _, sub := range m.subs {
+		if g, ok := m.guilds[sub.GuildID]; !ok || g.leftAt == nil {
+			s.Subscriptions++
+		}
+	}
+	for id := range m.feeds {
+		if m.hasActiveSubscription(id) {
+			s.ActiveFeeds++
+		}
+	}
+	return &s, nil
+}
+
+// AcquireLease takes the named lease for holder until ttl after now, or renews it if
+// holder already has it; it reports false while another holder's lease hasn't expired
+func (m *MemoryStorage) AcquireLease(ctx context.Context, name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l, ok := m.leases[name]; ok && l.holder != holder && !l.expiresAt.Before(now) {
+		return false, nil
+	}
+	m.leases[name] = memoryLease{holder: holder, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+// ReleaseLease gives up holder's lease early, so that another holder can take it at once
+func (m *MemoryStorage) ReleaseLease(ctx context.Context, name, holder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l, ok := m.leases[name]; ok && l.holder == holder {
+		delete(m.leases, name)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package feedbot_test
+
+import (
+	"testing"
+
+	"github.com/foxbot/feedbot"
+	"github.com/foxbot/feedbot/storagetest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, feedbot.NewMemoryStorage())
+}
@@ -0,0 +1,234 @@
+package feedbot
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics contains the bot's Prometheus collectors. Every method is safe to call on a nil
+// *Metrics, which records nothing, so components work without them.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	feedsChecked  *prometheus.CounterVec
+	fetchDuration *prometheus.HistogramVec
+	fetchErrors   *prometheus.CounterVec
+	httpResponses *prometheus.CounterVec
+	itemsFound    prometheus.Counter
+	messages      *prometheus.CounterVec
+	rateLimits    prometheus.Counter
+	commands      *prometheus.CounterVec
+	queryDuration *prometheus.HistogramVec
+}
+
+// NewMetrics creates the bot's collectors, and registers them along with the Go runtime's;
+// the guild, subscription and active feed gauges are read from storage on each scrape.
+func NewMetrics(storage Storage) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		feedsChecked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "feedbot_feeds_checked_total",
+			Help: "Feeds polled, by outcome.",
+		}, []string{"outcome"}),
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "feedbot_fetch_duration_seconds",
+			Help:    "How long fetching a feed took, by source kind.",
+			Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"kind"}),
+		fetchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "feedbot_fetch_errors_total",
+			Help: "Feeds which couldn't be fetched, by class of error.",
+		}, []string{"class"}),
+		httpResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "feedbot_http_responses_total",
+			Help: "Responses to requests for feeds and WebSub hubs, by status code.",
+		}, []string{"code"}),
+		itemsFound: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "feedbot_items_found_total",
+			Help: "New items found in feeds, whether polled or pushed.",
+		}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "feedbot_messages_total",
+			Help: "Items posted to Discord channels, by outcome.",
+		}, []string{"outcome"}),
+		rateLimits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "feedbot_discord_rate_limits_total",
+			Help: "Requests to Discord which were rate limited.",
+		}),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "feedbot_commands_total",
+			Help: "Commands run, by name and outcome.",
+		}, []string{"command", "outcome"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "feedbot_db_query_duration_seconds",
+			Help:    "How long database queries took to start returning results, by operation.",
+			Buckets: prometheus.ExponentialBuckets(.0005, 4, 8),
+		}, []string{"op"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.feedsChecked,
+		m.fetchDuration,
+		m.fetchErrors,
+		m.httpResponses,
+		m.itemsFound,
+		m.messages,
+		m.rateLimits,
+		m.commands,
+		m.queryDuration,
+		&statsCollector{storage: storage},
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) feedChecked(kind string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.fetchDuration.WithLabelValues(kind).Observe(d.Seconds())
+	if err != nil {
+		m.feedsChecked.WithLabelValues("error").Inc()
+		m.fetchErrors.WithLabelValues(fetchErrorClass(err)).Inc()
+		return
+	}
+	m.feedsChecked.WithLabelValues("ok").Inc()
+}
+
+func (m *Metrics) httpResponse(code int) {
+	if m == nil {
+		return
+	}
+	m.httpResponses.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+func (m *Metrics) foundItems(n int) {
+	if m == nil {
+		return
+	}
+	m.itemsFound.Add(float64(n))
+}
+
+func (m *Metrics) messageSent(err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.messages.WithLabelValues("failed").Inc()
+		return
+	}
+	m.messages.WithLabelValues("delivered").Inc()
+}
+
+func (m *Metrics) rateLimited() {
+	if m == nil {
+		return
+	}
+	m.rateLimits.Inc()
+}
+
+// commandRan counts a command; unknown commands are counted together, so users can't
+// create a series per typo
+func (m *Metrics) commandRan(name, outcome string) {
+	if m == nil {
+		return
+	}
+	m.commands.WithLabelValues(name, outcome).Inc()
+}
+
+func (m *Metrics) queried(op string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.queryDuration.WithLabelValues(op).Observe(d.Seconds())
+}
+
+// fetchErrorClass sorts a fetch error into a small set of classes, for a metric label
+func fetchErrorClass(err error) string {
+	var (
+		status   *statusError
+		dns      *net.DNSError
+		netErr   net.Error
+		unknown  x509.UnknownAuthorityError
+		hostname x509.HostnameError
+		invalid  x509.CertificateInvalidError
+		xmlErr   *xml.SyntaxError
+		jsonErr  *json.SyntaxError
+	)
+	switch {
+	case errors.Is(err, ErrAddressBlocked), errors.Is(err, ErrSchemeNotAllowed), errors.Is(err, ErrLocalSourcesDisabled):
+		return "blocked"
+	case errors.Is(err, ErrResponseTooLarge):
+		return "too_large"
+	case errors.Is(err, ErrTooManyRedirects):
+		return "redirects"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &status):
+		return "http_status"
+	case errors.As(err, &dns):
+		return "dns"
+	case errors.As(err, &unknown), errors.As(err, &hostname), errors.As(err, &invalid):
+		return "tls"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	case errors.Is(err, gofeed.ErrFeedTypeNotDetected), errors.As(err, &xmlErr), errors.As(err, &jsonErr):
+		return "parse"
+	}
+	return "other"
+}
+
+// statsCollector reads the guild, subscription and active feed gauges from storage when
+// the metrics are scraped
+type statsCollector struct {
+	storage Storage
+}
+
+var (
+	guildsDesc        = prometheus.NewDesc("feedbot_guilds", "Guilds the bot is in.", nil, nil)
+	subscriptionsDesc = prometheus.NewDesc("feedbot_subscriptions", "Subscriptions in the guilds the bot is in.", nil, nil)
+	activeFeedsDesc   = prometheus.NewDesc("feedbot_active_feeds", "Feeds with at least one subscription, which are checked.", nil, nil)
+)
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- guildsDesc
+	ch <- subscriptionsDesc
+	ch <- activeFeedsDesc
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := c.storage.GetStats(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(guildsDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(guildsDesc, prometheus.GaugeValue, float64(s.Guilds))
+	ch <- prometheus.MustNewConstMetric(subscriptionsDesc, prometheus.GaugeValue, float64(s.Subscriptions))
+	ch <- prometheus.MustNewConstMetric(activeFeedsDesc, prometheus.GaugeValue, float64(s.ActiveFeeds))
+}
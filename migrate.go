@@ -0,0 +1,292 @@
+package feedbot
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationName matches files such as 0001_initial.up.sql
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// foreignKeysOff starts a SQLite migration which has to run with foreign keys off, as one
+// which rebuilds a table does; every other migration runs with them on, so that deletes
+// cascade
+const foreignKeysOff = "-- foreign_keys: off\n"
+
+// Migration is a numbered change to the database schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus describes whether a Migration has been applied to the database
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var (
+	// ErrSchemaOutdated is returned when the database has not had every migration applied
+	ErrSchemaOutdated = errors.New("database schema is out of date, please run `migrate up`")
+)
+
+// Migrations returns every embedded migration for a database driver, ordered by version;
+// each driver keeps its own set, under migrations/<dialect>.
+func Migrations(driver string) ([]Migration, error) {
+	d, err := dialectFor(driver)
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Join("migrations", d.name)
+	files, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, f := range files {
+		m := migrationName.FindStringSubmatch(f.Name())
+		if m == nil {
+			return nil, errors.Errorf("badly named migration %s", f.Name())
+		}
+		v, _ := strconv.Atoi(m[1])
+		sql, err := migrationFiles.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		mig, ok := byVersion[v]
+		if !ok {
+			mig = &Migration{Version: v, Name: m[2]}
+			byVersion[v] = mig
+		} else if mig.Name != m[2] {
+			return nil, errors.Errorf("migration %d is named both %s and %s", v, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(sql)
+		} else {
+			mig.Down = string(sql)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, errors.Errorf("migration %d is missing its up or down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, errors.Errorf("migrations skip from %d to %d", i, m.Version)
+		}
+	}
+	return migrations, nil
+}
+
+func (c *Controller) ensureMigrationsTable(ctx context.Context) error {
+	_, err := c.exec(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version int PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamp NOT NULL
+	);
+	`)
+	return errors.WithStack(err)
+}
+
+// SchemaVersion returns the version of the most recent migration applied to the database
+func (c *Controller) SchemaVersion(ctx context.Context) (int, error) {
+	if err := c.ensureMigrationsTable(ctx); err != nil {
+		return 0, err
+	}
+	var v int
+	err := c.queryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations;").Scan(&v)
+	return v, errors.WithStack(err)
+}
+
+// CheckSchema returns ErrSchemaOutdated unless every migration has been applied
+func (c *Controller) CheckSchema(ctx context.Context) error {
+	migrations, err := Migrations(c.driver)
+	if err != nil {
+		return err
+	}
+	v, err := c.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if latest := len(migrations); v != latest {
+		return errors.Wrapf(ErrSchemaOutdated, "database is at version %d, expected %d", v, latest)
+	}
+	return nil
+}
+
+// MigrationStatus lists every migration, and whether it has been applied
+func (c *Controller) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := Migrations(c.driver)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	r, err := c.query(ctx, "SELECT version, applied_at FROM schema_migrations;")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer r.Close()
+	applied := map[int]time.Time{}
+	for r.Next() {
+		var v int
+		var at time.Time
+		if err = r.Scan(&v, &at); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		applied[v] = at
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		at, ok := applied[m.Version]
+		status[i] = MigrationStatus{Migration: m, Applied: ok, AppliedAt: at}
+	}
+	return status, errors.WithStack(r.Err())
+}
+
+// MigrateUp applies every pending migration
+func (c *Controller) MigrateUp(ctx context.Context) error {
+	migrations, err := Migrations(c.driver)
+	if err != nil {
+		return err
+	}
+	return c.MigrateTo(ctx, len(migrations))
+}
+
+// MigrateDown reverts the most recently applied migration
+func (c *Controller) MigrateDown(ctx context.Context) error {
+	v, err := c.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if v == 0 {
+		return errors.New("no migrations have been applied")
+	}
+	return c.MigrateTo(ctx, v-1)
+}
+
+// MigrateTo applies or reverts migrations until the database is at the given version;
+// each migration runs in its own transaction.
+func (c *Controller) MigrateTo(ctx context.Context, target int) error {
+	migrations, err := Migrations(c.driver)
+	if err != nil {
+		return err
+	}
+	if target < 0 || target > len(migrations) {
+		return errors.Errorf("there is no migration %d, the latest is %d", target, len(migrations))
+	}
+	v, err := c.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	for ; v < target; v++ {
+		m := migrations[v]
+		start := time.Now()
+		err = c.applyMigration(ctx, m.Up, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?);",
+			m.Version, m.Name, start)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't apply migration %d_%s", m.Version, m.Name)
+		}
+		c.log.Info("applied migration", "version", m.Version, "name", m.Name, "duration", time.Since(start))
+	}
+	for ; v > target; v-- {
+		m := migrations[v-1]
+		start := time.Now()
+		err = c.applyMigration(ctx, m.Down, "DELETE FROM schema_migrations WHERE version = ?;", m.Version)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't revert migration %d_%s", m.Version, m.Name)
+		}
+		c.log.Info("reverted migration", "version", m.Version, "name", m.Name, "duration", time.Since(start))
+	}
+	return nil
+}
+
+func (c *Controller) applyMigration(ctx context.Context, script string, record string, args ...interface{}) error {
+	apply := func(t *tx) error {
+		// the script is run verbatim, it may contain literal question marks
+		if _, err := t.ExecContext(ctx, script); err != nil {
+			return errors.WithStack(err)
+		}
+		_, err := t.exec(record, args...)
+		return errors.WithStack(err)
+	}
+	if c.driver != "sqlite3" || !strings.HasPrefix(script, foreignKeysOff) {
+		return c.transact(ctx, apply)
+	}
+
+	// SQLite can only change a table's constraints by rebuilding it, and dropping a table
+	// others reference would cascade; as SQLite recommends, foreign keys are switched off
+	// for a migration which rebuilds tables, and checked before it commits. The pragma is
+	// a no-op within a transaction, so it is set on a connection of our own first.
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF;"); err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "PRAGMA foreign_keys = ON;")
+
+	t, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = apply(&tx{Tx: t, ctx: ctx, c: c})
+	if err == nil {
+		err = checkForeignKeys(ctx, t)
+	}
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+	return errors.WithStack(t.Commit())
+}
+
+// checkForeignKeys fails if any row in a SQLite database references one that is missing
+func checkForeignKeys(ctx context.Context, t *sql.Tx) error {
+	r, err := t.QueryContext(ctx, "PRAGMA foreign_key_check;")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer r.Close()
+	if r.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fkid int
+		if err = r.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.Errorf("row %d of %s references a missing row of %s", rowid.Int64, table, parent)
+	}
+	return errors.WithStack(r.Err())
+}
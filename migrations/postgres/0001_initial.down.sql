@@ -0,0 +1,4 @@
+DROP TABLE subscription_overrides;
+DROP TABLE subscriptions;
+DROP TABLE guild_config;
+DROP TABLE feeds;
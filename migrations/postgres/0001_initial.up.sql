@@ -0,0 +1,30 @@
+CREATE TABLE feeds (
+	id SERIAL PRIMARY KEY,
+	uri text UNIQUE NOT NULL,
+	last_updated timestamptz NOT NULL
+);
+
+CREATE TABLE guild_config (
+	id text PRIMARY KEY,
+	contact text NOT NULL,
+	enable_embeds boolean NOT NULL,
+	enable_webhooks boolean NOT NULL
+);
+
+CREATE TABLE subscriptions (
+	id SERIAL PRIMARY KEY,
+	guild_id text NOT NULL,
+	channel_id text NOT NULL,
+	feed_id int NOT NULL,
+
+	FOREIGN KEY(feed_id) REFERENCES feeds(id)
+);
+
+CREATE TABLE subscription_overrides (
+	id SERIAL PRIMARY KEY,
+	sub_id int NOT NULL,
+	enable_embeds boolean,
+	enable_webhooks boolean,
+
+	FOREIGN KEY(sub_id) REFERENCES subscriptions(id) ON DELETE CASCADE
+);
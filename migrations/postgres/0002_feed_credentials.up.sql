@@ -0,0 +1,7 @@
+CREATE TABLE feed_credentials (
+	feed_id int PRIMARY KEY,
+	guild_id text NOT NULL,
+	data bytea NOT NULL,
+
+	FOREIGN KEY(feed_id) REFERENCES feeds(id) ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+ALTER TABLE guild_config DROP COLUMN left_at;
@@ -0,0 +1 @@
+ALTER TABLE subscriptions DROP CONSTRAINT subscriptions_channel_feed;
@@ -0,0 +1,11 @@
+-- keep the oldest of any duplicate subscriptions; their overrides cascade
+DELETE FROM subscriptions WHERE id NOT IN (
+	SELECT MIN(id) FROM subscriptions GROUP BY channel_id, feed_id
+);
+
+-- restore the override row of any subscription left without one
+INSERT INTO subscription_overrides (sub_id)
+	SELECT id FROM subscriptions
+	WHERE id NOT IN (SELECT sub_id FROM subscription_overrides);
+
+ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_channel_feed UNIQUE (channel_id, feed_id);
@@ -0,0 +1 @@
+ALTER TABLE guild_config ADD COLUMN prefix text;
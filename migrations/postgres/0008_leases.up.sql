@@ -0,0 +1,5 @@
+CREATE TABLE leases (
+	name text PRIMARY KEY,
+	holder text NOT NULL,
+	expires_at timestamptz NOT NULL
+);
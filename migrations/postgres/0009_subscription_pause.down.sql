@@ -0,0 +1,3 @@
+ALTER TABLE subscriptions DROP COLUMN paused_seen;
+ALTER TABLE subscriptions DROP COLUMN paused_until;
+ALTER TABLE subscriptions DROP COLUMN paused_at;
@@ -0,0 +1,3 @@
+ALTER TABLE subscriptions ADD COLUMN paused_at timestamptz;
+ALTER TABLE subscriptions ADD COLUMN paused_until timestamptz;
+ALTER TABLE subscriptions ADD COLUMN paused_seen timestamptz;
@@ -0,0 +1,16 @@
+-- each URI is merged into one feed, its shared feed if it has one; merged feeds lose
+-- their credentials and WebSub state
+CREATE TEMP TABLE merged_feeds ON COMMIT DROP AS
+	SELECT f.id, (
+		SELECT k.id FROM feeds as k WHERE k.uri = f.uri ORDER BY k.guild_id != '', k.id LIMIT 1
+	) as into_id
+	FROM feeds as f;
+DELETE FROM merged_feeds WHERE id = into_id;
+
+UPDATE subscriptions SET feed_id = m.into_id
+	FROM merged_feeds as m WHERE m.id = subscriptions.feed_id;
+DELETE FROM feeds WHERE id IN (SELECT id FROM merged_feeds);
+
+ALTER TABLE feeds DROP CONSTRAINT feeds_uri_guild_id_key;
+ALTER TABLE feeds DROP COLUMN guild_id;
+ALTER TABLE feeds ADD CONSTRAINT feeds_uri_key UNIQUE (uri);
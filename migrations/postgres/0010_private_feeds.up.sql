@@ -0,0 +1,11 @@
+-- a feed fetched with a guild's credentials is private to that guild, so one URI may be
+-- a shared feed and a private feed for each of several guilds; guild_id is empty for a
+-- shared feed
+ALTER TABLE feeds ADD COLUMN guild_id text NOT NULL DEFAULT '';
+
+-- feeds with credentials could only be subscribed to by the guild which owns them
+UPDATE feeds SET guild_id = fc.guild_id
+	FROM feed_credentials as fc WHERE fc.feed_id = feeds.id;
+
+ALTER TABLE feeds DROP CONSTRAINT feeds_uri_key;
+ALTER TABLE feeds ADD CONSTRAINT feeds_uri_guild_id_key UNIQUE (uri, guild_id);
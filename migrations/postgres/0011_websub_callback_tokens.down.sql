@@ -0,0 +1,2 @@
+ALTER TABLE websub_subscriptions DROP COLUMN pending_token;
+ALTER TABLE websub_subscriptions DROP COLUMN callback_token;
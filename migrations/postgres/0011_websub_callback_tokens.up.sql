@@ -0,0 +1,4 @@
+-- callback URLs carry a token only the hub was sent, so nobody else can verify or deny
+-- a subscription on its behalf
+ALTER TABLE websub_subscriptions ADD COLUMN callback_token text NOT NULL DEFAULT '';
+ALTER TABLE websub_subscriptions ADD COLUMN pending_token text NOT NULL DEFAULT '';
@@ -0,0 +1,31 @@
+-- IF NOT EXISTS lets databases created before migrations existed adopt this one
+CREATE TABLE IF NOT EXISTS feeds (
+	id INTEGER PRIMARY KEY,
+	uri text UNIQUE NOT NULL,
+	last_updated timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS guild_config (
+	id text PRIMARY KEY,
+	contact text NOT NULL,
+	enable_embeds int NOT NULL,
+	enable_webhooks int NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id INTEGER PRIMARY KEY,
+	guild_id text NOT NULL,
+	channel_id text NOT NULL,
+	feed_id int NOT NULL,
+
+	FOREIGN KEY(feed_id) REFERENCES feeds(id)
+);
+
+CREATE TABLE IF NOT EXISTS subscription_overrides (
+	id INTEGER PRIMARY KEY,
+	sub_id int NOT NULL,
+	enable_embeds int,
+	enable_webhooks int,
+
+	FOREIGN KEY(sub_id) REFERENCES subscriptions(id) ON DELETE CASCADE
+);
@@ -0,0 +1,10 @@
+CREATE TABLE websub_subscriptions (
+	feed_id int PRIMARY KEY,
+	hub text NOT NULL,
+	topic text NOT NULL,
+	secret text NOT NULL,
+	active int NOT NULL,
+	lease_expires timestamp NOT NULL,
+
+	FOREIGN KEY(feed_id) REFERENCES feeds(id) ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+ALTER TABLE guild_config ADD COLUMN left_at timestamp;
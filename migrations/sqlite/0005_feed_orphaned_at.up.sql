@@ -0,0 +1 @@
+ALTER TABLE feeds ADD COLUMN orphaned_at timestamp;
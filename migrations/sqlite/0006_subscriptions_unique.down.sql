@@ -0,0 +1 @@
+DROP INDEX subscriptions_channel_feed;
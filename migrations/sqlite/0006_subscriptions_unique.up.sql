@@ -0,0 +1,14 @@
+-- keep the oldest of any duplicate subscriptions; their overrides cascade, and are also
+-- deleted explicitly, in case foreign keys are off
+DELETE FROM subscriptions WHERE id NOT IN (
+	SELECT MIN(id) FROM subscriptions GROUP BY channel_id, feed_id
+);
+DELETE FROM subscription_overrides WHERE sub_id NOT IN (SELECT id FROM subscriptions);
+
+-- restore the override row of any subscription left without one
+INSERT INTO subscription_overrides (sub_id)
+	SELECT id FROM subscriptions
+	WHERE id NOT IN (SELECT sub_id FROM subscription_overrides);
+
+-- SQLite can't add a constraint to an existing table; a unique index is equivalent
+CREATE UNIQUE INDEX subscriptions_channel_feed ON subscriptions (channel_id, feed_id);
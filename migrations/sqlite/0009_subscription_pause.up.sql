@@ -0,0 +1,3 @@
+ALTER TABLE subscriptions ADD COLUMN paused_at timestamp;
+ALTER TABLE subscriptions ADD COLUMN paused_until timestamp;
+ALTER TABLE subscriptions ADD COLUMN paused_seen timestamp;
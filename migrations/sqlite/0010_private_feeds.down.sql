@@ -0,0 +1,29 @@
+-- foreign_keys: off
+-- each URI is merged into one feed, its shared feed if it has one; merged feeds lose
+-- their credentials and WebSub state
+CREATE TEMP TABLE merged_feeds AS
+	SELECT f.id, (
+		SELECT k.id FROM feeds as k WHERE k.uri = f.uri ORDER BY k.guild_id != '', k.id LIMIT 1
+	) as into_id
+	FROM feeds as f;
+DELETE FROM merged_feeds WHERE id = into_id;
+
+UPDATE subscriptions SET feed_id = (
+	SELECT into_id FROM merged_feeds WHERE merged_feeds.id = subscriptions.feed_id
+) WHERE feed_id IN (SELECT id FROM merged_feeds);
+DELETE FROM feed_credentials WHERE feed_id IN (SELECT id FROM merged_feeds);
+DELETE FROM websub_subscriptions WHERE feed_id IN (SELECT id FROM merged_feeds);
+DELETE FROM feeds WHERE id IN (SELECT id FROM merged_feeds);
+DROP TABLE merged_feeds;
+
+CREATE TABLE feeds_old (
+	id INTEGER PRIMARY KEY,
+	uri text UNIQUE NOT NULL,
+	last_updated timestamp NOT NULL,
+	orphaned_at timestamp
+);
+INSERT INTO feeds_old (id, uri, last_updated, orphaned_at)
+	SELECT id, uri, last_updated, orphaned_at FROM feeds;
+
+DROP TABLE feeds;
+ALTER TABLE feeds_old RENAME TO feeds;
@@ -0,0 +1,23 @@
+-- foreign_keys: off
+-- a feed fetched with a guild's credentials is private to that guild, so one URI may be
+-- a shared feed and a private feed for each of several guilds. SQLite can't drop the
+-- UNIQUE on uri, so the table is rebuilt with foreign keys off.
+CREATE TABLE feeds_new (
+	id INTEGER PRIMARY KEY,
+	uri text NOT NULL,
+	-- guild_id is empty for a shared feed
+	guild_id text NOT NULL DEFAULT '',
+	last_updated timestamp NOT NULL,
+	orphaned_at timestamp,
+
+	UNIQUE(uri, guild_id)
+);
+
+-- feeds with credentials could only be subscribed to by the guild which owns them
+INSERT INTO feeds_new (id, uri, guild_id, last_updated, orphaned_at)
+	SELECT f.id, f.uri, COALESCE(fc.guild_id, ''), f.last_updated, f.orphaned_at
+	FROM feeds as f
+	LEFT JOIN feed_credentials as fc ON fc.feed_id = f.id;
+
+DROP TABLE feeds;
+ALTER TABLE feeds_new RENAME TO feeds;
@@ -0,0 +1,108 @@
+package feedbot
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxOPMLSize is the largest OPML file which may be imported
+	maxOPMLSize = 1 << 20
+	// maxImportFeeds is the most feeds one import may subscribe to, so that it finishes
+	// within a command's timeout
+	maxImportFeeds = 100
+)
+
+// opml is the layout of an OPML subscription list; only what feed readers exchange is
+// kept, see http://opml.org/spec2.opml
+type opml struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Title   string        `xml:"head>title"`
+	Created string        `xml:"head>dateCreated,omitempty"`
+	Body    []opmlOutline `xml:"body>outline"`
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XMLURL   string        `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string        `xml:"htmlUrl,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// opmlFeed is a feed listed in an OPML file
+type opmlFeed struct {
+	URI string
+	// Folder is the outermost outline the feed is nested in; empty if it isn't in one
+	Folder string
+}
+
+// opmlFolder is a group of feeds written to an OPML file
+type opmlFolder struct {
+	Name string
+	URIs []string
+}
+
+// parseOPML lists every feed in an OPML file, in order, including those nested in folders
+func parseOPML(r io.Reader) ([]opmlFeed, error) {
+	var doc opml
+	if err := xml.NewDecoder(io.LimitReader(r, maxOPMLSize)).Decode(&doc); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse OPML")
+	}
+
+	var feeds []opmlFeed
+	var walk func(outlines []opmlOutline, folder string)
+	walk = func(outlines []opmlOutline, folder string) {
+		for _, o := range outlines {
+			if uri := strings.TrimSpace(o.XMLURL); uri != "" {
+				feeds = append(feeds, opmlFeed{URI: uri, Folder: folder})
+			}
+			if len(o.Outlines) == 0 {
+				continue
+			}
+			inner := folder
+			if inner == "" {
+				inner = o.Text
+				if inner == "" {
+					inner = o.Title
+				}
+			}
+			walk(o.Outlines, inner)
+		}
+	}
+	walk(doc.Body, "")
+	return feeds, nil
+}
+
+// writeOPML writes an OPML file with a folder of feeds for each of folders
+func writeOPML(w io.Writer, title string, folders []opmlFolder) error {
+	doc := opml{
+		Version: "2.0",
+		Title:   title,
+		Created: time.Now().UTC().Format(time.RFC1123Z),
+	}
+	for _, f := range folders {
+		folder := opmlOutline{Text: f.Name, Title: f.Name}
+		for _, uri := range f.URIs {
+			folder.Outlines = append(folder.Outlines, opmlOutline{Text: uri, Type: "rss", XMLURL: uri})
+		}
+		doc.Body = append(doc.Body, folder)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return errors.WithStack(err)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(doc); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return errors.WithStack(err)
+}
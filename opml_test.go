@@ -0,0 +1,71 @@
+package feedbot
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOPML(t *testing.T) {
+	doc := `<?xml version="1.0"?>
+<opml version="2.0">
+	<head><title>Subscriptions</title></head>
+	<body>
+		<outline text="Loose" xmlUrl=" https://example.com/loose.xml "/>
+		<outline text="Empty" xmlUrl=""/>
+		<outline title="News">
+			<outline text="One" xmlUrl="https://example.com/1.xml"/>
+			<outline text="Local">
+				<outline text="Two" xmlUrl="https://example.com/2.xml"/>
+			</outline>
+		</outline>
+		<outline text="Blog" xmlUrl="https://example.com/blog.xml">
+			<outline text="Comments" xmlUrl="https://example.com/comments.xml"/>
+		</outline>
+	</body>
+</opml>`
+	feeds, err := parseOPML(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []opmlFeed{
+		{URI: "https://example.com/loose.xml"},
+		{URI: "https://example.com/1.xml", Folder: "News"},
+		// nested folders are flattened into the outermost one
+		{URI: "https://example.com/2.xml", Folder: "News"},
+		{URI: "https://example.com/blog.xml"},
+		{URI: "https://example.com/comments.xml", Folder: "Blog"},
+	}
+	if !reflect.DeepEqual(feeds, want) {
+		t.Errorf("parsed %+v, expected %+v", feeds, want)
+	}
+
+	if _, err := parseOPML(strings.NewReader("<opml><body>")); err == nil {
+		t.Error("truncated OPML was parsed")
+	}
+}
+
+func TestOPMLRoundTrip(t *testing.T) {
+	folders := []opmlFolder{
+		{Name: "general", URIs: []string{"https://example.com/1.xml", "https://example.com/a&b.xml"}},
+		{Name: "empty"},
+		{Name: "news", URIs: []string{"https://example.com/2.xml"}},
+	}
+	var buf bytes.Buffer
+	if err := writeOPML(&buf, "Feeds", folders); err != nil {
+		t.Fatal(err)
+	}
+	feeds, err := parseOPML(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []opmlFeed{
+		{URI: "https://example.com/1.xml", Folder: "general"},
+		{URI: "https://example.com/a&b.xml", Folder: "general"},
+		{URI: "https://example.com/2.xml", Folder: "news"},
+	}
+	if !reflect.DeepEqual(feeds, want) {
+		t.Errorf("round trip gave %+v, expected %+v", feeds, want)
+	}
+}
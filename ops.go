@@ -0,0 +1,44 @@
+package feedbot
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// opsServer is the operator's HTTP listener, serving metrics to Prometheus, and health
+// and readiness checks to an orchestrator
+type opsServer struct {
+	server *http.Server
+}
+
+func newOpsServer(addr string, metrics *Metrics, healthz, readyz http.HandlerFunc) *opsServer {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	return &opsServer{
+		server: &http.Server{
+			Addr:         addr,
+			Handler:      mux,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		},
+	}
+}
+
+// ListenAndServe serves until Close is called
+func (o *opsServer) ListenAndServe() error {
+	err := o.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+// Close stops the listener; it is closed last, so that the bot can be watched while it
+// shuts down
+func (o *opsServer) Close() error {
+	return errors.WithStack(o.server.Close())
+}
@@ -0,0 +1,219 @@
+package feedbot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// permission is who may run a command
+type permission int
+
+const (
+	// permEveryone commands check any permissions they need themselves
+	permEveryone permission = iota
+	// permAdmin commands require the ADMINISTRATOR permission in the guild they're run in
+	permAdmin
+	// permOwner commands may only be run by the bot's owners
+	permOwner
+)
+
+func (p permission) String() string {
+	switch p {
+	case permAdmin:
+		return "requires the **ADMINISTRATOR** permission"
+	case permOwner:
+		return "only the bot's owners may use this"
+	}
+	return ""
+}
+
+// command describes a command; its usage and description are what help is generated from
+type command struct {
+	name    string
+	aliases []string
+	// usage lists the command's arguments, e.g. "<uri> [channel]"
+	usage       string
+	description string
+	permission  permission
+	// hidden commands are left out of help and suggestions
+	hidden bool
+	// subcommands are chosen by the first argument; a command with subcommands may have
+	// no handler of its own
+	subcommands []*command
+	handler     commandHandler
+}
+
+// registry looks commands up by name or alias
+type registry struct {
+	commands []*command
+	names    map[string]*command
+}
+
+func newRegistry(commands ...*command) *registry {
+	r := &registry{
+		commands: commands,
+		names:    map[string]*command{},
+	}
+	for _, c := range commands {
+		for _, name := range append([]string{c.name}, c.aliases...) {
+			if _, ok := r.names[name]; ok {
+				panic("duplicate command " + name)
+			}
+			r.names[name] = c
+		}
+	}
+	return r
+}
+
+// find resolves a command, and any subcommands, from the words of a message; it returns
+// the path of commands, so that each one's permission can be checked, and the remaining
+// arguments. path is empty when the first word isn't a command.
+func (r *registry) find(words []string) (path []*command, args []string) {
+	cmd, ok := r.names[words[0]]
+	if !ok {
+		return nil, words[1:]
+	}
+	path = append(path, cmd)
+	args = words[1:]
+	for len(args) > 0 {
+		if cmd = cmd.subcommand(args[0]); cmd == nil {
+			break
+		}
+		path = append(path, cmd)
+		args = args[1:]
+	}
+	return path, args
+}
+
+func (c *command) subcommand(name string) *command {
+	for _, sub := range c.subcommands {
+		if sub.name == name {
+			return sub
+		}
+		for _, alias := range sub.aliases {
+			if alias == name {
+				return sub
+			}
+		}
+	}
+	return nil
+}
+
+// suggest finds the visible names closest to an unknown one, if any are close enough to
+// be a typo
+func suggest(name string, commands []*command) []string {
+	limit := min(len(name)/2, 2)
+	best := limit + 1
+	var names []string
+	for _, c := range commands {
+		if c.hidden {
+			continue
+		}
+		for _, candidate := range append([]string{c.name}, c.aliases...) {
+			switch d := editDistance(name, candidate); {
+			case d < best:
+				best = d
+				names = []string{c.name}
+			case d == best && len(names) > 0 && names[len(names)-1] != c.name:
+				names = append(names, c.name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// pathPermission is the strictest permission of a command and its parents
+func pathPermission(path []*command) permission {
+	p := permEveryone
+	for _, c := range path {
+		p = max(p, c.permission)
+	}
+	return p
+}
+
+// fmtName formats a command's full name, e.g. "set embed"
+func fmtName(path []*command) string {
+	var words []string
+	for _, c := range path {
+		words = append(words, c.name)
+	}
+	return strings.Join(words, " ")
+}
+
+// fmtUsage formats a command's full usage, e.g. "set embed <on|off|inherit> [id]"
+func fmtUsage(path []*command) string {
+	words := []string{fmtName(path)}
+	last := path[len(path)-1]
+	if last.usage != "" {
+		words = append(words, last.usage)
+	} else if len(last.subcommands) > 0 {
+		words = append(words, "<"+strings.Join(subcommandNames(last), "|")+">")
+	}
+	return strings.Join(words, " ")
+}
+
+func subcommandNames(c *command) []string {
+	var names []string
+	for _, sub := range c.subcommands {
+		if !sub.hidden {
+			names = append(names, sub.name)
+		}
+	}
+	return names
+}
+
+// fmtCommandList lists the visible commands, and their subcommands, for help
+func fmtCommandList(b *strings.Builder, path []*command, commands []*command) {
+	for _, c := range commands {
+		if c.hidden {
+			continue
+		}
+		full := append(path[:len(path):len(path)], c)
+		if c.handler != nil || len(c.subcommands) == 0 {
+			fmt.Fprintf(b, "- `%s`: %s\n", fmtUsage(full), c.description)
+		}
+		fmtCommandList(b, full, c.subcommands)
+	}
+}
+
+// fmtCommandHelp describes a single command in detail, for help <command>
+func fmtCommandHelp(path []*command) string {
+	c := path[len(path)-1]
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "**usage:** `%s`\n%s\n", fmtUsage(path), c.description)
+	if len(c.aliases) > 0 {
+		fmt.Fprintf(&b, "**aliases:** %s\n", strings.Join(c.aliases, ", "))
+	}
+	if p := pathPermission(path); p != permEveryone {
+		fmt.Fprintf(&b, "%s\n", p)
+	}
+	if len(c.subcommands) > 0 {
+		b.WriteString("\n**subcommands:**\n")
+		fmtCommandList(&b, path, c.subcommands)
+	}
+	return b.String()
+}
@@ -0,0 +1,141 @@
+package feedbot
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxPrefixLen is the longest prefix a guild may set
+	maxPrefixLen = 16
+	// prefixTTL is how long a guild's prefix is cached; another instance may answer the
+	// command which changes it, so it is reloaded once this passes
+	prefixTTL = time.Minute
+)
+
+// router resolves which command, if any, a message invokes. A command is invoked by a
+// mention of the bot, which always works, or by the guild's prefix; the bot's default
+// prefix is used in direct messages and guilds which haven't set one.
+type router struct {
+	storage  Storage
+	prefix   string
+	commands *registry
+
+	// mu guards everything below, which is learned once the session is ready
+	mu       sync.RWMutex
+	mentions []string
+	owner    string
+	// prefixes caches each guild's prefix, empty for the default, as messages arrive
+	prefixes map[string]cachedPrefix
+}
+
+type cachedPrefix struct {
+	prefix  string
+	expires time.Time
+}
+
+func newRouter(storage Storage, prefix string) *router {
+	return &router{
+		storage:  storage,
+		prefix:   prefix,
+		commands: newCommands(),
+		prefixes: map[string]cachedPrefix{},
+	}
+}
+
+// ready records the bot's user, and the owner of its application
+func (r *router) ready(user *discordgo.User, owner string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// clients mention a user with a nickname as <@!id>
+	r.mentions = []string{"<@" + user.ID + ">", "<@!" + user.ID + ">"}
+	r.owner = owner
+}
+
+// isOwner reports whether a user owns the bot's application
+func (r *router) isOwner(userID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.owner != "" && r.owner == userID
+}
+
+// route splits a message invoking a command into words, the first of which names the
+// command; words is empty when the message isn't a command
+func (r *router) route(ctx context.Context, m *discordgo.Message) (words []string, err error) {
+	content, ok := r.trimMention(m.Content)
+	if !ok {
+		prefix, err := r.guildPrefix(ctx, m.GuildID)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(m.Content, prefix) {
+			return nil, nil
+		}
+		content = m.Content[len(prefix):]
+	}
+	return strings.Split(content, " "), nil
+}
+
+func (r *router) trimMention(content string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, mention := range r.mentions {
+		if strings.HasPrefix(content, mention) {
+			return strings.TrimLeft(content[len(mention):], " "), true
+		}
+	}
+	return "", false
+}
+
+// guildPrefix gets the prefix commands in a guild start with
+func (r *router) guildPrefix(ctx context.Context, guildID string) (string, error) {
+	if guildID == "" {
+		return r.prefix, nil
+	}
+
+	r.mu.RLock()
+	cached, ok := r.prefixes[guildID]
+	r.mu.RUnlock()
+	prefix := cached.prefix
+	if !ok || time.Now().After(cached.expires) {
+		prefix = ""
+		gc, err := r.storage.GetGuildConfig(ctx, guildID)
+		if err != nil && errors.Cause(err) != sql.ErrNoRows {
+			return "", err
+		}
+		if gc != nil {
+			prefix = gc.Prefix
+		}
+		r.setPrefix(guildID, prefix)
+	}
+
+	if prefix == "" {
+		return r.prefix, nil
+	}
+	return prefix, nil
+}
+
+// setPrefix records a guild's new prefix; an empty prefix restores the default
+func (r *router) setPrefix(guildID, prefix string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prefixes[guildID] = cachedPrefix{prefix: prefix, expires: time.Now().Add(prefixTTL)}
+}
+
+// forget drops a guild's cached prefix, once the bot leaves it
+func (r *router) forget(guildID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.prefixes, guildID)
+}
+
+// validPrefix reports whether a prefix can be typed at the start of a message
+func validPrefix(prefix string) bool {
+	return prefix != "" && len(prefix) <= maxPrefixLen && !strings.ContainsAny(prefix, " \t\n`")
+}
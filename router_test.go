@@ -0,0 +1,40 @@
+package feedbot
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestGuildPrefix checks that a prefix changed through another instance is picked up once
+// the cached one expires
+func TestGuildPrefix(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	if err := storage.CreateGuildConfig(ctx, "1", "u:2"); err != nil {
+		t.Fatal(err)
+	}
+	r := newRouter(storage, "f!")
+
+	prefix := func(guildID, want string) {
+		t.Helper()
+		if got, err := r.guildPrefix(ctx, guildID); err != nil || got != want {
+			t.Errorf("guild %q has prefix %q (%v), expected %q", guildID, got, err, want)
+		}
+	}
+	prefix("", "f!")
+	prefix("1", "f!")
+	// a guild without a config uses the default
+	prefix("3", "f!")
+
+	if err := storage.ModifyGuildPrefix(ctx, "1", "?"); err != nil {
+		t.Fatal(err)
+	}
+	prefix("1", "f!")
+	r.prefixes["1"] = cachedPrefix{expires: time.Now().Add(-time.Second)}
+	prefix("1", "?")
+
+	// this instance's own changes apply at once
+	r.setPrefix("1", "")
+	prefix("1", "f!")
+}
@@ -0,0 +1,216 @@
+package feedbot
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+)
+
+// identifyInterval is how long Discord requires between shards identifying
+const identifyInterval = 5 * time.Second
+
+// ShardConfig contains which of the bot's gateway shards this process runs
+type ShardConfig struct {
+	// Count is how many shards the bot has in total; zero asks Discord how many it
+	// recommends
+	Count int
+	// IDs are the shards this process runs; empty means every shard
+	IDs []int
+}
+
+// shards are the bot's gateway sessions, one for each shard this process runs. Every
+// session shares the handlers added to the shards; REST requests for a guild are sent
+// through its shard's session, or the first session if another process runs it.
+type shards struct {
+	token  string
+	config ShardConfig
+
+	// mu guards everything below, which is only written once the shards are opened
+	mu       sync.RWMutex
+	count    int
+	sessions []*discordgo.Session
+	ready    []bool
+	handlers []interface{}
+}
+
+// newShards creates the first session, which is used for REST requests until the shards
+// are opened
+func newShards(token string, config ShardConfig) (*shards, error) {
+	s, err := discordgo.New(token)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &shards{
+		token:    token,
+		config:   config,
+		count:    1,
+		sessions: []*discordgo.Session{s},
+		ready:    []bool{false},
+	}, nil
+}
+
+// addHandler adds an event handler to every session, including those opened later
+func (sh *shards) addHandler(handler interface{}) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.handlers = append(sh.handlers, handler)
+	for _, s := range sh.sessions {
+		s.AddHandler(handler)
+	}
+}
+
+// create creates a session for every shard this process runs, without connecting them;
+// it returns their IDs, and how many shards the bot has in total
+func (sh *shards) create() (ids []int, count int, err error) {
+	count = sh.config.Count
+	if count == 0 {
+		gw, err := sh.session(0).GatewayBot()
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "couldn't get the recommended shard count")
+		}
+		count = max(gw.Shards, 1)
+	}
+	ids = sh.config.IDs
+	if len(ids) == 0 {
+		for id := 0; id < count; id++ {
+			ids = append(ids, id)
+		}
+	}
+
+	sh.mu.Lock()
+	sh.count = count
+	sh.ready = make([]bool, len(ids))
+	for i, id := range ids {
+		if i > 0 {
+			s, err := discordgo.New(sh.token)
+			if err != nil {
+				sh.mu.Unlock()
+				return nil, 0, errors.WithStack(err)
+			}
+			for _, h := range sh.handlers {
+				s.AddHandler(h)
+			}
+			sh.sessions = append(sh.sessions, s)
+		}
+		sh.sessions[i].ShardID = id
+		sh.sessions[i].ShardCount = count
+	}
+	sh.mu.Unlock()
+	return ids, count, nil
+}
+
+// open connects the shards create created, one at a time as Discord requires
+func (sh *shards) open() error {
+	sh.mu.RLock()
+	sessions := sh.sessions
+	sh.mu.RUnlock()
+
+	for i, s := range sessions {
+		if i > 0 {
+			time.Sleep(identifyInterval)
+		}
+		if err := s.Open(); err != nil {
+			return errors.Wrapf(err, "couldn't open shard %d", s.ShardID)
+		}
+	}
+	return nil
+}
+
+// close disconnects every shard
+func (sh *shards) close() error {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	var first error
+	for _, s := range sh.sessions {
+		if err := s.Close(); err != nil && first == nil {
+			first = errors.Wrapf(err, "couldn't close shard %d", s.ShardID)
+		}
+	}
+	return first
+}
+
+func (sh *shards) session(i int) *discordgo.Session {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.sessions[i]
+}
+
+// forGuild finds the session of the shard a guild is on
+func (sh *shards) forGuild(guildID string) *discordgo.Session {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	id, err := strconv.ParseUint(guildID, 10, 64)
+	if err != nil {
+		return sh.sessions[0]
+	}
+	shard := int((id >> 22) % uint64(sh.count))
+	for _, s := range sh.sessions {
+		if s.ShardID == shard {
+			return s
+		}
+	}
+	return sh.sessions[0]
+}
+
+// setReady records whether a session is connected and has received READY
+func (sh *shards) setReady(s *discordgo.Session, ready bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for i := range sh.sessions {
+		if sh.sessions[i] == s {
+			sh.ready[i] = ready
+		}
+	}
+}
+
+// setAllReady sets every session's readiness at once, e.g. when shutting down
+func (sh *shards) setAllReady(ready bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for i := range sh.ready {
+		sh.ready[i] = ready
+	}
+}
+
+// allReady reports whether every shard this process runs is ready
+func (sh *shards) allReady() bool {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	for _, ready := range sh.ready {
+		if !ready {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseShardIDs parses a list of shard IDs, each either a single ID such as "3" or an
+// inclusive range such as "0-7"
+func ParseShardIDs(list []string) ([]int, error) {
+	var ids []int
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(s, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil || first < 0 {
+			return nil, errors.Errorf("invalid shard ID %q", s)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(to); err != nil || last < first {
+				return nil, errors.Errorf("invalid shard range %q", s)
+			}
+		}
+		for id := first; id <= last; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
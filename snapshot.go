@@ -0,0 +1,209 @@
+package feedbot
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+)
+
+const (
+	// snapshotVersion is the version of the guild snapshot format; newer snapshots are
+	// refused, since they may hold settings this version would silently drop
+	snapshotVersion = 1
+	// maxSnapshotSize is the largest guild snapshot which may be imported
+	maxSnapshotSize = 1 << 20
+)
+
+// guildSnapshot is everything a guild has configured, as written by export config and
+// read by import config. Feed credentials aren't included, since they are sealed with the
+// bot's key, and shouldn't be handed to whoever can read the channel.
+type guildSnapshot struct {
+	Version       int                    `json:"version"`
+	Exported      time.Time              `json:"exported"`
+	GuildID       string                 `json:"guild_id"`
+	Config        snapshotConfig         `json:"config"`
+	Subscriptions []snapshotSubscription `json:"subscriptions"`
+}
+
+type snapshotConfig struct {
+	Contact  string `json:"contact"`
+	Embeds   bool   `json:"embeds"`
+	Webhooks bool   `json:"webhooks"`
+	// Prefix is empty when the guild uses the bot's default
+	Prefix string `json:"prefix"`
+}
+
+type snapshotSubscription struct {
+	ChannelID string `json:"channel_id"`
+	// ChannelName finds the channel when the snapshot is imported into another guild
+	ChannelName string `json:"channel_name,omitempty"`
+	Feed        string `json:"feed"`
+	// Embeds and Webhooks override the guild's config; null inherits it
+	Embeds   *bool `json:"embeds"`
+	Webhooks *bool `json:"webhooks"`
+}
+
+// newGuildSnapshot takes a snapshot of a guild; names maps channel IDs to their names
+func newGuildSnapshot(gc *GuildConfig, subs []Subscription, names map[string]string) *guildSnapshot {
+	snap := &guildSnapshot{
+		Version:  snapshotVersion,
+		Exported: time.Now().UTC(),
+		GuildID:  gc.ID,
+		Config: snapshotConfig{
+			Contact:  gc.Contact,
+			Embeds:   gc.Embeds,
+			Webhooks: gc.Webhooks,
+			Prefix:   gc.Prefix,
+		},
+		Subscriptions: []snapshotSubscription{},
+	}
+	for _, s := range subs {
+		snap.Subscriptions = append(snap.Subscriptions, snapshotSubscription{
+			ChannelID:   s.ChannelID,
+			ChannelName: names[s.ChannelID],
+			Feed:        s.Feed.URI,
+			Embeds:      boolPtr(s.Overwrite.Embeds),
+			Webhooks:    boolPtr(s.Overwrite.Webhooks),
+		})
+	}
+	return snap
+}
+
+// parseGuildSnapshot reads a snapshot, and checks that this version can import it
+func parseGuildSnapshot(r io.Reader) (*guildSnapshot, error) {
+	var snap guildSnapshot
+	if err := json.NewDecoder(io.LimitReader(r, maxSnapshotSize)).Decode(&snap); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse the snapshot")
+	}
+	switch {
+	case snap.Version == 0:
+		return nil, errors.New("it isn't a feedbot snapshot")
+	case snap.Version > snapshotVersion:
+		return nil, errors.Errorf("it is version %d, this bot only understands up to version %d", snap.Version, snapshotVersion)
+	case snap.Config.Prefix != "" && !validPrefix(snap.Config.Prefix):
+		return nil, errors.Errorf("its prefix %q is invalid", snap.Config.Prefix)
+	case !strings.HasPrefix(snap.Config.Contact, "u:") && !strings.HasPrefix(snap.Config.Contact, "c:"):
+		return nil, errors.Errorf("its contact %q is invalid", snap.Config.Contact)
+	}
+	return &snap, nil
+}
+
+// snapshotPlan is what importing a snapshot into a guild would change. Nothing is
+// removed, so a snapshot taken before a subscription was added can't destroy it.
+type snapshotPlan struct {
+	// config is the guild's config once imported
+	config  GuildConfig
+	changed bool
+	add     []snapshotSubscription
+	modify  []plannedOverwrite
+	// lines describe the plan, one change per line
+	lines []string
+}
+
+type plannedOverwrite struct {
+	subID    int
+	embeds   sql.NullBool
+	webhooks sql.NullBool
+}
+
+// planSnapshot works out how to import a snapshot into a guild, given its config,
+// subscriptions and text channels. A subscription's channel is found by its ID, or else
+// by its name, when the snapshot came from another guild.
+func planSnapshot(gc *GuildConfig, subs []Subscription, snap *guildSnapshot, channels []*discordgo.Channel) *snapshotPlan {
+	ids := map[string]bool{}
+	byName := map[string]string{}
+	for _, c := range channels {
+		ids[c.ID] = true
+		byName[c.Name] = c.ID
+	}
+
+	p := &snapshotPlan{config: *gc}
+	change := func(name string, from, to interface{}) {
+		if from != to {
+			p.changed = true
+			p.lines = append(p.lines, fmt.Sprintf("~ %s: `%v` → `%v`", name, from, to))
+		}
+	}
+	if contact := snap.Config.Contact; strings.HasPrefix(contact, "c:") && !ids[contact[2:]] {
+		p.lines = append(p.lines, fmt.Sprintf("! contact: <#%s> isn't in this guild, keeping `%s`", contact[2:], gc.Contact))
+	} else {
+		change("contact", gc.Contact, contact)
+		p.config.Contact = contact
+	}
+	change("embeds", gc.Embeds, snap.Config.Embeds)
+	change("webhooks", gc.Webhooks, snap.Config.Webhooks)
+	change("prefix", fmtPrefix(gc.Prefix), fmtPrefix(snap.Config.Prefix))
+	p.config.Embeds = snap.Config.Embeds
+	p.config.Webhooks = snap.Config.Webhooks
+	p.config.Prefix = snap.Config.Prefix
+
+	existing := map[string]Subscription{}
+	for _, s := range subs {
+		existing[s.ChannelID+" "+s.Feed.URI] = s
+	}
+	seen := map[string]bool{}
+	for _, s := range snap.Subscriptions {
+		channel := s.ChannelID
+		if !ids[channel] {
+			if channel = byName[s.ChannelName]; channel == "" {
+				p.lines = append(p.lines, fmt.Sprintf("! `%s`: there's no channel <#%s> or #%s here, skipping", s.Feed, s.ChannelID, s.ChannelName))
+				continue
+			}
+		}
+		key := channel + " " + s.Feed
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		embeds, webhooks := nullBool(s.Embeds), nullBool(s.Webhooks)
+		cur, ok := existing[key]
+		if !ok {
+			s.ChannelID = channel
+			p.add = append(p.add, s)
+			p.lines = append(p.lines, fmt.Sprintf("+ <#%s> `%s` (embeds %s, webhooks %s)", channel, s.Feed, fmtBool(embeds), fmtBool(webhooks)))
+			continue
+		}
+		if cur.Overwrite.Embeds != embeds || cur.Overwrite.Webhooks != webhooks {
+			p.modify = append(p.modify, plannedOverwrite{subID: cur.ID, embeds: embeds, webhooks: webhooks})
+			p.lines = append(p.lines, fmt.Sprintf("~ #%d <#%s> `%s`: embeds %s → %s, webhooks %s → %s", cur.ID, channel, s.Feed,
+				fmtBool(cur.Overwrite.Embeds), fmtBool(embeds), fmtBool(cur.Overwrite.Webhooks), fmtBool(webhooks)))
+		}
+	}
+	if kept := len(subs) - len(seen) + len(p.add); kept > 0 {
+		p.lines = append(p.lines, fmt.Sprintf("%d subscriptions which aren't in the snapshot are kept.", kept))
+	}
+	return p
+}
+
+// empty reports whether importing would change nothing
+func (p *snapshotPlan) empty() bool {
+	return !p.changed && len(p.add) == 0 && len(p.modify) == 0
+}
+
+func fmtPrefix(prefix string) string {
+	if prefix == "" {
+		return "default"
+	}
+	return prefix
+}
+
+func boolPtr(v sql.NullBool) *bool {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Bool
+}
+
+func nullBool(v *bool) sql.NullBool {
+	if v == nil {
+		return sql.NullBool{}
+	}
+	return sql.NullBool{Bool: *v, Valid: true}
+}
@@ -0,0 +1,100 @@
+package feedbot
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestParseGuildSnapshot(t *testing.T) {
+	for _, tt := range []struct {
+		doc string
+		ok  bool
+	}{
+		{`{"version": 1, "config": {"contact": "u:1"}}`, true},
+		{`{"version": 1, "config": {"contact": "c:1", "prefix": "!"}}`, true},
+		{`{"config": {"contact": "u:1"}}`, false},
+		{`{"version": 2, "config": {"contact": "u:1"}}`, false},
+		{`{"version": 1, "config": {"contact": "1"}}`, false},
+		{`{"version": 1, "config": {"contact": "u:1", "prefix": "` + strings.Repeat("!", 100) + `"}}`, false},
+		{`{"version": 1`, false},
+	} {
+		_, err := parseGuildSnapshot(strings.NewReader(tt.doc))
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: parsed %v, expected %v (%v)", tt.doc, ok, tt.ok, err)
+		}
+	}
+
+	// a snapshot round trips through JSON
+	gc := &GuildConfig{ID: "1", Contact: "u:2", Embeds: true, Prefix: "?"}
+	subs := []Subscription{{
+		ChannelID: "10",
+		Feed:      &Feed{URI: "https://example.com/feed.xml"},
+		Overwrite: &Overwrite{Webhooks: sql.NullBool{Bool: true, Valid: true}},
+	}}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(newGuildSnapshot(gc, subs, map[string]string{"10": "news"})); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := parseGuildSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := snap.Subscriptions[0]
+	if s.ChannelName != "news" || s.Embeds != nil || s.Webhooks == nil || !*s.Webhooks {
+		t.Errorf("subscription came back as %+v", s)
+	}
+}
+
+func TestPlanSnapshot(t *testing.T) {
+	yes := true
+	gc := &GuildConfig{ID: "1", Contact: "u:2"}
+	subs := []Subscription{
+		{ID: 1, ChannelID: "10", Feed: &Feed{URI: "a"}, Overwrite: &Overwrite{}},
+		{ID: 2, ChannelID: "11", Feed: &Feed{URI: "b"}, Overwrite: &Overwrite{}},
+	}
+	channels := []*discordgo.Channel{{ID: "10", Name: "news"}, {ID: "11", Name: "blogs"}}
+
+	// a snapshot from another guild: its channels are matched by name
+	snap := &guildSnapshot{
+		Version: snapshotVersion,
+		Config:  snapshotConfig{Contact: "c:99", Embeds: true},
+		Subscriptions: []snapshotSubscription{
+			{ChannelID: "90", ChannelName: "news", Feed: "a"},
+			{ChannelID: "90", ChannelName: "news", Feed: "c"},
+			{ChannelID: "90", ChannelName: "news", Feed: "c"},
+			{ChannelID: "10", Feed: "a", Embeds: &yes},
+			{ChannelID: "91", ChannelName: "blogs", Feed: "b", Webhooks: &yes},
+			{ChannelID: "92", ChannelName: "gone", Feed: "d"},
+		},
+	}
+	p := planSnapshot(gc, subs, snap, channels)
+
+	// the contact channel isn't in this guild, so the contact is kept
+	if p.config.Contact != "u:2" || !p.config.Embeds || !p.changed {
+		t.Errorf("planned config %+v, changed %v", p.config, p.changed)
+	}
+	if len(p.add) != 1 || p.add[0].ChannelID != "10" || p.add[0].Feed != "c" {
+		t.Errorf("planned to add %+v", p.add)
+	}
+	// the first entry for a channel and feed wins
+	if len(p.modify) != 1 || p.modify[0].subID != 2 || p.modify[0].webhooks != (sql.NullBool{Bool: true, Valid: true}) {
+		t.Errorf("planned to modify %+v", p.modify)
+	}
+	plan := strings.Join(p.lines, "\n")
+	for _, want := range []string{"! contact: <#99>", "#gone here, skipping", "~ embeds: `false` → `true`"} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("plan doesn't mention %q:\n%s", want, plan)
+		}
+	}
+
+	// importing a guild's own snapshot changes nothing
+	own := newGuildSnapshot(gc, subs, map[string]string{"10": "news", "11": "blogs"})
+	if p := planSnapshot(gc, subs, own, channels); !p.empty() {
+		t.Errorf("own snapshot planned %s", strings.Join(p.lines, "\n"))
+	}
+}
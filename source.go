@@ -0,0 +1,358 @@
+package feedbot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/pkg/errors"
+)
+
+// Source produces the items of a feed, most recent first; Fetch gives up once ctx is done
+type Source interface {
+	Fetch(ctx context.Context) (*gofeed.Feed, error)
+}
+
+var (
+	// ErrLocalSourcesDisabled is returned when a file or command feed is used, but the
+	// operator has not enabled them
+	ErrLocalSourcesDisabled = errors.New("local sources are disabled")
+)
+
+// Source kinds, derived from the scheme of a feed's URI:
+//   - http(s)://: a remote RSS, Atom or JSON Feed
+//   - json+http(s)://: a JSON API; items and their fields are selected with JSONPath
+//     expressions in the fragment, e.g. json+https://example.com/api#items=$.data[*]&link=$.html_url
+//   - file:///path: a local RSS, Atom or JSON Feed file
+//   - exec:///path?arg=a&arg=b: the output of a local command, as RSS, Atom or JSON Feed
+const (
+	SourceFeed    = "feed"
+	SourceJSON    = "json"
+	SourceFile    = "file"
+	SourceCommand = "exec"
+)
+
+// SourceKind returns the kind of Source a URI describes
+func SourceKind(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return SourceFeed, nil
+	case "json+http", "json+https":
+		return SourceJSON, nil
+	case "file":
+		return SourceFile, nil
+	case "exec":
+		return SourceCommand, nil
+	}
+	return "", ErrSchemeNotAllowed
+}
+
+// IsLocalSource returns true for kinds which read from the bot's own machine
+func IsLocalSource(kind string) bool {
+	return kind == SourceFile || kind == SourceCommand
+}
+
+// Sources creates the Source for each feed
+type Sources struct {
+	fetcher *Fetcher
+	local   bool
+}
+
+// NewSources creates a new Sources; file and command feeds are refused unless local is set
+func NewSources(f *Fetcher, local bool) *Sources {
+	return &Sources{
+		fetcher: f,
+		local:   local,
+	}
+}
+
+// Validate checks that a URI describes a Source which may be opened
+func (s *Sources) Validate(uri string) error {
+	kind, err := SourceKind(uri)
+	if err != nil {
+		return err
+	}
+	if IsLocalSource(kind) && !s.local {
+		return ErrLocalSourcesDisabled
+	}
+	switch kind {
+	case SourceFeed:
+		return ValidateURI(uri)
+	case SourceJSON:
+		_, err = newJSONSource(s.fetcher, uri, nil)
+		return err
+	}
+	return nil
+}
+
+// Open creates the Source for a URI; auth may be nil
+func (s *Sources) Open(uri string, auth *FeedAuth) (Source, error) {
+	if err := s.Validate(uri); err != nil {
+		return nil, err
+	}
+	kind, _ := SourceKind(uri)
+	switch kind {
+	case SourceJSON:
+		return newJSONSource(s.fetcher, uri, auth)
+	case SourceFile:
+		return &fileSource{uri: uri, maxSize: s.fetcher.config.MaxSize}, nil
+	case SourceCommand:
+		return &commandSource{uri: uri, maxSize: s.fetcher.config.MaxSize, timeout: s.fetcher.config.Timeout}, nil
+	}
+	return &feedSource{fetcher: s.fetcher, uri: uri, auth: auth}, nil
+}
+
+// feedSource is a remote RSS, Atom or JSON Feed
+type feedSource struct {
+	fetcher *Fetcher
+	uri     string
+	auth    *FeedAuth
+}
+
+func (s *feedSource) Fetch(ctx context.Context) (*gofeed.Feed, error) {
+	return s.fetcher.Feed(ctx, s.uri, s.auth)
+}
+
+// fileSource is an RSS, Atom or JSON Feed on the local filesystem
+type fileSource struct {
+	uri     string
+	maxSize int64
+}
+
+func (s *fileSource) Fetch(ctx context.Context) (*gofeed.Feed, error) {
+	u, err := url.Parse(s.uri)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	file, err := os.Open(u.Path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	feed, err := gofeed.NewParser().Parse(&limitedBody{ReadCloser: file, remaining: s.maxSize})
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse feed at %s", s.uri)
+	}
+	return feed, nil
+}
+
+// commandSource runs a local command, and parses its output as a feed
+type commandSource struct {
+	uri     string
+	maxSize int64
+	timeout time.Duration
+}
+
+func (s *commandSource) Fetch(ctx context.Context) (*gofeed.Feed, error) {
+	u, err := url.Parse(s.uri)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// the command is killed once it runs past the timeout, or ctx is done
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, u.Path, u.Query()["arg"]...)
+	cmd.Stdout = &cappedWriter{w: &stdout, remaining: s.maxSize}
+	cmd.Stderr = &cappedWriter{w: &stderr, remaining: 4096}
+	if err = cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "%s failed: %s", u.Path, strings.TrimSpace(stderr.String()))
+	}
+
+	feed, err := gofeed.NewParser().Parse(&stdout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse output of %s", u.Path)
+	}
+	return feed, nil
+}
+
+// cappedWriter fails once more than remaining bytes are written to it
+type cappedWriter struct {
+	w         *bytes.Buffer
+	remaining int64
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > c.remaining {
+		return 0, ErrResponseTooLarge
+	}
+	c.remaining -= int64(len(p))
+	return c.w.Write(p)
+}
+
+// jsonSource is a JSON API which doesn't publish a feed; each field of an item is
+// found by evaluating a JSONPath expression relative to that item.
+type jsonSource struct {
+	fetcher *Fetcher
+	uri     string
+	auth    *FeedAuth
+
+	items       []jsonStep
+	title       []jsonStep
+	link        []jsonStep
+	id          []jsonStep
+	published   []jsonStep
+	description []jsonStep
+}
+
+// jsonDefaults are the expressions used for any field not given in the URI's fragment
+var jsonDefaults = map[string]string{
+	"items":       "$[*]",
+	"title":       "$.title",
+	"link":        "$.url",
+	"id":          "$.id",
+	"published":   "$.published",
+	"description": "$.description",
+}
+
+func newJSONSource(f *Fetcher, uri string, auth *FeedAuth) (*jsonSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	opts, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid json source options")
+	}
+	u.Scheme = strings.TrimPrefix(u.Scheme, "json+")
+	u.Fragment = ""
+
+	s := &jsonSource{
+		fetcher: f,
+		uri:     u.String(),
+		auth:    auth,
+	}
+	fields := map[string]*[]jsonStep{
+		"items":       &s.items,
+		"title":       &s.title,
+		"link":        &s.link,
+		"id":          &s.id,
+		"published":   &s.published,
+		"description": &s.description,
+	}
+	for k := range opts {
+		if _, ok := fields[k]; !ok {
+			return nil, errors.Errorf("unknown json source option %q", k)
+		}
+	}
+	for k, dst := range fields {
+		expr := opts.Get(k)
+		if expr == "" {
+			expr = jsonDefaults[k]
+		}
+		if *dst, err = parseJSONPath(expr); err != nil {
+			return nil, errors.Wrapf(err, "invalid expression for %s", k)
+		}
+	}
+	return s, ValidateURI(s.uri)
+}
+
+func (s *jsonSource) Fetch(ctx context.Context) (*gofeed.Feed, error) {
+	body, err := s.fetcher.Get(ctx, s.uri, s.auth)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var doc interface{}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	if err = dec.Decode(&doc); err != nil {
+		return nil, errors.Wrapf(err, "couldn't decode json at %s", s.uri)
+	}
+
+	feed := &gofeed.Feed{
+		Link:     s.uri,
+		FeedType: SourceJSON,
+	}
+	for _, v := range evalJSONPath(doc, s.items) {
+		item := &gofeed.Item{
+			Title:       jsonString(v, s.title),
+			Link:        jsonString(v, s.link),
+			GUID:        jsonString(v, s.id),
+			Description: jsonString(v, s.description),
+		}
+		if item.GUID == "" {
+			item.GUID = item.Link
+		}
+		if t, ok := jsonTime(v, s.published); ok {
+			item.Published = t.Format(time.RFC3339)
+			item.PublishedParsed = &t
+		}
+		feed.Items = append(feed.Items, item)
+	}
+
+	// APIs make no promises about ordering; the checker expects the newest item first
+	sort.SliceStable(feed.Items, func(i, j int) bool {
+		a, b := feed.Items[i].PublishedParsed, feed.Items[j].PublishedParsed
+		return a != nil && (b == nil || a.After(*b))
+	})
+	return feed, nil
+}
+
+// jsonString evaluates path against v, returning the first match as a string
+func jsonString(v interface{}, path []jsonStep) string {
+	matches := evalJSONPath(v, path)
+	if len(matches) == 0 {
+		return ""
+	}
+	switch t := matches[0].(type) {
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	return ""
+}
+
+var jsonTimeLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC1123Z,
+	time.RFC1123,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// jsonTime evaluates path against v, accepting common date formats or a unix timestamp
+func jsonTime(v interface{}, path []jsonStep) (time.Time, bool) {
+	matches := evalJSONPath(v, path)
+	if len(matches) == 0 {
+		return time.Time{}, false
+	}
+	switch t := matches[0].(type) {
+	case string:
+		for _, layout := range jsonTimeLayouts {
+			if parsed, err := time.Parse(layout, t); err == nil {
+				return parsed, true
+			}
+		}
+	case json.Number:
+		n, err := t.Int64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		// anything this large is surely milliseconds, not a date in the year 33658
+		if n > 1e12 {
+			return time.Unix(0, n*int64(time.Millisecond)), true
+		}
+		return time.Unix(n, 0), true
+	}
+	return time.Time{}, false
+}
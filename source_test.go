@@ -0,0 +1,75 @@
+package feedbot
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONSource(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, `{"data": [
+			{"name": "oldest", "html_url": "https://example.com/1", "created": "2020-01-01T00:00:00Z"},
+			{"name": "undated", "html_url": "https://example.com/2"},
+			{"name": "newest", "html_url": "https://example.com/3", "created": 1700000000000, "uid": 42},
+			{"name": "middle", "html_url": "https://example.com/4", "created": 1600000000}
+		]}`)
+	}))
+	defer s.Close()
+
+	f := newLoopbackFetcher(t, DefaultFetcherConfig)
+	base := "json+" + s.URL + "/api"
+	src, err := newJSONSource(f, base+"#items=$.data[*]&title=$.name&link=$.html_url&published=$.created&id=$.uid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.uri != s.URL+"/api" {
+		t.Errorf("source fetches %s", src.uri)
+	}
+	feed, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// newest first, whatever order the API returns them in, and undated items last
+	var titles, ids []string
+	for _, item := range feed.Items {
+		titles = append(titles, item.Title)
+		ids = append(ids, item.GUID)
+	}
+	if got := strings.Join(titles, " "); got != "newest middle oldest undated" {
+		t.Errorf("items are ordered %s", got)
+	}
+	// the ID falls back to the link
+	if got := strings.Join(ids, " "); got != "42 https://example.com/4 https://example.com/1 https://example.com/2" {
+		t.Errorf("item IDs are %s", got)
+	}
+	// timestamps in milliseconds, seconds and RFC 3339
+	for i, want := range []time.Time{
+		time.Unix(1700000000, 0),
+		time.Unix(1600000000, 0),
+		time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		if p := feed.Items[i].PublishedParsed; p == nil || !p.Equal(want) {
+			t.Errorf("%s was published %v, expected %v", feed.Items[i].Title, p, want)
+		}
+	}
+	if feed.Items[3].PublishedParsed != nil {
+		t.Errorf("undated item was published %v", feed.Items[3].PublishedParsed)
+	}
+
+	for _, uri := range []string{
+		base + "#colour=$.colour",
+		base + "#title=$..name",
+		base + "#items=$[",
+		"json+file:///etc/passwd",
+	} {
+		if _, err := newJSONSource(f, uri, nil); err == nil {
+			t.Errorf("%s was accepted", uri)
+		}
+	}
+}
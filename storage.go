@@ -0,0 +1,62 @@
+package feedbot
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Storage is everything feedbot keeps in its database. Controller implements it for
+// SQLite and Postgres, and MemoryStorage without a database; storagetest checks that
+// every implementation behaves the same.
+//
+// Every method takes the context of the command, check or delivery it was called for,
+// so that work can be abandoned when it times out or the bot shuts down.
+//
+// Getters for a single row return an error wrapping sql.ErrNoRows when it doesn't exist,
+// except where documented to return nil, nil instead.
+type Storage interface {
+	GetOrCreateFeed(ctx context.Context, uri string, guildID string) (*Feed, error)
+	PrivatizeFeed(ctx context.Context, feedID int, guildID string) (*Feed, error)
+	GetFeeds(ctx context.Context) ([]Feed, error)
+	GetFeed(ctx context.Context, id int) (*Feed, error)
+	UpdateFeedTimestamp(ctx context.Context, feed *Feed, timestamp *time.Time) error
+	MarkOrphanedFeeds(ctx context.Context, now time.Time) error
+	DestroyOrphanedFeeds(ctx context.Context, before, now time.Time) (int64, error)
+
+	GetFeedCredentials(ctx context.Context, feedID int) (*FeedCredentials, error)
+	SetFeedCredentials(ctx context.Context, feedID int, guildID string, data []byte) error
+	DestroyFeedCredentials(ctx context.Context, feedID int) error
+
+	GetWebSubSubscription(ctx context.Context, feedID int) (*WebSubSubscription, error)
+	GetExpiringWebSubSubscriptions(ctx context.Context, before time.Time) ([]WebSubSubscription, error)
+	SetWebSubSubscription(ctx context.Context, w *WebSubSubscription) error
+	DestroyWebSubSubscription(ctx context.Context, feedID int) error
+
+	AddSubscription(ctx context.Context, channelID, guildID string, feedID int) (*Subscription, error)
+	GetSubscription(ctx context.Context, id int) (*Subscription, error)
+	GetSubscriptions(ctx context.Context, guildID string) ([]Subscription, error)
+	GetFeedSubscriptions(ctx context.Context, feedID int) ([]Subscription, error)
+	ModifySubscriptionChannel(ctx context.Context, id int, channelID string) error
+	DestroySubscription(ctx context.Context, id int) error
+	PauseSubscription(ctx context.Context, id int, pause Pause) error
+	ResumeSubscription(ctx context.Context, id int) error
+	ModifyOverwriteEmbeds(ctx context.Context, subID int, embeds sql.NullBool) error
+	ModifyOverwriteWebhooks(ctx context.Context, subID int, webhooks sql.NullBool) error
+
+	CreateGuildConfig(ctx context.Context, guildID string, ownerContact string) error
+	MarkGuildLeft(ctx context.Context, guildID string, at time.Time) error
+	GetDepartedGuilds(ctx context.Context, before time.Time) ([]string, error)
+	GetGuildConfig(ctx context.Context, guildID string) (*GuildConfig, error)
+	ModifyGuildContact(ctx context.Context, guildID string, contact string) error
+	ModifyGuildEmbeds(ctx context.Context, guildID string, embeds bool) error
+	ModifyGuildWebhooks(ctx context.Context, guildID string, webhooks bool) error
+	ModifyGuildPrefix(ctx context.Context, guildID string, prefix string) error
+	DestroyGuildData(ctx context.Context, guildID string) error
+	ImportGuild(ctx context.Context, guildID string, imp GuildImport) (int, error)
+
+	GetStats(ctx context.Context) (*Stats, error)
+
+	AcquireLease(ctx context.Context, name, holder string, now time.Time, ttl time.Duration) (bool, error)
+	ReleaseLease(ctx context.Context, name, holder string) error
+}
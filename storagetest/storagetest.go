@@ -0,0 +1,898 @@
+// Package storagetest contains a conformance suite for feedbot.Storage implementations,
+// so every backend can be checked against the same expectations from its tests.
+package storagetest
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxbot/feedbot"
+	"github.com/pkg/errors"
+)
+
+// check is a single conformance check
+type check struct {
+	name string
+	run  func(ctx context.Context, s feedbot.Storage) error
+}
+
+// checks are run in order, against a single empty Storage; each uses its own feeds and
+// guilds, so they don't depend on one another.
+var checks = []check{
+	{"feeds", checkFeeds},
+	{"active feeds", checkActiveFeeds},
+	{"orphaned feeds", checkOrphanedFeeds},
+	{"feed credentials", checkFeedCredentials},
+	{"private feeds", checkPrivateFeeds},
+	{"websub", checkWebSub},
+	{"subscriptions", checkSubscriptions},
+	{"concurrent subscriptions", checkConcurrentSubscriptions},
+	{"paused subscriptions", checkPausedSubscriptions},
+	{"guild config", checkGuildConfig},
+	{"guild departure", checkGuildDeparture},
+	{"guild import", checkGuildImport},
+	{"stats", checkStats},
+	{"leases", checkLeases},
+}
+
+// Run runs every check against an empty Storage, each as a subtest of t
+func Run(t *testing.T, s feedbot.Storage) {
+	ctx := context.Background()
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.run(ctx, s); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		})
+	}
+}
+
+// Storage implementations may round times to the database's precision
+var epsilon = time.Millisecond
+
+func sameTime(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d < epsilon && d > -epsilon
+}
+
+func isNoRows(err error) bool {
+	return errors.Cause(err) == sql.ErrNoRows
+}
+
+func findFeed(ctx context.Context, s feedbot.Storage, id int) (*feedbot.Feed, error) {
+	feeds, err := s.GetFeeds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range feeds {
+		if f.ID == id {
+			return &f, nil
+		}
+	}
+	return nil, nil
+}
+
+func checkFeeds(ctx context.Context, s feedbot.Storage) error {
+	f, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/a", "")
+	if err != nil {
+		return err
+	}
+	if f.URI != "https://feeds.example.com/a" || !f.LastUpdated.IsZero() {
+		return errors.Errorf("new feed is %+v", f)
+	}
+	again, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/a", "")
+	if err != nil {
+		return err
+	}
+	if again.ID != f.ID {
+		return errors.Errorf("creating a feed twice gave ids %d and %d", f.ID, again.ID)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	if err = s.UpdateFeedTimestamp(ctx, f, &now); err != nil {
+		return err
+	}
+	got, err := s.GetFeed(ctx, f.ID)
+	if err != nil {
+		return err
+	}
+	if !sameTime(got.LastUpdated, now) {
+		return errors.Errorf("feed timestamp is %v, expected %v", got.LastUpdated, now)
+	}
+
+	if _, err = s.GetFeed(ctx, f.ID+1000); !isNoRows(err) {
+		return errors.Errorf("getting a missing feed returned %v", err)
+	}
+	return nil
+}
+
+func checkActiveFeeds(ctx context.Context, s feedbot.Storage) error {
+	f, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/active", "")
+	if err != nil {
+		return err
+	}
+	if got, err := findFeed(ctx, s, f.ID); err != nil || got != nil {
+		return errors.Errorf("feed without subscriptions was listed (err %v)", err)
+	}
+
+	if err = s.CreateGuildConfig(ctx, "active-guild", "owner"); err != nil {
+		return err
+	}
+	if _, err = s.AddSubscription(ctx, "active-channel", "active-guild", f.ID); err != nil {
+		return err
+	}
+	if got, err := findFeed(ctx, s, f.ID); err != nil || got == nil {
+		return errors.Errorf("subscribed feed wasn't listed (err %v)", err)
+	}
+	subs, err := s.GetFeedSubscriptions(ctx, f.ID)
+	if err != nil {
+		return err
+	}
+	if len(subs) != 1 || subs[0].ChannelID != "active-channel" || subs[0].GuildID != "active-guild" || subs[0].Overwrite == nil {
+		return errors.Errorf("feed's subscriptions are %+v", subs)
+	}
+
+	if err = s.MarkGuildLeft(ctx, "active-guild", time.Now()); err != nil {
+		return err
+	}
+	if got, err := findFeed(ctx, s, f.ID); err != nil || got != nil {
+		return errors.Errorf("feed subscribed only by a departed guild was listed (err %v)", err)
+	}
+	if subs, err = s.GetFeedSubscriptions(ctx, f.ID); err != nil || len(subs) != 0 {
+		return errors.Errorf("departed guild's subscriptions were listed: %+v (err %v)", subs, err)
+	}
+	return nil
+}
+
+func checkOrphanedFeeds(ctx context.Context, s feedbot.Storage) error {
+	kept, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/kept", "")
+	if err != nil {
+		return err
+	}
+	orphan, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/orphan", "")
+	if err != nil {
+		return err
+	}
+	if _, err = s.AddSubscription(ctx, "orphan-channel", "orphan-guild", kept.ID); err != nil {
+		return err
+	}
+	if err = s.SetFeedCredentials(ctx, orphan.ID, "orphan-guild", []byte("sealed")); err != nil {
+		return err
+	}
+	pushed, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/orphan-pushed", "")
+	if err != nil {
+		return err
+	}
+	lease := time.Now().Add(time.Hour)
+	w := &feedbot.WebSubSubscription{FeedID: pushed.ID, Hub: "https://hub.example.com", Topic: pushed.URI, Active: true, LeaseExpires: lease}
+	if err = s.SetWebSubSubscription(ctx, w); err != nil {
+		return err
+	}
+	expiring, err := s.GetExpiringWebSubSubscriptions(ctx, lease.Add(time.Hour))
+	if err != nil {
+		return err
+	}
+	for _, e := range expiring {
+		if e.FeedID == pushed.ID {
+			return errors.New("an orphaned feed's lease was listed for renewal")
+		}
+	}
+
+	marked := time.Now().Add(-time.Hour)
+	if err = s.MarkOrphanedFeeds(ctx, marked); err != nil {
+		return err
+	}
+	// feeds marked after the cutoff survive
+	if _, err = s.DestroyOrphanedFeeds(ctx, marked.Add(-time.Minute), time.Now()); err != nil {
+		return err
+	}
+	if _, err = s.GetFeed(ctx, orphan.ID); err != nil {
+		return errors.Wrap(err, "feed orphaned after the cutoff was destroyed")
+	}
+
+	if _, err = s.DestroyOrphanedFeeds(ctx, time.Now(), time.Now()); err != nil {
+		return err
+	}
+	if _, err = s.GetFeed(ctx, orphan.ID); !isNoRows(err) {
+		return errors.Errorf("orphaned feed wasn't destroyed (err %v)", err)
+	}
+	if _, err = s.GetFeed(ctx, pushed.ID); err != nil {
+		return errors.Wrap(err, "orphaned feed was destroyed while its hub's lease was running")
+	}
+	if _, err = s.DestroyOrphanedFeeds(ctx, time.Now(), lease.Add(time.Minute)); err != nil {
+		return err
+	}
+	if _, err = s.GetFeed(ctx, pushed.ID); !isNoRows(err) {
+		return errors.Errorf("orphaned feed wasn't destroyed once its lease lapsed (err %v)", err)
+	}
+	if c, err := s.GetFeedCredentials(ctx, orphan.ID); err != nil || c != nil {
+		return errors.Errorf("orphaned feed's credentials weren't destroyed (err %v)", err)
+	}
+	if _, err = s.GetFeed(ctx, kept.ID); err != nil {
+		return errors.Wrap(err, "subscribed feed was destroyed")
+	}
+	return nil
+}
+
+func checkFeedCredentials(ctx context.Context, s feedbot.Storage) error {
+	f, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/private", "")
+	if err != nil {
+		return err
+	}
+	if c, err := s.GetFeedCredentials(ctx, f.ID); err != nil || c != nil {
+		return errors.Errorf("feed without credentials returned %+v, %v", c, err)
+	}
+
+	for _, data := range []string{"first", "second"} {
+		if err = s.SetFeedCredentials(ctx, f.ID, "cred-guild", []byte(data)); err != nil {
+			return err
+		}
+		c, err := s.GetFeedCredentials(ctx, f.ID)
+		if err != nil {
+			return err
+		}
+		if c == nil || c.GuildID != "cred-guild" || string(c.Data) != data {
+			return errors.Errorf("credentials are %+v, expected %q", c, data)
+		}
+	}
+
+	if _, err = s.AddSubscription(ctx, "cred-channel", "cred-guild", f.ID); err != nil {
+		return err
+	}
+	got, err := findFeed(ctx, s, f.ID)
+	if err != nil {
+		return err
+	}
+	if got == nil || string(got.Credentials) != "second" {
+		return errors.Errorf("listed feed is %+v, expected its credentials", got)
+	}
+
+	if err = s.DestroyFeedCredentials(ctx, f.ID); err != nil {
+		return err
+	}
+	if c, err := s.GetFeedCredentials(ctx, f.ID); err != nil || c != nil {
+		return errors.Errorf("destroyed credentials returned %+v, %v", c, err)
+	}
+	return nil
+}
+
+func checkPrivateFeeds(ctx context.Context, s feedbot.Storage) error {
+	const uri = "https://feeds.example.com/privatized"
+	shared, err := s.GetOrCreateFeed(ctx, uri, "owner-guild")
+	if err != nil {
+		return err
+	}
+	if shared.GuildID != "" {
+		return errors.Errorf("new feed is private to %q", shared.GuildID)
+	}
+	mine, err := s.AddSubscription(ctx, "owner-channel", "owner-guild", shared.ID)
+	if err != nil {
+		return err
+	}
+	theirs, err := s.AddSubscription(ctx, "bystander-channel", "bystander-guild", shared.ID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Truncate(time.Second)
+	if err = s.UpdateFeedTimestamp(ctx, shared, &now); err != nil {
+		return err
+	}
+
+	private, err := s.PrivatizeFeed(ctx, shared.ID, "owner-guild")
+	if err != nil {
+		return err
+	}
+	if private.ID == shared.ID || private.URI != uri || private.GuildID != "owner-guild" || !sameTime(private.LastUpdated, now) {
+		return errors.Errorf("private feed is %+v", private)
+	}
+	if again, err := s.PrivatizeFeed(ctx, private.ID, "owner-guild"); err != nil || again.ID != private.ID {
+		return errors.Errorf("privatizing a private feed gave %+v, %v", again, err)
+	}
+	if got, err := s.GetSubscription(ctx, mine.ID); err != nil || got.FeedID != private.ID {
+		return errors.Errorf("owner's subscription is %+v (err %v), expected feed %d", got, err, private.ID)
+	}
+	if got, err := s.GetSubscription(ctx, theirs.ID); err != nil || got.FeedID != shared.ID {
+		return errors.Errorf("bystander's subscription is %+v (err %v), expected feed %d", got, err, shared.ID)
+	}
+
+	for guild, want := range map[string]int{"owner-guild": private.ID, "bystander-guild": shared.ID, "new-guild": shared.ID} {
+		f, err := s.GetOrCreateFeed(ctx, uri, guild)
+		if err != nil {
+			return err
+		}
+		if f.ID != want {
+			return errors.Errorf("%s got feed %d, expected %d", guild, f.ID, want)
+		}
+	}
+	if got, err := s.GetFeed(ctx, private.ID); err != nil || got.GuildID != "owner-guild" {
+		return errors.Errorf("private feed is %+v, %v", got, err)
+	}
+	return nil
+}
+
+func checkWebSub(ctx context.Context, s feedbot.Storage) error {
+	f, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/pushed", "")
+	if err != nil {
+		return err
+	}
+	if _, err = s.AddSubscription(ctx, "websub-channel", "websub-guild", f.ID); err != nil {
+		return err
+	}
+	if w, err := s.GetWebSubSubscription(ctx, f.ID); err != nil || w != nil {
+		return errors.Errorf("feed without websub returned %+v, %v", w, err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	w := &feedbot.WebSubSubscription{
+		FeedID:       f.ID,
+		Hub:          "https://hub.example.com",
+		Topic:        f.URI,
+		Secret:       "secret",
+		LeaseExpires: now,
+		Pending:      "first",
+	}
+	if err = s.SetWebSubSubscription(ctx, w); err != nil {
+		return err
+	}
+	got, err := findFeed(ctx, s, f.ID)
+	if err != nil {
+		return err
+	}
+	if got == nil || got.PushedUntil != nil {
+		return errors.Errorf("feed with a pending subscription is %+v, expected it to be polled", got)
+	}
+
+	w.Active = true
+	w.LeaseExpires = now.Add(time.Hour)
+	w.Callback, w.Pending = "first", ""
+	if err = s.SetWebSubSubscription(ctx, w); err != nil {
+		return err
+	}
+	stored, err := s.GetWebSubSubscription(ctx, f.ID)
+	if err != nil {
+		return err
+	}
+	if stored == nil || !stored.Active || stored.Secret != "secret" || !sameTime(stored.LeaseExpires, w.LeaseExpires) ||
+		stored.Callback != "first" || stored.Pending != "" {
+		return errors.Errorf("websub subscription is %+v, expected %+v", stored, w)
+	}
+	if got, err = findFeed(ctx, s, f.ID); err != nil {
+		return err
+	}
+	if got == nil || got.PushedUntil == nil || !sameTime(*got.PushedUntil, w.LeaseExpires) {
+		return errors.Errorf("feed with an active subscription is %+v", got)
+	}
+
+	expiring, err := s.GetExpiringWebSubSubscriptions(ctx, now.Add(30*time.Minute))
+	if err != nil {
+		return err
+	}
+	for _, e := range expiring {
+		if e.FeedID == f.ID {
+			return errors.New("lease expiring in an hour was listed as expiring within 30 minutes")
+		}
+	}
+	if expiring, err = s.GetExpiringWebSubSubscriptions(ctx, now.Add(2*time.Hour)); err != nil {
+		return err
+	}
+	found := false
+	for _, e := range expiring {
+		found = found || e.FeedID == f.ID
+	}
+	if !found {
+		return errors.New("lease expiring in an hour wasn't listed as expiring within 2 hours")
+	}
+
+	if err = s.DestroyWebSubSubscription(ctx, f.ID); err != nil {
+		return err
+	}
+	if w, err := s.GetWebSubSubscription(ctx, f.ID); err != nil || w != nil {
+		return errors.Errorf("destroyed websub returned %+v, %v", w, err)
+	}
+	return nil
+}
+
+func checkSubscriptions(ctx context.Context, s feedbot.Storage) error {
+	f, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/subs", "")
+	if err != nil {
+		return err
+	}
+	sub, err := s.AddSubscription(ctx, "sub-channel", "sub-guild", f.ID)
+	if err != nil {
+		return err
+	}
+	if dup, err := s.AddSubscription(ctx, "sub-channel", "sub-guild", f.ID); err != feedbot.ErrSubExists || dup == nil || dup.ID != sub.ID {
+		return errors.Errorf("duplicate subscription returned %+v, %v", dup, err)
+	}
+
+	got, err := s.GetSubscription(ctx, sub.ID)
+	if err != nil {
+		return err
+	}
+	if got.GuildID != "sub-guild" || got.ChannelID != "sub-channel" || got.FeedID != f.ID {
+		return errors.Errorf("subscription is %+v", got)
+	}
+	if _, err = s.GetSubscription(ctx, sub.ID+1000); !isNoRows(err) {
+		return errors.Errorf("getting a missing subscription returned %v", err)
+	}
+
+	other, err := s.AddSubscription(ctx, "other-channel", "other-guild", f.ID)
+	if err != nil {
+		return err
+	}
+
+	if err = s.ModifySubscriptionChannel(ctx, sub.ID, "moved-channel"); err != nil {
+		return err
+	}
+	if err = s.ModifyOverwriteEmbeds(ctx, sub.ID, sql.NullBool{Bool: true, Valid: true}); err != nil {
+		return err
+	}
+	if err = s.ModifyOverwriteWebhooks(ctx, sub.ID, sql.NullBool{Bool: false, Valid: true}); err != nil {
+		return err
+	}
+	subs, err := s.GetSubscriptions(ctx, "sub-guild")
+	if err != nil {
+		return err
+	}
+	if len(subs) != 1 {
+		return errors.Errorf("guild has %d subscriptions, expected 1", len(subs))
+	}
+	listed := subs[0]
+	if listed.ID != sub.ID || listed.ChannelID != "moved-channel" || listed.Feed == nil || listed.Feed.URI != f.URI {
+		return errors.Errorf("listed subscription is %+v", listed)
+	}
+	if listed.Overwrite == nil || listed.Overwrite.Embeds != (sql.NullBool{Bool: true, Valid: true}) ||
+		listed.Overwrite.Webhooks != (sql.NullBool{Bool: false, Valid: true}) {
+		return errors.Errorf("listed overwrite is %+v", listed.Overwrite)
+	}
+	if subs, err = s.GetSubscriptions(ctx, "other-guild"); err != nil {
+		return err
+	}
+	if len(subs) != 1 || subs[0].Overwrite.Embeds.Valid || subs[0].Overwrite.Webhooks.Valid {
+		return errors.Errorf("new subscription should inherit the guild's settings, got %+v", subs)
+	}
+
+	if err = s.DestroySubscription(ctx, other.ID); err != nil {
+		return err
+	}
+	if _, err = s.GetSubscription(ctx, other.ID); !isNoRows(err) {
+		return errors.Errorf("destroyed subscription returned %v", err)
+	}
+	if err = s.DestroySubscription(ctx, other.ID); !isNoRows(err) {
+		return errors.Errorf("destroying a missing subscription returned %v", err)
+	}
+	if err = s.ModifySubscriptionChannel(ctx, other.ID, "nowhere"); !isNoRows(err) {
+		return errors.Errorf("moving a missing subscription returned %v", err)
+	}
+	return nil
+}
+
+func checkConcurrentSubscriptions(ctx context.Context, s feedbot.Storage) error {
+	f, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/race", "")
+	if err != nil {
+		return err
+	}
+
+	const n = 8
+	type result struct {
+		sub *feedbot.Subscription
+		err error
+	}
+	results := make(chan result, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub, err := s.AddSubscription(ctx, "race-channel", "race-guild", f.ID)
+			results <- result{sub, err}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	created, id := 0, 0
+	for r := range results {
+		switch {
+		case r.err == nil:
+			created++
+		case r.err != feedbot.ErrSubExists:
+			return r.err
+		}
+		if id != 0 && r.sub.ID != id {
+			return errors.Errorf("concurrent adds returned subscriptions %d and %d", id, r.sub.ID)
+		}
+		id = r.sub.ID
+	}
+	if created != 1 {
+		return errors.Errorf("%d concurrent adds created %d subscriptions, expected 1", n, created)
+	}
+
+	subs, err := s.GetSubscriptions(ctx, "race-guild")
+	if err != nil {
+		return err
+	}
+	if len(subs) != 1 || subs[0].ID != id {
+		return errors.Errorf("guild lists %+v, expected subscription %d", subs, id)
+	}
+	return nil
+}
+
+func checkPausedSubscriptions(ctx context.Context, s feedbot.Storage) error {
+	f, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/paused", "")
+	if err != nil {
+		return err
+	}
+	sub, err := s.AddSubscription(ctx, "paused-channel", "paused-guild", f.ID)
+	if err != nil {
+		return err
+	}
+	if got, err := s.GetSubscription(ctx, sub.ID); err != nil || got.Pause != nil {
+		return errors.Errorf("new subscription has pause %+v (err %v)", got.Pause, err)
+	}
+
+	now := time.Now()
+	until := now.Add(time.Hour)
+	pause := feedbot.Pause{At: now, Until: &until, Seen: now.Add(-time.Hour)}
+	if err = s.PauseSubscription(ctx, sub.ID, pause); err != nil {
+		return err
+	}
+	samePause := func(p *feedbot.Pause) bool {
+		return p != nil && sameTime(p.At, pause.At) && p.Until != nil && sameTime(*p.Until, until) && sameTime(p.Seen, pause.Seen)
+	}
+	// every getter returns the pause, since delivery and list both need it
+	got, err := s.GetSubscription(ctx, sub.ID)
+	if err != nil {
+		return err
+	}
+	if !samePause(got.Pause) {
+		return errors.Errorf("paused subscription has pause %+v, expected %+v", got.Pause, pause)
+	}
+	subs, err := s.GetSubscriptions(ctx, "paused-guild")
+	if err != nil || len(subs) != 1 || !samePause(subs[0].Pause) {
+		return errors.Errorf("guild's subscriptions are %+v (err %v)", subs, err)
+	}
+	subs, err = s.GetFeedSubscriptions(ctx, f.ID)
+	if err != nil || len(subs) != 1 || !samePause(subs[0].Pause) {
+		return errors.Errorf("feed's subscriptions are %+v (err %v)", subs, err)
+	}
+	if !got.Paused(now) || got.Paused(until.Add(time.Second)) {
+		return errors.New("a pause with an end isn't paused only until then")
+	}
+
+	// pausing until resumed
+	pause.Until = nil
+	if err = s.PauseSubscription(ctx, sub.ID, pause); err != nil {
+		return err
+	}
+	if got, err = s.GetSubscription(ctx, sub.ID); err != nil || got.Pause == nil || got.Pause.Until != nil {
+		return errors.Errorf("subscription paused until resumed has pause %+v (err %v)", got.Pause, err)
+	}
+
+	if err = s.ResumeSubscription(ctx, sub.ID); err != nil {
+		return err
+	}
+	if got, err = s.GetSubscription(ctx, sub.ID); err != nil || got.Pause != nil {
+		return errors.Errorf("resumed subscription has pause %+v (err %v)", got.Pause, err)
+	}
+	if err = s.PauseSubscription(ctx, sub.ID+1000, pause); !isNoRows(err) {
+		return errors.Errorf("pausing a missing subscription returned %v", err)
+	}
+	if err = s.ResumeSubscription(ctx, sub.ID+1000); !isNoRows(err) {
+		return errors.Errorf("resuming a missing subscription returned %v", err)
+	}
+	return nil
+}
+
+func checkGuildConfig(ctx context.Context, s feedbot.Storage) error {
+	if _, err := s.GetGuildConfig(ctx, "config-guild"); !isNoRows(err) {
+		return errors.Errorf("getting a missing guild config returned %v", err)
+	}
+	if err := s.ModifyGuildContact(ctx, "config-guild", "nobody"); !isNoRows(err) {
+		return errors.Errorf("modifying a missing guild config returned %v", err)
+	}
+
+	if err := s.CreateGuildConfig(ctx, "config-guild", "owner"); err != nil {
+		return err
+	}
+	g, err := s.GetGuildConfig(ctx, "config-guild")
+	if err != nil {
+		return err
+	}
+	if g.Contact != "owner" || g.Embeds || g.Webhooks || g.Prefix != "" {
+		return errors.Errorf("new guild config is %+v", g)
+	}
+
+	if err = s.ModifyGuildContact(ctx, "config-guild", "admin"); err != nil {
+		return err
+	}
+	if err = s.ModifyGuildEmbeds(ctx, "config-guild", true); err != nil {
+		return err
+	}
+	if err = s.ModifyGuildWebhooks(ctx, "config-guild", true); err != nil {
+		return err
+	}
+	if err = s.ModifyGuildPrefix(ctx, "config-guild", "!rss"); err != nil {
+		return err
+	}
+	// rejoining keeps the existing config
+	if err = s.CreateGuildConfig(ctx, "config-guild", "owner"); err != nil {
+		return err
+	}
+	want := feedbot.GuildConfig{ID: "config-guild", Contact: "admin", Embeds: true, Webhooks: true, Prefix: "!rss"}
+	if g, err = s.GetGuildConfig(ctx, "config-guild"); err != nil {
+		return err
+	}
+	if *g != want {
+		return errors.Errorf("guild config is %+v, expected %+v", g, want)
+	}
+	if err = s.ModifyGuildWebhooks(ctx, "config-guild", false); err != nil {
+		return err
+	}
+	if g, err = s.GetGuildConfig(ctx, "config-guild"); err != nil {
+		return err
+	}
+	if !g.Embeds || g.Webhooks {
+		return errors.Errorf("setting webhooks changed the guild config to %+v", g)
+	}
+	// an empty prefix restores the default
+	if err = s.ModifyGuildPrefix(ctx, "config-guild", ""); err != nil {
+		return err
+	}
+	if g, err = s.GetGuildConfig(ctx, "config-guild"); err != nil {
+		return err
+	}
+	if g.Prefix != "" {
+		return errors.Errorf("resetting the prefix left %q", g.Prefix)
+	}
+	return nil
+}
+
+func checkGuildDeparture(ctx context.Context, s feedbot.Storage) error {
+	f, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/departed", "")
+	if err != nil {
+		return err
+	}
+	if err = s.CreateGuildConfig(ctx, "departed-guild", "owner"); err != nil {
+		return err
+	}
+	sub, err := s.AddSubscription(ctx, "departed-channel", "departed-guild", f.ID)
+	if err != nil {
+		return err
+	}
+	if err = s.SetFeedCredentials(ctx, f.ID, "departed-guild", []byte("sealed")); err != nil {
+		return err
+	}
+
+	left := time.Now().Add(-time.Hour)
+	if err = s.MarkGuildLeft(ctx, "departed-guild", left); err != nil {
+		return err
+	}
+	departed := func(before time.Time) (bool, error) {
+		ids, err := s.GetDepartedGuilds(ctx, before)
+		for _, id := range ids {
+			if id == "departed-guild" {
+				return true, err
+			}
+		}
+		return false, err
+	}
+	if ok, err := departed(left.Add(-time.Minute)); err != nil || ok {
+		return errors.Errorf("guild was listed as departed before it left (err %v)", err)
+	}
+	if ok, err := departed(time.Now()); err != nil || !ok {
+		return errors.Errorf("guild wasn't listed as departed (err %v)", err)
+	}
+
+	// rejoining forgets the departure
+	if err = s.CreateGuildConfig(ctx, "departed-guild", "owner"); err != nil {
+		return err
+	}
+	if ok, err := departed(time.Now()); err != nil || ok {
+		return errors.Errorf("rejoined guild was listed as departed (err %v)", err)
+	}
+
+	if err = s.DestroyGuildData(ctx, "departed-guild"); err != nil {
+		return err
+	}
+	if _, err = s.GetGuildConfig(ctx, "departed-guild"); !isNoRows(err) {
+		return errors.Errorf("destroyed guild config returned %v", err)
+	}
+	if _, err = s.GetSubscription(ctx, sub.ID); !isNoRows(err) {
+		return errors.Errorf("destroyed guild's subscription returned %v", err)
+	}
+	if c, err := s.GetFeedCredentials(ctx, f.ID); err != nil || c != nil {
+		return errors.Errorf("destroyed guild's credentials returned %+v, %v", c, err)
+	}
+	if subs, err := s.GetSubscriptions(ctx, "departed-guild"); err != nil || len(subs) != 0 {
+		return errors.Errorf("destroyed guild still has %d subscriptions (err %v)", len(subs), err)
+	}
+	return nil
+}
+
+// checkStats compares counts before and after, since earlier checks leave rows behind
+func checkGuildImport(ctx context.Context, s feedbot.Storage) error {
+	a, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/import-a", "")
+	if err != nil {
+		return err
+	}
+	b, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/import-b", "")
+	if err != nil {
+		return err
+	}
+	if err = s.CreateGuildConfig(ctx, "import-guild", "owner"); err != nil {
+		return err
+	}
+	existing, err := s.AddSubscription(ctx, "import-channel-a", "import-guild", a.ID)
+	if err != nil {
+		return err
+	}
+	other, err := s.AddSubscription(ctx, "import-other-channel", "import-other-guild", a.ID)
+	if err != nil {
+		return err
+	}
+
+	yes := sql.NullBool{Bool: true, Valid: true}
+	imp := feedbot.GuildImport{
+		Config: &feedbot.GuildConfig{Contact: "c:import-channel-a", Embeds: true, Prefix: "!import"},
+		Subscriptions: []feedbot.ImportedSubscription{
+			{ChannelID: "import-channel-b", FeedID: b.ID, Webhooks: yes},
+			{ID: existing.ID, Embeds: yes},
+		},
+	}
+	// an import which fails part way changes nothing, including another guild's subscription
+	for _, bad := range []feedbot.ImportedSubscription{{ID: 1 << 30, Embeds: yes}, {ID: other.ID, Embeds: yes}} {
+		failing := imp
+		failing.Subscriptions = append(append([]feedbot.ImportedSubscription{}, imp.Subscriptions...), bad)
+		if _, err = s.ImportGuild(ctx, "import-guild", failing); !isNoRows(err) {
+			return errors.Errorf("importing subscription %d returned %v", bad.ID, err)
+		}
+		g, err := s.GetGuildConfig(ctx, "import-guild")
+		if err != nil {
+			return err
+		}
+		if g.Contact != "owner" || g.Embeds || g.Prefix != "" {
+			return errors.Errorf("a failed import changed the guild config to %+v", g)
+		}
+		subs, err := s.GetSubscriptions(ctx, "import-guild")
+		if err != nil {
+			return err
+		}
+		if len(subs) != 1 || subs[0].Overwrite.Embeds.Valid {
+			return errors.Errorf("a failed import changed the guild's subscriptions to %+v", subs)
+		}
+		subs, err = s.GetSubscriptions(ctx, "import-other-guild")
+		if err != nil {
+			return err
+		}
+		if len(subs) != 1 || subs[0].Overwrite.Embeds.Valid {
+			return errors.Errorf("a failed import changed another guild's subscriptions to %+v", subs)
+		}
+	}
+
+	// a subscription the channel already has has its overwrites set, rather than being added
+	imp.Subscriptions = append(imp.Subscriptions, feedbot.ImportedSubscription{ChannelID: "import-channel-a", FeedID: a.ID, Embeds: yes, Webhooks: yes})
+	created, err := s.ImportGuild(ctx, "import-guild", imp)
+	if err != nil {
+		return err
+	}
+	if created != 1 {
+		return errors.Errorf("import created %d subscriptions, expected 1", created)
+	}
+	want := feedbot.GuildConfig{ID: "import-guild", Contact: "c:import-channel-a", Embeds: true, Prefix: "!import"}
+	if g, err := s.GetGuildConfig(ctx, "import-guild"); err != nil {
+		return err
+	} else if *g != want {
+		return errors.Errorf("imported guild config is %+v, expected %+v", g, want)
+	}
+	subs, err := s.GetSubscriptions(ctx, "import-guild")
+	if err != nil {
+		return err
+	}
+	if len(subs) != 2 {
+		return errors.Errorf("guild has %d subscriptions after the import, expected 2", len(subs))
+	}
+	for _, sub := range subs {
+		if sub.ChannelID == "import-channel-a" && (sub.ID != existing.ID || sub.Overwrite.Embeds != yes || sub.Overwrite.Webhooks != yes) ||
+			sub.ChannelID == "import-channel-b" && (sub.Feed.URI != b.URI || sub.Overwrite.Embeds.Valid || sub.Overwrite.Webhooks != yes) {
+			return errors.Errorf("imported subscription is %+v with overwrites %+v", sub, sub.Overwrite)
+		}
+	}
+
+	if _, err = s.ImportGuild(ctx, "import-missing-guild", feedbot.GuildImport{Config: &want}); !isNoRows(err) {
+		return errors.Errorf("importing a missing guild's config returned %v", err)
+	}
+	return nil
+}
+
+func checkStats(ctx context.Context, s feedbot.Storage) error {
+	before, err := s.GetStats(ctx)
+	if err != nil {
+		return err
+	}
+	expect := func(guilds, subs, feeds int) error {
+		after, err := s.GetStats(ctx)
+		if err != nil {
+			return err
+		}
+		want := feedbot.Stats{
+			Guilds:        before.Guilds + guilds,
+			Subscriptions: before.Subscriptions + subs,
+			ActiveFeeds:   before.ActiveFeeds + feeds,
+		}
+		if *after != want {
+			return errors.Errorf("stats are %+v, expected %+v", after, want)
+		}
+		return nil
+	}
+
+	f, err := s.GetOrCreateFeed(ctx, "https://feeds.example.com/stats", "")
+	if err != nil {
+		return err
+	}
+	if err = expect(0, 0, 0); err != nil {
+		return errors.Wrap(err, "unsubscribed feed")
+	}
+	if err = s.CreateGuildConfig(ctx, "stats-guild", "owner"); err != nil {
+		return err
+	}
+	for _, channel := range []string{"stats-channel", "stats-other-channel"} {
+		if _, err = s.AddSubscription(ctx, channel, "stats-guild", f.ID); err != nil {
+			return err
+		}
+	}
+	if err = expect(1, 2, 1); err != nil {
+		return errors.Wrap(err, "subscribed feed")
+	}
+	if err = s.MarkGuildLeft(ctx, "stats-guild", time.Now()); err != nil {
+		return err
+	}
+	return errors.Wrap(expect(0, 0, 0), "departed guild")
+}
+
+func checkLeases(ctx context.Context, s feedbot.Storage) error {
+	const ttl = time.Minute
+	now := time.Now().UTC()
+	acquire := func(holder string, at time.Time, want bool) error {
+		ok, err := s.AcquireLease(ctx, "check-lease", holder, at, ttl)
+		if err != nil {
+			return err
+		}
+		if ok != want {
+			return errors.Errorf("%s acquiring the lease at %v returned %v, expected %v", holder, at.Sub(now), ok, want)
+		}
+		return nil
+	}
+
+	if err := acquire("first", now, true); err != nil {
+		return err
+	}
+	if err := acquire("second", now.Add(ttl/2), false); err != nil {
+		return errors.Wrap(err, "held lease")
+	}
+	// renewing extends the lease
+	if err := acquire("first", now.Add(ttl/2), true); err != nil {
+		return err
+	}
+	if err := acquire("second", now.Add(ttl+time.Second), false); err != nil {
+		return errors.Wrap(err, "renewed lease")
+	}
+	if err := acquire("second", now.Add(2*ttl), true); err != nil {
+		return errors.Wrap(err, "expired lease")
+	}
+
+	// only the holder can release a lease
+	if err := s.ReleaseLease(ctx, "check-lease", "first"); err != nil {
+		return err
+	}
+	if err := acquire("first", now.Add(2*ttl), false); err != nil {
+		return errors.Wrap(err, "lease released by another holder")
+	}
+	if err := s.ReleaseLease(ctx, "check-lease", "second"); err != nil {
+		return err
+	}
+	return errors.Wrap(acquire("first", now.Add(2*ttl), true), "released lease")
+}
@@ -0,0 +1,405 @@
+package feedbot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/pkg/errors"
+)
+
+// keys in gofeed.Feed.Custom where the Fetcher records a feed's WebSub hub
+const (
+	customHub  = "websub:hub"
+	customSelf = "websub:self"
+)
+
+// WebSubConfig contains the settings for receiving WebSub (PubSubHubbub) pushes
+type WebSubConfig struct {
+	// Addr is the address the callback server listens on, e.g. ":8080"
+	Addr string
+	// CallbackURL is the public URL which routes to Addr, e.g. "https://feedbot.example.com"
+	CallbackURL string
+	// Lease is the subscription lifetime requested from hubs; hubs may choose another
+	Lease time.Duration
+}
+
+// DefaultWebSubConfig leaves WebSub disabled, since a CallbackURL is required
+var DefaultWebSubConfig = WebSubConfig{
+	Addr:  ":8080",
+	Lease: 10 * 24 * time.Hour,
+}
+
+// WebSub subscribes to the hubs advertised by feeds, and receives their pushes through an
+// embedded HTTP server
+type WebSub struct {
+	config  WebSubConfig
+	storage Storage
+	fetcher *Fetcher
+	handle  func(ctx context.Context, feedID int, feed *gofeed.Feed) error
+	log     *slog.Logger
+	server  *http.Server
+	// ctx is the context ListenAndServe was called with
+	ctx context.Context
+}
+
+// NewWebSub creates a new WebSub; pushed feeds are passed to handle
+func NewWebSub(config WebSubConfig, s Storage, f *Fetcher, handle func(context.Context, int, *gofeed.Feed) error, log *slog.Logger) *WebSub {
+	w := &WebSub{
+		config:  config,
+		storage: s,
+		fetcher: f,
+		handle:  handle,
+		log:     log,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/websub/", w.serveCallback)
+	w.server = &http.Server{
+		Addr:         config.Addr,
+		Handler:      mux,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	return w
+}
+
+// ListenAndServe runs the callback server until Shutdown is called; requests are handled
+// under ctx, so pushes stop being processed once it is done
+func (w *WebSub) ListenAndServe(ctx context.Context) error {
+	w.ctx = ctx
+	w.server.BaseContext = func(net.Listener) context.Context { return ctx }
+	err := w.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+// Shutdown stops the callback server, waiting until ctx is done for pushes which are
+// being handled
+func (w *WebSub) Shutdown(ctx context.Context) error {
+	return errors.WithStack(w.server.Shutdown(ctx))
+}
+
+// discover subscribes to the hub a feed advertises, if we aren't already subscribed
+func (w *WebSub) discover(ctx context.Context, dbFeed *Feed, feed *gofeed.Feed) error {
+	hub := feed.Custom[customHub]
+	if hub == "" {
+		return nil
+	}
+	topic := feed.Custom[customSelf]
+	if topic == "" {
+		topic = dbFeed.URI
+	}
+
+	existing, err := w.storage.GetWebSubSubscription(ctx, dbFeed.ID)
+	if err != nil {
+		return err
+	}
+	// a pending subscription is left alone until renew picks it back up
+	if existing != nil && existing.Hub == hub && existing.Topic == topic {
+		return nil
+	}
+	return w.subscribe(ctx, dbFeed.ID, hub, topic)
+}
+
+// renew resubscribes every lease which expires within the given window; subscriptions
+// a hub never verified are retried the same way. Failures are logged, and retried at the
+// next renewal.
+func (w *WebSub) renew(ctx context.Context, within time.Duration) {
+	subs, err := w.storage.GetExpiringWebSubSubscriptions(ctx, time.Now().Add(within))
+	if err != nil {
+		w.log.Error("couldn't find expiring websub subscriptions", "err", err)
+		return
+	}
+
+	for _, s := range subs {
+		if err = w.subscribe(ctx, s.FeedID, s.Hub, s.Topic); err != nil {
+			w.log.Warn("couldn't renew websub subscription", "feed_id", s.FeedID, "err", err)
+		}
+	}
+}
+
+// subscribe asks a hub to push a topic to us; the subscription stays pending, and the feed
+// keeps being polled, until the hub verifies it through the callback.
+func (w *WebSub) subscribe(ctx context.Context, feedID int, hub, topic string) error {
+	secret, err := randomToken(24)
+	if err != nil {
+		return err
+	}
+	// only the hub is sent the callback URL, so only it can verify this request
+	token, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+
+	s := &WebSubSubscription{
+		FeedID: feedID,
+		Hub:    hub,
+		Topic:  topic,
+		Secret: secret,
+		// retry at the next renewal if the hub never calls back
+		LeaseExpires: time.Now(),
+	}
+	if existing, err := w.storage.GetWebSubSubscription(ctx, feedID); err != nil {
+		return err
+	} else if existing != nil && existing.Active && existing.Hub == hub && existing.Topic == topic {
+		// keep receiving pushes signed with the old secret until the renewal is verified
+		s = existing
+	}
+	s.Pending = token
+	if err := w.storage.SetWebSubSubscription(ctx, s); err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {topic},
+		"hub.callback":      {w.callback(feedID, token)},
+		"hub.secret":        {s.Secret},
+		"hub.lease_seconds": {strconv.Itoa(int(w.config.Lease / time.Second))},
+	}
+	return errors.Wrapf(w.fetcher.PostForm(ctx, hub, form), "couldn't subscribe to hub %s", hub)
+}
+
+func (w *WebSub) callback(feedID int, token string) string {
+	return fmt.Sprintf("%s/websub/%d/%s", strings.TrimRight(w.config.CallbackURL, "/"), feedID, token)
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sameToken compares a callback URL's token in constant time; an empty token never matches
+func sameToken(token, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// serveCallback handles /websub/<feed id>/<token>; subscriptions made before callbacks
+// carried a token are pushed to /websub/<feed id> until they are renewed
+func (w *WebSub) serveCallback(rw http.ResponseWriter, r *http.Request) {
+	id, token, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/websub/"), "/")
+	feedID, err := strconv.Atoi(id)
+	if err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+	s, err := w.storage.GetWebSubSubscription(r.Context(), feedID)
+	if err != nil {
+		w.log.Error("couldn't find websub subscription", "feed_id", feedID, "err", err)
+		http.Error(rw, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.verify(rw, r, feedID, token, s)
+	case http.MethodPost:
+		w.receive(rw, r, feedID, token, s)
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// verify answers a hub's verification of intent, or its denial of a subscription. Only
+// the request we last sent the hub may be verified, through the token in its callback
+// URL; anyone can find a feed's topic, and its ID is easily guessed.
+func (w *WebSub) verify(rw http.ResponseWriter, r *http.Request, feedID int, token string, s *WebSubSubscription) {
+	q := r.URL.Query()
+	mode, topic := q.Get("hub.mode"), q.Get("hub.topic")
+
+	if s == nil || topic != s.Topic {
+		// we never asked for this; answering unsubscribes with a 404 lets them lapse too
+		http.NotFound(rw, r)
+		return
+	}
+
+	switch {
+	case mode == "subscribe" && sameToken(token, s.Pending):
+		// a hub may grant a shorter lease than we asked for, but not a longer one, so a
+		// lapsed subscription is always noticed and the feed polled again
+		lease := w.config.Lease
+		if secs, err := strconv.Atoi(q.Get("hub.lease_seconds")); err == nil && secs > 0 && secs < int(lease/time.Second) {
+			lease = time.Duration(secs) * time.Second
+		}
+		s.Active = true
+		s.LeaseExpires = time.Now().Add(lease)
+		s.Callback, s.Pending = token, ""
+		if err := w.storage.SetWebSubSubscription(r.Context(), s); err != nil {
+			w.log.Error("couldn't verify websub subscription", "feed_id", feedID, "err", err)
+			http.Error(rw, "internal error", http.StatusInternalServerError)
+			return
+		}
+		rw.Write([]byte(q.Get("hub.challenge")))
+	case mode == "denied" && (sameToken(token, s.Pending) || sameToken(token, s.Callback)):
+		// fall back to polling; the next poll will discover the hub and ask it again
+		w.log.Info("hub denied websub subscription", "feed_id", feedID, "reason", q.Get("hub.reason"))
+		if err := w.storage.DestroyWebSubSubscription(r.Context(), feedID); err != nil {
+			w.log.Error("couldn't remove websub subscription", "feed_id", feedID, "err", err)
+		}
+		rw.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+// receive handles content distributed by a hub
+func (w *WebSub) receive(rw http.ResponseWriter, r *http.Request, feedID int, token string, s *WebSubSubscription) {
+	if s == nil || subtle.ConstantTimeCompare([]byte(token), []byte(s.Callback)) != 1 {
+		// a 410 tells well-behaved hubs to drop the subscription, including ones a
+		// renewal replaced
+		http.Error(rw, "gone", http.StatusGone)
+		return
+	}
+
+	body, err := ioutil.ReadAll(&limitedBody{ReadCloser: r.Body, remaining: w.fetcher.config.MaxSize})
+	if err != nil {
+		http.Error(rw, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// the spec asks for a 2xx even when the signature doesn't match, so the hub can't be
+	// used to probe for valid secrets; the content is simply dropped
+	rw.WriteHeader(http.StatusAccepted)
+	if !validSignature(r.Header.Get("X-Hub-Signature"), s.Secret, body) {
+		w.log.Warn("dropped websub push with an invalid signature", "feed_id", feedID)
+		return
+	}
+
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+	if err != nil {
+		w.log.Warn("couldn't parse websub push", "feed_id", feedID, "err", err)
+		return
+	}
+	// the hub has its answer, so its disconnecting mustn't abandon the delivery
+	if err = w.handle(w.ctx, feedID, feed); err != nil {
+		w.log.Error("couldn't handle websub push", "feed_id", feedID, "err", err)
+	}
+}
+
+// validSignature checks an X-Hub-Signature header of the form "method=hexdigest"
+func validSignature(header, secret string, body []byte) bool {
+	parts := strings.SplitN(header, "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	var h func() hash.Hash
+	switch parts[0] {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha384":
+		h = sha512.New384
+	case "sha512":
+		h = sha512.New
+	default:
+		return false
+	}
+
+	want, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// discoverHub finds the rel="hub" and rel="self" links of a feed, preferring its HTTP
+// Link header over the links in its body
+func discoverHub(header http.Header, body []byte) (hub, self string) {
+	for _, v := range header["Link"] {
+		for _, link := range strings.Split(v, ",") {
+			href, rel := parseLinkHeader(link)
+			if rel["hub"] && hub == "" {
+				hub = href
+			}
+			if rel["self"] && self == "" {
+				self = href
+			}
+		}
+	}
+	if hub != "" {
+		return hub, self
+	}
+
+	// both Atom feeds and RSS's atom:link use <link rel="hub" href="...">; gofeed doesn't
+	// keep rel on Atom links, so look for them ourselves
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		// hub links belong to the channel; stop at the first entry
+		if el.Name.Local == "item" || el.Name.Local == "entry" {
+			break
+		}
+		if el.Name.Local != "link" {
+			continue
+		}
+		var rel, href string
+		for _, a := range el.Attr {
+			switch a.Name.Local {
+			case "rel":
+				rel = a.Value
+			case "href":
+				href = a.Value
+			}
+		}
+		if rel == "hub" && hub == "" {
+			hub = href
+		}
+		if rel == "self" && self == "" {
+			self = href
+		}
+	}
+	return hub, self
+}
+
+// parseLinkHeader parses a single `<href>; rel="a b"` link value
+func parseLinkHeader(link string) (string, map[string]bool) {
+	rels := map[string]bool{}
+	parts := strings.Split(link, ";")
+	href := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 || strings.ToLower(kv[0]) != "rel" {
+			continue
+		}
+		for _, r := range strings.Fields(strings.Trim(kv[1], `"`)) {
+			rels[strings.ToLower(r)] = true
+		}
+	}
+	return href, rels
+}
@@ -0,0 +1,269 @@
+package feedbot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+const pushedFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>pushed</title>
+<item><title>hello</title><link>https://feeds.example.com/hello</link></item>
+</channel></rss>`
+
+// standInHub is a minimal WebSub hub, which verifies each subscription request before
+// answering it and can then push content to the subscriber
+type standInHub struct {
+	*httptest.Server
+	t *testing.T
+
+	mu sync.Mutex
+	// lease is the hub.lease_seconds the hub grants
+	lease    string
+	callback string
+	secret   string
+}
+
+func newStandInHub(t *testing.T) *standInHub {
+	h := &standInHub{t: t, lease: "3600"}
+	h.Server = httptest.NewServer(http.HandlerFunc(h.serveSubscribe))
+	t.Cleanup(h.Close)
+	return h
+}
+
+func (h *standInHub) serveSubscribe(rw http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("hub.mode") != "subscribe" {
+		http.Error(rw, "bad request", http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	lease := h.lease
+	h.mu.Unlock()
+
+	callback := r.Form.Get("hub.callback")
+	q := url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {r.Form.Get("hub.topic")},
+		"hub.challenge":     {"challenge-accepted"},
+		"hub.lease_seconds": {lease},
+	}
+	resp, err := http.Get(callback + "?" + q.Encode())
+	if err != nil {
+		h.t.Errorf("hub couldn't verify the subscription: %v", err)
+		http.Error(rw, "verification failed", http.StatusBadGateway)
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "challenge-accepted" {
+		http.Error(rw, "verification failed", http.StatusBadGateway)
+		return
+	}
+
+	h.mu.Lock()
+	h.callback, h.secret = callback, r.Form.Get("hub.secret")
+	h.mu.Unlock()
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// push distributes content to the last verified callback, signed with secret
+func (h *standInHub) push(callback, secret, content string) int {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(content))
+	req, _ := http.NewRequest(http.MethodPost, callback, strings.NewReader(content))
+	req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatalf("couldn't push: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (h *standInHub) subscription() (callback, secret string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.callback, h.secret
+}
+
+func newTestWebSub(t *testing.T, storage Storage, handle func(context.Context, int, *gofeed.Feed) error) *WebSub {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	fc := DefaultFetcherConfig
+	fc.Allow = []*net.IPNet{loopback}
+
+	var w *WebSub
+	callbacks := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.server.Handler.ServeHTTP(rw, r)
+	}))
+	t.Cleanup(callbacks.Close)
+
+	config := DefaultWebSubConfig
+	config.CallbackURL = callbacks.URL
+	w = NewWebSub(config, storage, NewFetcher(fc), handle, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	w.ctx = context.Background()
+	return w
+}
+
+func TestWebSubStandInHub(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	feed, err := storage.GetOrCreateFeed(ctx, "https://feeds.example.com/pushed", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushed := make(chan *gofeed.Feed, 1)
+	w := newTestWebSub(t, storage, func(ctx context.Context, feedID int, f *gofeed.Feed) error {
+		if feedID != feed.ID {
+			t.Errorf("pushed feed %d, expected %d", feedID, feed.ID)
+		}
+		pushed <- f
+		return nil
+	})
+	hub := newStandInHub(t)
+
+	if err = w.subscribe(ctx, feed.ID, hub.URL, feed.URI); err != nil {
+		t.Fatalf("couldn't subscribe: %v", err)
+	}
+	s, err := storage.GetWebSubSubscription(ctx, feed.ID)
+	if err != nil || s == nil {
+		t.Fatalf("subscription is %+v, %v", s, err)
+	}
+	if !s.Active || s.Pending != "" || s.Callback == "" {
+		t.Fatalf("verified subscription is %+v", s)
+	}
+	if d := time.Until(s.LeaseExpires); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("lease expires in %v, the hub granted an hour", d)
+	}
+
+	callback, secret := hub.subscription()
+	if !strings.HasSuffix(callback, "/"+s.Callback) {
+		t.Errorf("hub was given callback %s, expected its token to be %s", callback, s.Callback)
+	}
+	if code := hub.push(callback, secret, pushedFeed); code != http.StatusAccepted {
+		t.Fatalf("push was answered with %d", code)
+	}
+	select {
+	case f := <-pushed:
+		if len(f.Items) != 1 || f.Items[0].Title != "hello" {
+			t.Errorf("pushed feed is %+v", f)
+		}
+	default:
+		t.Fatal("push wasn't handled")
+	}
+
+	if code := hub.push(callback, "not the secret", pushedFeed); code != http.StatusAccepted {
+		t.Errorf("badly signed push was answered with %d, expected a 202 regardless", code)
+	}
+	select {
+	case <-pushed:
+		t.Error("badly signed push was handled")
+	default:
+	}
+
+	// a renewal is verified through a new callback, and pushes to the old one are refused
+	hub.mu.Lock()
+	hub.lease = "2147483647"
+	hub.mu.Unlock()
+	if err = w.subscribe(ctx, feed.ID, hub.URL, feed.URI); err != nil {
+		t.Fatalf("couldn't renew: %v", err)
+	}
+	renewed, _ := storage.GetWebSubSubscription(ctx, feed.ID)
+	if renewed.Callback == s.Callback || renewed.Secret != s.Secret {
+		t.Errorf("renewed subscription is %+v, was %+v", renewed, s)
+	}
+	if d := time.Until(renewed.LeaseExpires); d > w.config.Lease {
+		t.Errorf("lease expires in %v, longer than the %v asked for", d, w.config.Lease)
+	}
+	if code := hub.push(callback, secret, pushedFeed); code != http.StatusGone {
+		t.Errorf("push to a replaced callback was answered with %d", code)
+	}
+}
+
+func TestWebSubForgedVerification(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	feed, err := storage.GetOrCreateFeed(ctx, "https://feeds.example.com/forged", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWebSub(t, storage, nil)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	active := &WebSubSubscription{
+		FeedID:       feed.ID,
+		Hub:          "https://hub.example.com",
+		Topic:        feed.URI,
+		Secret:       "secret",
+		Active:       true,
+		LeaseExpires: expires,
+		Callback:     "verified",
+		Pending:      "pending",
+	}
+	if err = storage.SetWebSubSubscription(ctx, active); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(path, mode, lease string) int {
+		q := url.Values{
+			"hub.mode":          {mode},
+			"hub.topic":         {feed.URI},
+			"hub.challenge":     {"forged"},
+			"hub.lease_seconds": {lease},
+		}
+		rec := httptest.NewRecorder()
+		w.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?"+q.Encode(), nil))
+		return rec.Code
+	}
+	base := fmt.Sprintf("/websub/%d/", feed.ID)
+	for _, tc := range []struct{ path, mode string }{
+		{base, "subscribe"},
+		{base + "guessed", "subscribe"},
+		// the verified callback is known to the hub, but only a request we sent is verified
+		{base + "verified", "subscribe"},
+		{base, "denied"},
+		{base + "guessed", "denied"},
+	} {
+		if code := verify(tc.path, tc.mode, "2147483647"); code != http.StatusNotFound {
+			t.Errorf("%s to %s was answered with %d", tc.mode, tc.path, code)
+		}
+	}
+	s, err := storage.GetWebSubSubscription(ctx, feed.ID)
+	if err != nil || s == nil {
+		t.Fatalf("subscription is %+v, %v", s, err)
+	}
+	if !s.LeaseExpires.Equal(expires) || s.Callback != "verified" || s.Pending != "pending" {
+		t.Errorf("forged verifications changed the subscription to %+v", s)
+	}
+
+	// the hub's own verification is accepted, with its lease clamped to what we asked for
+	if code := verify(base+"pending", "subscribe", "2147483647"); code != http.StatusOK {
+		t.Fatalf("verification was answered with %d", code)
+	}
+	s, _ = storage.GetWebSubSubscription(ctx, feed.ID)
+	if s.Callback != "pending" || s.Pending != "" || time.Until(s.LeaseExpires) > w.config.Lease {
+		t.Errorf("verified subscription is %+v", s)
+	}
+
+	body := bytes.NewBufferString(pushedFeed)
+	rec := httptest.NewRecorder()
+	w.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, base+"verified", body))
+	if rec.Code != http.StatusGone {
+		t.Errorf("push to a replaced callback was answered with %d", rec.Code)
+	}
+}